@@ -0,0 +1,219 @@
+package common
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"io"
+	"strings"
+
+	"github.com/astaxie/beego"
+	"github.com/astaxie/beego/logs"
+)
+
+// Envelope format: enc:v1:<key id>:<algorithm>:<base64(nonce|ciphertext)>.
+// Values without the prefix are the legacy base64 encoded AES-CBC output of
+// AesString, encrypted with the key in `key`.
+const (
+	EnvelopePrefix  = "enc"
+	EnvelopeVersion = "v1"
+	AlgAesGcm       = "aes-gcm"
+	AlgAesCbc       = "aes-cbc"
+	LegacyKeyId     = "legacy"
+)
+
+// LoadSecretKeys reads crypto::keys, a comma separated list of id:base64key
+// entries, and the id of the key new secrets are encrypted with
+func LoadSecretKeys() (map[string][]byte, string, error) {
+	keys := make(map[string][]byte)
+	for _, entry := range strings.Split(beego.AppConfig.String("crypto::keys"), ",") {
+		entry = strings.TrimSpace(entry)
+		if len(entry) == 0 {
+			continue
+		}
+		kv := strings.SplitN(entry, ":", 2)
+		if len(kv) != 2 || len(kv[0]) == 0 || strings.Contains(kv[0], ":") {
+			return nil, "", errors.New("invalid entry in crypto::keys")
+		}
+		key, err := base64.StdEncoding.DecodeString(kv[1])
+		if err != nil {
+			return nil, "", errors.New("invalid key in crypto::keys, id: " + kv[0])
+		}
+		if len(key) != 16 && len(key) != 24 && len(key) != 32 {
+			return nil, "", errors.New("keys must be 16, 24 or 32 bytes, id: " + kv[0])
+		}
+		keys[kv[0]] = key
+	}
+	activeKey := beego.AppConfig.String("crypto::active_key")
+	if len(activeKey) > 0 {
+		if _, ok := keys[activeKey]; !ok {
+			return nil, "", errors.New("crypto::active_key is not in crypto::keys")
+		}
+	}
+	return keys, activeKey, nil
+}
+
+// ActiveKeyId returns the id new secrets are encrypted with
+func ActiveKeyId() string {
+	_, activeKey, err := LoadSecretKeys()
+	if err != nil || len(activeKey) == 0 {
+		return LegacyKeyId
+	}
+	return activeKey
+}
+
+// EncryptSecret encrypts a secret with the active key using AES-GCM. Without
+// an active key it falls back to the legacy format.
+func EncryptSecret(plaintext []byte) (string, string, error) {
+	keys, activeKey, err := LoadSecretKeys()
+	if err != nil {
+		return "", "", err
+	}
+	if len(activeKey) == 0 {
+		cipherText := AesString(plaintext)
+		if len(cipherText) == 0 {
+			return "", "", errors.New("failed to encrypt the secret")
+		}
+		return base64.StdEncoding.EncodeToString([]byte(cipherText)), AlgAesCbc, nil
+	}
+	gcm, err := newGcm(keys[activeKey])
+	if err != nil {
+		return "", "", err
+	}
+	nonce := make([]byte, gcm.NonceSize())
+	if _, err = io.ReadFull(rand.Reader, nonce); err != nil {
+		return "", "", err
+	}
+	header := strings.Join([]string{EnvelopePrefix, EnvelopeVersion, activeKey, AlgAesGcm}, ":")
+	sealed := gcm.Seal(nonce, nonce, plaintext, []byte(header))
+	return header + ":" + base64.StdEncoding.EncodeToString(sealed), AlgAesGcm, nil
+}
+
+// DecryptSecret decrypts a secret in either format and returns the id of the
+// key it was encrypted with
+func DecryptSecret(content string) ([]byte, string, error) {
+	if !strings.HasPrefix(content, EnvelopePrefix+":") {
+		data, err := base64.StdEncoding.DecodeString(content)
+		if err != nil {
+			return nil, LegacyKeyId, err
+		}
+		plaintext := DesString(string(data))
+		if len(plaintext) == 0 {
+			return nil, LegacyKeyId, errors.New("failed to decrypt the legacy secret")
+		}
+		return plaintext, LegacyKeyId, nil
+	}
+	parts := strings.SplitN(content, ":", 5)
+	if len(parts) != 5 || parts[1] != EnvelopeVersion {
+		return nil, "", errors.New("unsupported envelope version")
+	}
+	keyId, alg := parts[2], parts[3]
+	if alg != AlgAesGcm {
+		return nil, keyId, errors.New("unsupported envelope algorithm: " + alg)
+	}
+	keys, _, err := LoadSecretKeys()
+	if err != nil {
+		return nil, keyId, err
+	}
+	key, ok := keys[keyId]
+	if !ok {
+		return nil, keyId, errors.New("unknown key id: " + keyId)
+	}
+	sealed, err := base64.StdEncoding.DecodeString(parts[4])
+	if err != nil {
+		return nil, keyId, err
+	}
+	gcm, err := newGcm(key)
+	if err != nil {
+		return nil, keyId, err
+	}
+	if len(sealed) < gcm.NonceSize() {
+		return nil, keyId, errors.New("the envelope is too short")
+	}
+	header := strings.Join(parts[:4], ":")
+	plaintext, err := gcm.Open(nil, sealed[:gcm.NonceSize()], sealed[gcm.NonceSize():], []byte(header))
+	return plaintext, keyId, err
+}
+
+func newGcm(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// IsSealed reports whether a value is in the envelope format
+func IsSealed(value string) bool {
+	return strings.HasPrefix(value, EnvelopePrefix+":"+EnvelopeVersion+":")
+}
+
+// envelopeKeyId returns the key id recorded in an envelope
+func envelopeKeyId(value string) string {
+	parts := strings.SplitN(value, ":", 5)
+	if len(parts) != 5 {
+		return ""
+	}
+	return parts[2]
+}
+
+// SealField encrypts a column value into an envelope. Values already sealed
+// under the active key are kept, values under an older key are re-sealed, and
+// values stay plaintext while no active key is configured.
+func SealField(value string) (string, error) {
+	if len(value) == 0 {
+		return value, nil
+	}
+	activeKey := ActiveKeyId()
+	if activeKey == LegacyKeyId {
+		return value, nil
+	}
+	if IsSealed(value) {
+		if envelopeKeyId(value) == activeKey {
+			return value, nil
+		}
+		plaintext, _, err := DecryptSecret(value)
+		if err != nil {
+			return "", err
+		}
+		value = string(plaintext)
+	}
+	sealed, _, err := EncryptSecret([]byte(value))
+	return sealed, err
+}
+
+// OpenField decrypts a column value sealed by SealField, plaintext values
+// written before the migration are returned as they are. A value that cannot
+// be opened, under a key no longer configured for example, is returned sealed
+// with the error, so that it is never written back in place of the data.
+func OpenField(value string) (string, error) {
+	if !IsSealed(value) {
+		return value, nil
+	}
+	plaintext, keyId, err := DecryptSecret(value)
+	if err != nil {
+		logs.Error("OpenField, err: ", err, ",keyId: ", keyId)
+		return value, err
+	}
+	return string(plaintext), nil
+}
+
+// HashField returns the keyed hash a sealed column is looked up by, keyed with
+// crypto::hash_key or, without it, with `key`
+func HashField(value string) string {
+	if len(value) == 0 {
+		return ""
+	}
+	key, err := base64.StdEncoding.DecodeString(beego.AppConfig.String("crypto::hash_key"))
+	if err != nil || len(key) == 0 {
+		key = []byte(beego.AppConfig.String("key"))
+	}
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(value))
+	return hex.EncodeToString(mac.Sum(nil))
+}
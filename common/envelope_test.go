@@ -0,0 +1,153 @@
+package common
+
+import (
+	"bytes"
+	"encoding/base64"
+	"strings"
+	"testing"
+
+	"github.com/astaxie/beego"
+)
+
+var (
+	testKey1 = base64.StdEncoding.EncodeToString(bytes.Repeat([]byte{1}, 32))
+	testKey2 = base64.StdEncoding.EncodeToString(bytes.Repeat([]byte{2}, 16))
+)
+
+// setSecretKeys configures the legacy key, crypto::keys and crypto::active_key
+// until the test ends
+func setSecretKeys(t *testing.T, keys, activeKey string) {
+	values := map[string]string{"key": "0123456789abcdef", "crypto::keys": keys, "crypto::active_key": activeKey}
+	for name, value := range values {
+		beego.AppConfig.Set(name, value)
+	}
+	t.Cleanup(func() {
+		for name := range values {
+			beego.AppConfig.Set(name, "")
+		}
+	})
+}
+
+func TestEncryptSecretRoundTrip(t *testing.T) {
+	cases := []struct {
+		name      string
+		keys      string
+		activeKey string
+		plaintext string
+		wantAlg   string
+		wantKeyId string
+	}{
+		{"aes-256 key", "k1:" + testKey1 + ",k2:" + testKey2, "k1", "kubeconfig", AlgAesGcm, "k1"},
+		{"aes-128 key", "k1:" + testKey1 + ", k2:" + testKey2, "k2", "token: abc", AlgAesGcm, "k2"},
+		{"empty secret", "k1:" + testKey1, "k1", "", AlgAesGcm, "k1"},
+		{"legacy without an active key", "k1:" + testKey1, "", "kubeconfig", AlgAesCbc, LegacyKeyId},
+		{"legacy without keys", "", "", "password", AlgAesCbc, LegacyKeyId},
+	}
+	for _, c := range cases {
+		setSecretKeys(t, c.keys, c.activeKey)
+		sealed, alg, err := EncryptSecret([]byte(c.plaintext))
+		if err != nil {
+			t.Errorf("%s: EncryptSecret() err = %v", c.name, err)
+			continue
+		}
+		if alg != c.wantAlg {
+			t.Errorf("%s: EncryptSecret() alg = %s, want %s", c.name, alg, c.wantAlg)
+		}
+		if isEnvelope := strings.HasPrefix(sealed, EnvelopePrefix+":"); isEnvelope != (c.wantAlg == AlgAesGcm) {
+			t.Errorf("%s: EncryptSecret() = %q, envelope %v", c.name, sealed, isEnvelope)
+		}
+		plaintext, keyId, err := DecryptSecret(sealed)
+		if err != nil || string(plaintext) != c.plaintext || keyId != c.wantKeyId {
+			t.Errorf("%s: DecryptSecret() = %q, %s, %v, want %q, %s", c.name, plaintext, keyId, err,
+				c.plaintext, c.wantKeyId)
+		}
+	}
+}
+
+func TestDecryptSecretAfterRotation(t *testing.T) {
+	setSecretKeys(t, "k1:"+testKey1, "k1")
+	sealed, _, err := EncryptSecret([]byte("kubeconfig"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	setSecretKeys(t, "", "")
+	legacy, _, err := EncryptSecret([]byte("password"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Rotate to k2, both older secrets stay readable
+	setSecretKeys(t, "k1:"+testKey1+",k2:"+testKey2, "k2")
+	cases := []struct {
+		sealed    string
+		want      string
+		wantKeyId string
+	}{
+		{sealed, "kubeconfig", "k1"},
+		{legacy, "password", LegacyKeyId},
+	}
+	for _, c := range cases {
+		plaintext, keyId, err := DecryptSecret(c.sealed)
+		if err != nil || string(plaintext) != c.want || keyId != c.wantKeyId {
+			t.Errorf("DecryptSecret(%q) = %q, %s, %v, want %q, %s", c.sealed, plaintext, keyId, err,
+				c.want, c.wantKeyId)
+		}
+	}
+	if ActiveKeyId() != "k2" {
+		t.Errorf("ActiveKeyId() = %s, want k2", ActiveKeyId())
+	}
+}
+
+func TestDecryptSecretErrors(t *testing.T) {
+	setSecretKeys(t, "k1:"+testKey1, "k1")
+	sealed, _, err := EncryptSecret([]byte("kubeconfig"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	payload := sealed[strings.LastIndex(sealed, ":")+1:]
+	raw, _ := base64.StdEncoding.DecodeString(payload)
+	raw[len(raw)-1] ^= 0xff
+	tampered := strings.TrimSuffix(sealed, payload) + base64.StdEncoding.EncodeToString(raw)
+	cases := []struct {
+		name    string
+		keys    string
+		content string
+	}{
+		{"tampered ciphertext", "k1:" + testKey1, tampered},
+		{"header moved to another key", "k1:" + testKey1 + ",k2:" + testKey1,
+			strings.Replace(sealed, ":k1:", ":k2:", 1)},
+		{"unknown key id", "k2:" + testKey2, sealed},
+		{"unsupported version", "k1:" + testKey1, strings.Replace(sealed, ":v1:", ":v9:", 1)},
+		{"unsupported algorithm", "k1:" + testKey1, strings.Replace(sealed, ":"+AlgAesGcm+":", ":rot13:", 1)},
+		{"truncated envelope", "k1:" + testKey1, "enc:v1:k1:aes-gcm:AAAA"},
+		{"missing fields", "k1:" + testKey1, "enc:v1:k1"},
+		{"legacy not base64", "k1:" + testKey1, "not base64!"},
+	}
+	for _, c := range cases {
+		setSecretKeys(t, c.keys, "")
+		if plaintext, _, err := DecryptSecret(c.content); err == nil {
+			t.Errorf("%s: DecryptSecret() = %q, want an error", c.name, plaintext)
+		}
+	}
+}
+
+func TestLoadSecretKeysErrors(t *testing.T) {
+	cases := []struct {
+		name      string
+		keys      string
+		activeKey string
+	}{
+		{"entry without an id", testKey1, ""},
+		{"key not base64", "k1:not base64!", ""},
+		{"key of a bad length", "k1:" + base64.StdEncoding.EncodeToString([]byte("short")), ""},
+		{"active key not configured", "k1:" + testKey1, "k2"},
+	}
+	for _, c := range cases {
+		setSecretKeys(t, c.keys, c.activeKey)
+		if _, _, err := LoadSecretKeys(); err == nil {
+			t.Errorf("%s: LoadSecretKeys() err = nil, want an error", c.name)
+		}
+		if _, _, err := EncryptSecret([]byte("secret")); err == nil {
+			t.Errorf("%s: EncryptSecret() err = nil, want an error", c.name)
+		}
+	}
+}
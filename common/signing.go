@@ -0,0 +1,60 @@
+package common
+
+import (
+	"crypto/ed25519"
+	"encoding/base64"
+	"errors"
+	"strings"
+
+	"github.com/astaxie/beego"
+)
+
+// AlgEd25519 is the algorithm of the signatures made with certificate::signing_key
+const AlgEd25519 = "ed25519"
+
+// LoadSigningKey reads certificate::signing_key, the base64 seed or private
+// key of ed25519, and its id in certificate::key_id
+func LoadSigningKey() (ed25519.PrivateKey, string, error) {
+	content := beego.AppConfig.String("certificate::signing_key")
+	if len(content) == 0 {
+		return nil, "", errors.New("certificate::signing_key is not set")
+	}
+	key, err := base64.StdEncoding.DecodeString(content)
+	if err != nil {
+		return nil, "", errors.New("invalid certificate::signing_key")
+	}
+	keyId := beego.AppConfig.DefaultString("certificate::key_id", "cert-1")
+	switch len(key) {
+	case ed25519.SeedSize:
+		return ed25519.NewKeyFromSeed(key), keyId, nil
+	case ed25519.PrivateKeySize:
+		return ed25519.PrivateKey(key), keyId, nil
+	}
+	return nil, "", errors.New("certificate::signing_key must be a 32 byte seed or a 64 byte private key")
+}
+
+// LoadVerifyKeys returns the public keys signatures are verified with by id,
+// the key in use and the retired ones in certificate::public_keys, a comma
+// separated list of id:base64key entries
+func LoadVerifyKeys() (map[string]ed25519.PublicKey, error) {
+	keys := make(map[string]ed25519.PublicKey)
+	for _, entry := range strings.Split(beego.AppConfig.String("certificate::public_keys"), ",") {
+		entry = strings.TrimSpace(entry)
+		if len(entry) == 0 {
+			continue
+		}
+		kv := strings.SplitN(entry, ":", 2)
+		if len(kv) != 2 || len(kv[0]) == 0 {
+			return nil, errors.New("invalid entry in certificate::public_keys")
+		}
+		key, err := base64.StdEncoding.DecodeString(kv[1])
+		if err != nil || len(key) != ed25519.PublicKeySize {
+			return nil, errors.New("invalid key in certificate::public_keys, id: " + kv[0])
+		}
+		keys[kv[0]] = ed25519.PublicKey(key)
+	}
+	if privateKey, keyId, err := LoadSigningKey(); err == nil {
+		keys[keyId] = privateKey.Public().(ed25519.PublicKey)
+	}
+	return keys, nil
+}
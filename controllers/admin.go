@@ -0,0 +1,341 @@
+package controllers
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"playground_backend/handler"
+	"strconv"
+	"strings"
+
+	"github.com/astaxie/beego"
+	"github.com/astaxie/beego/logs"
+)
+
+// AdminBaseController guards the admin interfaces with the token in admin::token
+type AdminBaseController struct {
+	beego.Controller
+}
+
+type AdminData struct {
+	Body interface{} `json:"body"`
+	Mesg string      `json:"message"`
+	Code int         `json:"code"`
+}
+
+func (c *AdminBaseController) RetData(resp AdminData) {
+	c.Data["json"] = resp
+	c.ServeJSON()
+}
+
+func (c *AdminBaseController) Prepare() {
+	adminToken := beego.AppConfig.String("admin::token")
+	token := strings.TrimPrefix(c.Ctx.Input.Header("Authorization"), "Bearer ")
+	if len(adminToken) < 1 || subtle.ConstantTimeCompare([]byte(token), []byte(adminToken)) != 1 {
+		logs.Error("Admin request rejected, ip address: ", c.Ctx.Request.RemoteAddr, ",url: ", c.Ctx.Request.URL.Path)
+		c.RetData(AdminData{Mesg: "Unauthorized authentication information", Code: 401})
+		c.StopRun()
+	}
+}
+
+type ClusterHealthControllers struct {
+	AdminBaseController
+}
+
+// @Title ClusterHealth
+// @Description Health of every configured cluster
+// @Success 200 {object} handler.ClusterHealth
+// @Failure 401 Unauthorized
+// @router / [get]
+func (c *ClusterHealthControllers) Get() {
+	c.RetData(AdminData{Body: handler.ClusterHealthList(), Mesg: "success", Code: 200})
+}
+
+type ClusterControllers struct {
+	AdminBaseController
+}
+
+func (c *ClusterControllers) retError(err error) {
+	code := 400
+	if err == handler.ErrClusterNotFound {
+		code = 404
+	}
+	c.RetData(AdminData{Mesg: err.Error(), Code: code})
+}
+
+// @Title ClusterList
+// @Description List the registered clusters without their credentials
+// @Success 200 {object} handler.ClusterView
+// @router / [get]
+func (c *ClusterControllers) List() {
+	cvList, err := handler.ClusterList()
+	if err != nil {
+		c.retError(err)
+		return
+	}
+	c.RetData(AdminData{Body: cvList, Mesg: "success", Code: 200})
+}
+
+// @Title RegisterCluster
+// @Description Register a cluster, its credentials are validated and stored encrypted
+// @Param	body		body 	handler.ClusterReq	true		"cluster"
+// @Success 200 {object} handler.ClusterView
+// @router / [post]
+func (c *ClusterControllers) Register() {
+	var req handler.ClusterReq
+	jsErr := json.Unmarshal(c.Ctx.Input.RequestBody, &req)
+	if jsErr != nil {
+		c.RetData(AdminData{Mesg: "Parameter error", Code: 400})
+		return
+	}
+	cv, err := handler.RegisterCluster(req)
+	if err != nil {
+		logs.Error("RegisterCluster, err: ", err, ",cluster: ", req.ClusterName)
+		c.retError(err)
+		return
+	}
+	c.RetData(AdminData{Body: cv, Mesg: "success", Code: 200})
+}
+
+// @Title UpdateCluster
+// @Description Update a cluster, fields left out are kept
+// @Param	body		body 	handler.ClusterReq	true		"cluster"
+// @Success 200 {object} handler.ClusterView
+// @router /:resourceId [put]
+func (c *ClusterControllers) Update() {
+	var req handler.ClusterReq
+	jsErr := json.Unmarshal(c.Ctx.Input.RequestBody, &req)
+	if jsErr != nil {
+		c.RetData(AdminData{Mesg: "Parameter error", Code: 400})
+		return
+	}
+	cv, err := handler.UpdateCluster(c.Ctx.Input.Param(":resourceId"), req)
+	if err != nil {
+		logs.Error("UpdateCluster, err: ", err)
+		c.retError(err)
+		return
+	}
+	c.RetData(AdminData{Body: cv, Mesg: "success", Code: 200})
+}
+
+// @Title TestCluster
+// @Description Probe a cluster with its stored credentials
+// @Success 200 {object} handler.ClusterTestResult
+// @router /:resourceId/test [post]
+func (c *ClusterControllers) Test() {
+	ctr, err := handler.TestCluster(c.Ctx.Input.Param(":resourceId"))
+	if err != nil {
+		c.retError(err)
+		return
+	}
+	c.RetData(AdminData{Body: ctr, Mesg: "success", Code: 200})
+}
+
+// @Title RetireCluster
+// @Description Stop scheduling onto a cluster
+// @Success 200 success
+// @router /:resourceId [delete]
+func (c *ClusterControllers) Retire() {
+	err := handler.RetireCluster(c.Ctx.Input.Param(":resourceId"))
+	if err != nil {
+		c.retError(err)
+		return
+	}
+	c.RetData(AdminData{Mesg: "success", Code: 200})
+}
+
+type SecretControllers struct {
+	AdminBaseController
+}
+
+// @Title RotateSecrets
+// @Description Re-encrypt the stored cluster credentials under crypto::active_key
+// @Success 200 {object} handler.RotateResult
+// @router /rotate [post]
+func (c *SecretControllers) Rotate() {
+	rr, err := handler.RotateClusterSecrets()
+	if err != nil {
+		logs.Error("RotateClusterSecrets, err: ", err)
+		c.RetData(AdminData{Body: rr, Mesg: err.Error(), Code: 400})
+		return
+	}
+	c.RetData(AdminData{Body: rr, Mesg: "success", Code: 200})
+}
+
+type TemplateControllers struct {
+	AdminBaseController
+}
+
+// @Title DryRunTemplate
+// @Description Render a template with sample data, check it against the policy and dry run it on a cluster
+// @Param	body		body 	handler.DryRunReq	true		"template"
+// @Success 200 {object} handler.DryRunResult
+// @router /dryrun [post]
+func (c *TemplateControllers) DryRun() {
+	var req handler.DryRunReq
+	jsErr := json.Unmarshal(c.Ctx.Input.RequestBody, &req)
+	if jsErr != nil {
+		c.RetData(AdminData{Mesg: "Parameter error", Code: 400})
+		return
+	}
+	result := handler.DryRunTemplate(req)
+	if !result.Valid {
+		c.RetData(AdminData{Body: result, Mesg: "The template is invalid", Code: 422})
+		return
+	}
+	c.RetData(AdminData{Body: result, Mesg: "success", Code: 200})
+}
+
+// @Title TemplateList
+// @Description List the registered template versions, of one template with ?name=
+// @Success 200 {object} models.TemplateRegistry
+// @router / [get]
+func (c *TemplateControllers) List() {
+	trs, _, err := handler.QueryTemplateVersions(c.GetString("name"))
+	if err != nil {
+		c.RetData(AdminData{Mesg: err.Error(), Code: 400})
+		return
+	}
+	c.RetData(AdminData{Body: trs, Mesg: "success", Code: 200})
+}
+
+// @Title RegisterTemplate
+// @Description Register a template version, without content it is fetched from the course repository
+// @Param	body		body 	handler.TemplateReq	true		"template"
+// @Success 200 {object} models.TemplateRegistry
+// @router / [post]
+func (c *TemplateControllers) Register() {
+	var req handler.TemplateReq
+	jsErr := json.Unmarshal(c.Ctx.Input.RequestBody, &req)
+	if jsErr != nil {
+		c.RetData(AdminData{Mesg: "Parameter error", Code: 400})
+		return
+	}
+	tr, err := handler.RegisterTemplate(req)
+	if err != nil {
+		logs.Error("RegisterTemplate, err: ", err, ",name: ", req.Name)
+		c.RetData(AdminData{Mesg: err.Error(), Code: 400})
+		return
+	}
+	c.RetData(AdminData{Body: tr, Mesg: "success", Code: 200})
+}
+
+type CourseTemplateControllers struct {
+	AdminBaseController
+}
+
+func (c *CourseTemplateControllers) retError(err error) {
+	code := 400
+	if err == handler.ErrTemplateNotFound {
+		code = 404
+	}
+	c.RetData(AdminData{Mesg: err.Error(), Code: code})
+}
+
+// @Title CourseTemplateList
+// @Description The template versions a course and its chapters are mapped to
+// @Success 200 {object} handler.CourseTemplateView
+// @router /:courseId/templates [get]
+func (c *CourseTemplateControllers) List() {
+	ctvList, err := handler.CourseTemplateList(c.Ctx.Input.Param(":courseId"))
+	if err != nil {
+		c.retError(err)
+		return
+	}
+	c.RetData(AdminData{Body: ctvList, Mesg: "success", Code: 200})
+}
+
+// @Title SetCourseTemplate
+// @Description Pin a course, or one chapter with chapterId, to a template version
+// @Param	body		body 	handler.CourseTemplateReq	true		"mapping"
+// @Success 200 {object} handler.CourseTemplateView
+// @router /:courseId/templates [put]
+func (c *CourseTemplateControllers) Set() {
+	var req handler.CourseTemplateReq
+	jsErr := json.Unmarshal(c.Ctx.Input.RequestBody, &req)
+	if jsErr != nil || req.TemplateId < 1 {
+		c.RetData(AdminData{Mesg: "Parameter error", Code: 400})
+		return
+	}
+	ctv, err := handler.SetCourseTemplate(c.Ctx.Input.Param(":courseId"), req)
+	if err != nil {
+		c.retError(err)
+		return
+	}
+	c.RetData(AdminData{Body: ctv, Mesg: "success", Code: 200})
+}
+
+// @Title RollbackCourseTemplate
+// @Description Move a course back to its previous template version
+// @Param	body		body 	handler.CourseTemplateReq	true		"mapping, templateId is ignored"
+// @Success 200 {object} handler.CourseTemplateView
+// @router /:courseId/templates/rollback [post]
+func (c *CourseTemplateControllers) Rollback() {
+	var req handler.CourseTemplateReq
+	jsErr := json.Unmarshal(c.Ctx.Input.RequestBody, &req)
+	if jsErr != nil {
+		c.RetData(AdminData{Mesg: "Parameter error", Code: 400})
+		return
+	}
+	ctv, err := handler.RollbackCourseTemplate(c.Ctx.Input.Param(":courseId"), req)
+	if err != nil {
+		c.retError(err)
+		return
+	}
+	c.RetData(AdminData{Body: ctv, Mesg: "success", Code: 200})
+}
+
+// @Title RefreshCourseTemplate
+// @Description Move the mappings of a course that follow their template to its current content
+// @Success 200 {object} handler.CourseTemplateView
+// @router /:courseId/templates/refresh [post]
+func (c *CourseTemplateControllers) Refresh() {
+	ctvList, err := handler.RefreshCourseTemplate(c.Ctx.Input.Param(":courseId"))
+	if err != nil {
+		c.retError(err)
+		return
+	}
+	c.RetData(AdminData{Body: ctvList, Mesg: "success", Code: 200})
+}
+
+type CourseSyncControllers struct {
+	AdminBaseController
+}
+
+// @Title CourseSyncHistory
+// @Description The last sync runs of the course catalog, ?limit= runs, and the current catalog revision
+// @Success 200 {object} handler.CourseSyncStatus
+// @router /runs [get]
+func (c *CourseSyncControllers) List() {
+	limit, _ := c.GetInt("limit", 20)
+	if limit < 1 || limit > 200 {
+		limit = 20
+	}
+	status, err := handler.CourseSyncHistory(limit)
+	if err != nil {
+		c.RetData(AdminData{Mesg: err.Error(), Code: 400})
+		return
+	}
+	c.RetData(AdminData{Body: status, Mesg: "success", Code: 200})
+}
+
+// @Title CourseSyncRun
+// @Description A sync run with the changes it made to courses and chapters
+// @Success 200 {object} handler.CourseSyncRunView
+// @router /runs/:runId [get]
+func (c *CourseSyncControllers) Get() {
+	runId, _ := strconv.ParseInt(c.Ctx.Input.Param(":runId"), 10, 64)
+	if runId < 1 {
+		c.RetData(AdminData{Mesg: "Parameter error", Code: 400})
+		return
+	}
+	view, err := handler.CourseSyncRunDetail(runId)
+	if err != nil {
+		code := 400
+		if err == handler.ErrSyncRunNotFound {
+			code = 404
+		}
+		c.RetData(AdminData{Mesg: err.Error(), Code: code})
+		return
+	}
+	c.RetData(AdminData{Body: view, Mesg: "success", Code: 200})
+}
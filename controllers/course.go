@@ -2,8 +2,10 @@ package controllers
 
 import (
 	"encoding/json"
+	"fmt"
 	"playground_backend/handler"
 	"playground_backend/models"
+	"strings"
 
 	"github.com/astaxie/beego"
 	"github.com/astaxie/beego/logs"
@@ -20,9 +22,10 @@ func (c *CourseChapterControllers) RetData(resp RescourseData) {
 }
 
 type RescourseData struct {
-	ResInfo handler.RspCourse `json:"courseInfo"`
-	Mesg    string            `json:"message"`
-	Code    int               `json:"code"`
+	ResInfo handler.RspCourse   `json:"courseInfo"`
+	Unmet   *handler.UnmetRules `json:"unmet,omitempty"`
+	Mesg    string              `json:"message"`
+	Code    int                 `json:"code"`
 }
 
 // @Title CourseChapter
@@ -89,17 +92,31 @@ func (u *CourseChapterControllers) Post() {
 		}
 	}
 	// User bound course
-	ucId := handler.UserBoundBourse(crp)
+	ucId, boundErr := handler.UserBoundBourse(crp)
+	if unmet, ok := boundErr.(*handler.UnmetRules); ok {
+		resData.Unmet = unmet
+		resData.Mesg = unmet.Error()
+		resData.Code = 403
+		u.RetData(resData)
+		return
+	}
 	if ucId > 0 {
-		if len(crp.ChapterInfo) > 0 {
-			for _, chInfo := range crp.ChapterInfo {
-				handler.UserBoundBourseChapter(chInfo, ucId, crp.UserId, crp.CourseId, crp.Status)
-			}
-		}
 		resData.ResInfo.CId = ucId
 		resData.ResInfo.State = "success"
 		resData.Code = 200
 		resData.Mesg = "User binding course successfully"
+		if len(crp.ChapterInfo) > 0 {
+			for _, chInfo := range crp.ChapterInfo {
+				chapterErr := handler.UserBoundBourseChapter(chInfo, ucId, crp.UserId, crp.CourseId, crp.Status)
+				// The course stays bound, the chapters after a locked one are not bound
+				if unmet, ok := chapterErr.(*handler.UnmetRules); ok {
+					resData.Unmet = unmet
+					resData.Mesg = unmet.Error()
+					resData.Code = 403
+					break
+				}
+			}
+		}
 	} else {
 		resData.Mesg = "Service internal processing failed"
 		resData.Code = 500
@@ -182,3 +199,361 @@ func (u *CourseChapterControllers) Get() {
 	u.RetDetailData(resData)
 	return
 }
+
+type StudyHeartbeatControllers struct {
+	beego.Controller
+}
+
+type RespStudyData struct {
+	StudyInfo handler.RspStudyTime `json:"studyInfo"`
+	Mesg      string               `json:"message"`
+	Code      int                  `json:"code"`
+}
+
+func (c *StudyHeartbeatControllers) RetData(resp RespStudyData) {
+	c.Data["json"] = resp
+	c.ServeJSON()
+}
+
+// @Title StudyHeartbeat
+// @Description The learning page reports that a chapter is open, the study time is counted from it
+// @Param	body		body 	handler.StudyHeartbeat	true		"body for user content"
+// @Success 200 {object} handler.RspStudyTime
+// @Failure 403 token is err
+// @router / [post]
+func (u *StudyHeartbeatControllers) Post() {
+	var hb handler.StudyHeartbeat
+	var resData RespStudyData
+	err := json.Unmarshal(u.Ctx.Input.RequestBody, &hb)
+	if err != nil {
+		logs.Error("json.Unmarshal, err: ", err)
+		resData.Code = 404
+		resData.Mesg = "Parameter error"
+		u.RetData(resData)
+		return
+	}
+	if len(hb.CourseId) < 1 || len(hb.ChapterId) < 1 || hb.UserId < 1 {
+		resData.Code = 400
+		resData.Mesg = "Please check whether the request parameters are correct"
+		u.RetData(resData)
+		return
+	}
+	if len(hb.Token) < 1 {
+		resData.Code = 401
+		resData.Mesg = "Unauthorized authentication information"
+		u.RetData(resData)
+		return
+	}
+	gui := models.AuthUserInfo{AccessToken: hb.Token, UserId: hb.UserId}
+	if !handler.CheckToken(&gui) {
+		resData.Code = 403
+		resData.Mesg = "Authority authentication failed"
+		u.RetData(resData)
+		return
+	}
+	rst, hbErr := handler.AddStudyHeartbeat(hb)
+	resData.StudyInfo = rst
+	if hbErr == handler.ErrStudyChapterNotBound {
+		resData.Code = 404
+		resData.Mesg = hbErr.Error()
+	} else if hbErr != nil {
+		resData.Code = 500
+		resData.Mesg = "Service internal processing failed"
+	} else {
+		resData.Code = 200
+		resData.Mesg = "success"
+	}
+	u.RetData(resData)
+}
+
+type ChapterCheckControllers struct {
+	beego.Controller
+}
+
+type RespChapterCheckData struct {
+	CheckInfo handler.RspChapterCheck `json:"checkInfo"`
+	Mesg      string                  `json:"message"`
+	Code      int                     `json:"code"`
+}
+
+func (c *ChapterCheckControllers) RetData(resp RespChapterCheckData) {
+	logs.Info("Chapter check response: ", resp.Code, ", ", resp.Mesg)
+	c.Data["json"] = resp
+	c.ServeJSON()
+}
+
+// @Title ChapterCheck
+// @Description Run the completion check of a chapter in the user's instance
+// @Param	body		body 	handler.ChapterCheckReq	true		"body for user content"
+// @Success 200 {object} handler.RspChapterCheck
+// @Failure 403 token is err
+// @router / [post]
+func (u *ChapterCheckControllers) Post() {
+	var ccr handler.ChapterCheckReq
+	var resData RespChapterCheckData
+	err := json.Unmarshal(u.Ctx.Input.RequestBody, &ccr)
+	if err != nil {
+		logs.Error("json.Unmarshal, err: ", err)
+		resData.Code = 404
+		resData.Mesg = "Parameter error"
+		u.RetData(resData)
+		return
+	}
+	if len(ccr.CourseId) < 1 || len(ccr.ChapterId) < 1 || ccr.UserId < 1 {
+		resData.Code = 400
+		resData.Mesg = "Please check whether the request parameters are correct"
+		u.RetData(resData)
+		return
+	}
+	if len(ccr.Token) < 1 {
+		resData.Code = 401
+		resData.Mesg = "Unauthorized authentication information"
+		u.RetData(resData)
+		return
+	}
+	gui := models.AuthUserInfo{AccessToken: ccr.Token, UserId: ccr.UserId}
+	if !handler.CheckToken(&gui) {
+		resData.Code = 403
+		resData.Mesg = "Authority authentication failed"
+		u.RetData(resData)
+		return
+	}
+	rsp, checkErr := handler.RunChapterCheck(ccr)
+	resData.CheckInfo = rsp
+	switch checkErr {
+	case nil:
+		resData.Code = 200
+		resData.Mesg = "success"
+	case handler.ErrStudyChapterNotBound, handler.ErrChapterNoCheck, handler.ErrCheckNoInstance:
+		resData.Code = 404
+		resData.Mesg = checkErr.Error()
+	default:
+		resData.Code = 500
+		resData.Mesg = checkErr.Error()
+	}
+	u.RetData(resData)
+}
+
+type CourseSyncHookControllers struct {
+	beego.Controller
+}
+
+func (c *CourseSyncHookControllers) RetData(resp AdminData) {
+	c.Data["json"] = resp
+	c.ServeJSON()
+}
+
+// @Title CourseSyncHook
+// @Description Sync the courses, or only courseIds, after a change of the course repository. X-Playground-Signature signs X-Playground-Timestamp and the body with courses::webhook_secret.
+// @Param	body		body 	handler.CourseSyncHook	true		"courses"
+// @Success 202 {object} handler.CourseSyncTrigger
+// @Failure 401 Invalid signature
+// @router / [post]
+func (c *CourseSyncHookControllers) Post() {
+	body := c.Ctx.Input.RequestBody
+	if !handler.VerifySyncSignature(body, c.Ctx.Input.Header(handler.SyncTimestampHeader),
+		c.Ctx.Input.Header(handler.SyncSignatureHeader)) {
+		logs.Error("CourseSyncHook, invalid signature, ip address: ", c.Ctx.Request.RemoteAddr)
+		c.RetData(AdminData{Mesg: "Invalid signature", Code: 401})
+		return
+	}
+	var hook handler.CourseSyncHook
+	if len(body) > 0 {
+		if jsErr := json.Unmarshal(body, &hook); jsErr != nil {
+			c.RetData(AdminData{Mesg: "Parameter error", Code: 400})
+			return
+		}
+	}
+	started := handler.TriggerCourseSync(handler.SyncTriggerWebhook, hook.CourseIds)
+	logs.Info("CourseSyncHook, courseIds: ", hook.CourseIds, ", started: ", started)
+	c.RetData(AdminData{Body: handler.CourseSyncTrigger{Started: started, CourseIds: hook.CourseIds},
+		Mesg: "accepted", Code: 202})
+}
+
+type CourseCatalogControllers struct {
+	beego.Controller
+}
+
+type CatalogData struct {
+	Body interface{} `json:"body"`
+	Mesg string      `json:"message"`
+	Code int         `json:"code"`
+}
+
+func etagMatches(ifNoneMatch, etag string) bool {
+	for _, tag := range strings.Split(ifNoneMatch, ",") {
+		tag = strings.TrimPrefix(strings.TrimSpace(tag), "W/")
+		if tag == etag || tag == "*" {
+			return true
+		}
+	}
+	return false
+}
+
+// serveCatalog answers with a catalog response, or with 304 when the client
+// already has it
+func (c *CourseCatalogControllers) serveCatalog(resp CatalogData) {
+	etag, content, err := handler.CatalogETag(resp)
+	if err != nil || resp.Code != 200 {
+		c.Data["json"] = resp
+		c.ServeJSON()
+		return
+	}
+	maxAge := beego.AppConfig.DefaultInt("courses::catalog_max_age", 60)
+	c.Ctx.Output.Header("ETag", etag)
+	c.Ctx.Output.Header("Cache-Control", fmt.Sprintf("public, max-age=%d", maxAge))
+	if etagMatches(c.Ctx.Input.Header("If-None-Match"), etag) {
+		c.Ctx.Output.SetStatus(304)
+		c.Ctx.Output.Body([]byte{})
+		return
+	}
+	c.Ctx.Output.Header("Content-Type", "application/json; charset=utf-8")
+	c.Ctx.Output.Body(content)
+}
+
+// @Title CourseCatalog
+// @Description The courses with their chapters and environments, filtered by status (0: all, 1: online, 2: offline) and keyword
+// @Param	currentPage	int	false	"page, from 1"
+// @Param	pageSize	int	false	"courses per page, at most 100"
+// @Param	status	int	false	"default 1"
+// @Param	keyword	string	false	"matches name, title and description"
+// @Success 200 {object} handler.CatalogPage
+// @router / [get]
+func (c *CourseCatalogControllers) List() {
+	currentPage, _ := c.GetInt("currentPage", 1)
+	pageSize, _ := c.GetInt("pageSize", 20)
+	status, _ := c.GetInt("status", 1)
+	keyword := strings.TrimSpace(c.GetString("keyword"))
+	if currentPage < 1 || pageSize < 1 || pageSize > 100 || status < 0 || status > 2 || len(keyword) > 128 {
+		c.serveCatalog(CatalogData{Mesg: "Parameter error", Code: 400})
+		return
+	}
+	page, err := handler.CourseCatalog(status, keyword, currentPage, pageSize)
+	if err != nil {
+		logs.Error("CourseCatalog, err: ", err)
+		c.serveCatalog(CatalogData{Mesg: "Service internal processing failed", Code: 500})
+		return
+	}
+	c.serveCatalog(CatalogData{Body: page, Mesg: "success", Code: 200})
+}
+
+// @Title CatalogCourse
+// @Description One course with its chapters and environments
+// @Success 200 {object} handler.CatalogCourse
+// @Failure 404 The course does not exist
+// @router /:courseId [get]
+func (c *CourseCatalogControllers) Get() {
+	cc, err := handler.CatalogCourseDetail(c.Ctx.Input.Param(":courseId"))
+	if err != nil {
+		code := 500
+		if err == handler.ErrCourseNotFound {
+			code = 404
+		}
+		c.serveCatalog(CatalogData{Mesg: err.Error(), Code: code})
+		return
+	}
+	c.serveCatalog(CatalogData{Body: cc, Mesg: "success", Code: 200})
+}
+
+type CertificateControllers struct {
+	beego.Controller
+}
+
+type CertificateData struct {
+	Certificate handler.SignedCertificate `json:"certificateInfo"`
+	Mesg        string                    `json:"message"`
+	Code        int                       `json:"code"`
+}
+
+type CertificateVerifyData struct {
+	Verification handler.CertificateVerification `json:"verification"`
+	Mesg         string                          `json:"message"`
+	Code         int                             `json:"code"`
+}
+
+// serveSvg renders a certificate as an svg image
+func serveSvg(ctl *beego.Controller, sc handler.SignedCertificate) bool {
+	content, err := handler.RenderCertificateSvg(sc)
+	if err != nil {
+		return false
+	}
+	ctl.Ctx.Output.Header("Content-Type", "image/svg+xml; charset=utf-8")
+	ctl.Ctx.Output.Body(content)
+	return true
+}
+
+// @Title UserCertificate
+// @Description The certificate of a completed course as signed json, or as svg with format=svg
+// @Param	userId	int64	true	"user id"
+// @Param	token	string	true	"access token"
+// @Param	courseId	string	true	"course id"
+// @Param	format	string	false	"json or svg"
+// @Success 200 {object} handler.SignedCertificate
+// @Failure 403 token is err
+// @router / [get]
+func (c *CertificateControllers) Get() {
+	var resData CertificateData
+	token := c.GetString("token")
+	userId, _ := c.GetInt64("userId", 0)
+	courseId := c.GetString("courseId")
+	if userId == 0 || len(courseId) == 0 {
+		resData.Code = 400
+		resData.Mesg = "Please check whether the request parameters are correct"
+		c.Data["json"] = resData
+		c.ServeJSON()
+		return
+	}
+	gui := models.AuthUserInfo{AccessToken: token, UserId: userId}
+	if len(token) == 0 || !handler.CheckToken(&gui) {
+		resData.Code = 403
+		resData.Mesg = "Authority authentication failed"
+		c.Data["json"] = resData
+		c.ServeJSON()
+		return
+	}
+	sc, certErr := handler.UserCertificate(userId, courseId)
+	if certErr == handler.ErrCourseNotCompleted || certErr == handler.ErrCertificateDisabled {
+		resData.Code = 404
+		resData.Mesg = certErr.Error()
+	} else if certErr != nil {
+		resData.Code = 500
+		resData.Mesg = "Service internal processing failed"
+	} else {
+		if c.GetString("format") == "svg" && serveSvg(&c.Controller, sc) {
+			return
+		}
+		resData.Certificate = sc
+		resData.Code = 200
+		resData.Mesg = "success"
+	}
+	c.Data["json"] = resData
+	c.ServeJSON()
+}
+
+// @Title VerifyCertificate
+// @Description Check the signature of a certificate by its id, format=svg renders a valid certificate
+// @Param	certId	string	true	"certificate id"
+// @Param	format	string	false	"json or svg"
+// @Success 200 {object} handler.CertificateVerification
+// @Failure 404 the certificate does not exist
+// @router /:certId [get]
+func (c *CertificateControllers) Verify() {
+	var resData CertificateVerifyData
+	cv, verifyErr := handler.VerifyCertificate(c.Ctx.Input.Param(":certId"))
+	if verifyErr == handler.ErrCertificateNotFound {
+		resData.Code = 404
+		resData.Mesg = verifyErr.Error()
+	} else if verifyErr != nil {
+		resData.Code = 500
+		resData.Mesg = "Service internal processing failed"
+	} else {
+		if cv.Valid && c.GetString("format") == "svg" && serveSvg(&c.Controller, cv.Signed) {
+			return
+		}
+		resData.Verification = cv
+		resData.Code = 200
+		resData.Mesg = "success"
+	}
+	c.Data["json"] = resData
+	c.ServeJSON()
+}
@@ -26,6 +26,7 @@ type RequestParameter struct {
 	ContactEmail string `json:"contactEmail"`
 	Token        string `json:"token"`
 	ForceDelete  int    `json:"forceDelete"`
+	Region       string `json:"region"`
 }
 
 func (c *CrdResourceControllers) RetData(resp ResData) {
@@ -36,6 +37,7 @@ func (c *CrdResourceControllers) RetData(resp ResData) {
 
 type ResData struct {
 	ResInfo handler.ResResourceInfo `json:"instanceInfo"`
+	Unmet   *handler.UnmetRules     `json:"unmet,omitempty"`
 	Mesg    string                  `json:"message"`
 	Code    int                     `json:"code"`
 }
@@ -108,7 +110,8 @@ func (u *CrdResourceControllers) Post() {
 	var rri = new(handler.ResResourceInfo)
 	rr := handler.ReqResource{EnvResource: rp.TemplatePath, UserId: rp.UserId,
 		ContactEmail: rp.ContactEmail, ForceDelete: rp.ForceDelete,
-		ResourceId: rcp.ResourceId, CourseId: rp.CourseId, ChapterId: rp.ChapterId}
+		ResourceId: rcp.ResourceId, CourseId: rp.CourseId, ChapterId: rp.ChapterId,
+		Region: rp.Region}
 	rri.CourseId = rp.CourseId
 	rri.ChapterId = rp.ChapterId
 	cs := models.Courses{CourseId: rp.CourseId}
@@ -125,6 +128,20 @@ func (u *CrdResourceControllers) Post() {
 			1, 1, &crd, &ccp)
 		return
 	}
+	if ruleErr := handler.CheckLearnRules(rp.UserId, rp.CourseId, rp.ChapterId); ruleErr != nil {
+		if unmet, ok := ruleErr.(*handler.UnmetRules); ok {
+			resData.Unmet = unmet
+		}
+		resData.Code = 403
+		resData.Mesg = ruleErr.Error()
+		u.RetData(resData)
+		crd := models.Courses{CourseId: rp.CourseId}
+		ccp := models.CoursesChapter{CourseId: rp.CourseId, ChapterId: rp.ChapterId}
+		handler.WriteCourseData(rp.UserId, rp.ResourceId, rp.CourseId, rp.ChapterId,
+			"Application Resources", "", "failed", ruleErr.Error(),
+			1, 1, &crd, &ccp)
+		return
+	}
 	rcpErr := rr.SaveCourseAndResRel(&rcp, cs.Name)
 	if rcpErr != nil {
 		resData.Code = 403
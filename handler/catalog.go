@@ -0,0 +1,168 @@
+package handler
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"playground_backend/models"
+)
+
+var ErrCourseNotFound = errors.New("The course does not exist")
+
+// CatalogEnvironment is the environment a chapter runs in
+type CatalogEnvironment struct {
+	ImageId  string `json:"imageId"`
+	Backend  string `json:"backend"`
+	Template string `json:"template"`
+	Version  int    `json:"version"`
+}
+
+type CatalogChapter struct {
+	ChapterId   string             `json:"chapterId"`
+	Title       string             `json:"title"`
+	Description string             `json:"description"`
+	Estimated   string             `json:"estimated"`
+	Status      int8               `json:"status"`
+	Environment CatalogEnvironment `json:"environment"`
+}
+
+type CatalogCourse struct {
+	CourseId      string           `json:"courseId"`
+	Name          string           `json:"name"`
+	Title         string           `json:"title"`
+	Description   string           `json:"description"`
+	Icon          string           `json:"icon"`
+	Poster        string           `json:"poster"`
+	Banner        string           `json:"banner"`
+	Estimated     string           `json:"estimated"`
+	Status        int8             `json:"status"`
+	UpdateTime    string           `json:"updateTime"`
+	Prerequisites []string         `json:"prerequisites"`
+	ChapterOrder  string           `json:"chapterOrder"`
+	Chapters      []CatalogChapter `json:"chapters"`
+}
+
+type CatalogPage struct {
+	Courses     []CatalogCourse `json:"courseInfo"`
+	TotalCount  int64           `json:"totalCount"`
+	CurrentPage int             `json:"currentPage"`
+	PageSize    int             `json:"pageSize"`
+}
+
+// catalogEnv resolves the environments of the chapters of one course, the
+// template versions read are shared between chapters
+type catalogEnv struct {
+	maps      []models.CourseTemplateMap
+	templates map[int64]models.TemplateRegistry
+}
+
+func newCatalogEnv(courseId string) *catalogEnv {
+	ctmList, _, _ := models.QueryCourseTemplateMapList(courseId)
+	return &catalogEnv{maps: ctmList, templates: map[int64]models.TemplateRegistry{}}
+}
+
+func (e *catalogEnv) environment(cp models.CoursesChapter) CatalogEnvironment {
+	env := CatalogEnvironment{ImageId: cp.EulerBranch}
+	templateId := int64(0)
+	for _, ctm := range e.maps {
+		if ctm.ChapterId == cp.ChapterId {
+			templateId = ctm.TemplateId
+			break
+		}
+		if len(ctm.ChapterId) == 0 && ctm.EulerBranch == cp.EulerBranch {
+			templateId = ctm.TemplateId
+		}
+	}
+	if templateId == 0 {
+		return env
+	}
+	tr, ok := e.templates[templateId]
+	if !ok {
+		tr = models.TemplateRegistry{Id: templateId}
+		if models.QueryTemplateRegistry(&tr, "Id") != nil {
+			return env
+		}
+		e.templates[templateId] = tr
+	}
+	env.Template = tr.Name
+	env.Version = tr.Version
+	env.Backend = tr.Backend
+	if len(env.Backend) == 0 {
+		env.Backend = TemplateBackend(tr.Name)
+	}
+	return env
+}
+
+func newCatalogCourse(cs models.Courses) CatalogCourse {
+	return CatalogCourse{CourseId: cs.CourseId, Name: cs.Name, Title: cs.Title,
+		Description: cs.Description, Icon: cs.Icon, Poster: cs.Poster, Banner: cs.Banner,
+		Estimated: cs.Estimated, Status: cs.Status, UpdateTime: cs.UpdateTime,
+		Prerequisites: CourseRequires(cs), ChapterOrder: cs.Ordering, Chapters: []CatalogChapter{}}
+}
+
+// addCatalogChapters attaches the chapters of each course that have the
+// status of the course, an online course lists its online chapters only
+func addCatalogChapters(courses []CatalogCourse) error {
+	courseIds := make([]string, 0, len(courses))
+	index := map[string]int{}
+	for i, cc := range courses {
+		courseIds = append(courseIds, cc.CourseId)
+		index[cc.CourseId] = i
+	}
+	chapters, err := models.QueryCatalogChapters(courseIds)
+	if err != nil {
+		return err
+	}
+	envs := map[string]*catalogEnv{}
+	for _, cp := range chapters {
+		i, ok := index[cp.CourseId]
+		if !ok || cp.Status != courses[i].Status {
+			continue
+		}
+		env, ok := envs[cp.CourseId]
+		if !ok {
+			env = newCatalogEnv(cp.CourseId)
+			envs[cp.CourseId] = env
+		}
+		courses[i].Chapters = append(courses[i].Chapters, CatalogChapter{ChapterId: cp.ChapterId,
+			Title: cp.Title, Description: cp.Description, Estimated: cp.Estimated,
+			Status: cp.Status, Environment: env.environment(cp)})
+	}
+	return nil
+}
+
+// CourseCatalog returns a page of the courses with the status, 0 for every
+// status, whose name, title or description contains keyword
+func CourseCatalog(status int, keyword string, currentPage, pageSize int) (CatalogPage, error) {
+	page := CatalogPage{Courses: []CatalogCourse{}, CurrentPage: currentPage, PageSize: pageSize}
+	csList, total, err := models.QueryCatalogCourses(status, keyword, currentPage, pageSize)
+	if err != nil {
+		return page, err
+	}
+	page.TotalCount = total
+	for _, cs := range csList {
+		page.Courses = append(page.Courses, newCatalogCourse(cs))
+	}
+	return page, addCatalogChapters(page.Courses)
+}
+
+func CatalogCourseDetail(courseId string) (CatalogCourse, error) {
+	cs := models.Courses{CourseId: courseId}
+	if models.QueryCourse(&cs, "CourseId") != nil {
+		return CatalogCourse{}, ErrCourseNotFound
+	}
+	courses := []CatalogCourse{newCatalogCourse(cs)}
+	err := addCatalogChapters(courses)
+	return courses[0], err
+}
+
+// CatalogETag returns the entity tag of a catalog response
+func CatalogETag(body interface{}) (string, []byte, error) {
+	content, err := json.Marshal(body)
+	if err != nil {
+		return "", nil, err
+	}
+	sum := sha256.Sum256(content)
+	return `"` + hex.EncodeToString(sum[:16]) + `"`, content, nil
+}
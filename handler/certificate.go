@@ -0,0 +1,222 @@
+package handler
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"html/template"
+	"playground_backend/common"
+	"playground_backend/models"
+	"time"
+
+	"github.com/astaxie/beego"
+	"github.com/astaxie/beego/logs"
+)
+
+// CertificateVersion is the layout of the signed body, a verifier rejects
+// versions it does not know
+const CertificateVersion = "v1"
+
+var (
+	ErrCertificateNotFound = errors.New("The certificate does not exist")
+	ErrCourseNotCompleted  = errors.New("The user has not completed the course")
+	ErrCertificateDisabled = errors.New("Certificates are not issued, no signing key is configured")
+)
+
+// CertificateBody is what a certificate signature covers, the signature is
+// made over the compact json of the body in this field order
+type CertificateBody struct {
+	Version       string `json:"version"`
+	CertId        string `json:"certId"`
+	Issuer        string `json:"issuer"`
+	UserName      string `json:"userName"`
+	CourseId      string `json:"courseId"`
+	CourseTitle   string `json:"courseTitle"`
+	CompletedDate string `json:"completedDate"`
+	StudyTime     int64  `json:"studyTime"`
+	IssuedAt      string `json:"issuedAt"`
+	KeyId         string `json:"keyId"`
+}
+
+// SignedCertificate is the verifiable json of a certificate, Payload holds the
+// exact bytes the signature was made over
+type SignedCertificate struct {
+	Certificate CertificateBody `json:"certificate"`
+	Payload     string          `json:"payload"`
+	Algorithm   string          `json:"algorithm"`
+	Signature   string          `json:"signature"`
+	VerifyUrl   string          `json:"verifyUrl,omitempty"`
+}
+
+type CertificateVerification struct {
+	Valid     bool              `json:"valid"`
+	Message   string            `json:"message"`
+	PublicKey string            `json:"publicKey,omitempty"`
+	Signed    SignedCertificate `json:"signed"`
+}
+
+func certificateIssuer() string {
+	return beego.AppConfig.DefaultString("certificate::issuer", "openEuler Playground")
+}
+
+func certificateBody(cert models.Certificate) CertificateBody {
+	return CertificateBody{Version: CertificateVersion, CertId: cert.CertId, Issuer: cert.Issuer,
+		UserName: cert.UserName, CourseId: cert.CourseId, CourseTitle: cert.CourseTitle,
+		CompletedDate: cert.CompletedDate, StudyTime: cert.StudyTime, IssuedAt: cert.IssuedAt, KeyId: cert.KeyId}
+}
+
+func newCertId() (string, error) {
+	id := make([]byte, 16)
+	if _, err := rand.Read(id); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(id), nil
+}
+
+// IssueCertificate signs the completion of a course by a user, a user who has
+// a certificate for the course keeps it
+func IssueCertificate(userId int64, courseId string) (models.Certificate, error) {
+	cert := models.Certificate{UserId: userId, CourseId: courseId}
+	if models.QueryCertificate(&cert, "UserId", "CourseId") == nil {
+		return cert, nil
+	}
+	// Issued certificates stay readable, new ones are never signed without a key
+	if len(beego.AppConfig.String("certificate::signing_key")) == 0 {
+		return cert, ErrCertificateDisabled
+	}
+	uc := models.UserCourse{UserId: userId, CourseId: courseId}
+	if queryErr := models.QueryUserCourse(&uc, "UserId", "CourseId"); queryErr != nil || uc.CompletedFlag != 2 {
+		return cert, ErrCourseNotCompleted
+	}
+	privateKey, keyId, keyErr := common.LoadSigningKey()
+	if keyErr != nil {
+		logs.Error("IssueCertificate, keyErr: ", keyErr)
+		return cert, keyErr
+	}
+	userInfo := models.AuthUserInfo{UserId: userId}
+	if userErr := models.QueryAuthUserInfo(&userInfo, "UserId"); userErr != nil {
+		logs.Error("IssueCertificate, userErr: ", userErr)
+		return cert, userErr
+	}
+	cr := models.Courses{CourseId: courseId}
+	if courseErr := models.QueryCourse(&cr, "CourseId"); courseErr != nil {
+		logs.Error("IssueCertificate, courseErr: ", courseErr)
+		return cert, courseErr
+	}
+	certId, idErr := newCertId()
+	if idErr != nil {
+		return cert, idErr
+	}
+	now := time.Now().UTC()
+	cert = models.Certificate{CertId: certId, UserId: userId, CourseId: courseId, Issuer: certificateIssuer(),
+		UserName: RetUserName(userInfo), CourseTitle: cr.Title, CompletedDate: now.Format("2006-01-02"),
+		StudyTime: uc.StudyTime, IssuedAt: now.Format(time.RFC3339), KeyId: keyId,
+		CreateTime: common.GetCurTime()}
+	payload, _ := json.Marshal(certificateBody(cert))
+	cert.Signature = base64.StdEncoding.EncodeToString(ed25519.Sign(privateKey, payload))
+	created, inErr := models.InsertCertificate(&cert)
+	if inErr != nil {
+		logs.Error("IssueCertificate, inErr: ", inErr)
+		return cert, inErr
+	}
+	if created {
+		logs.Info("Certificate issued, certId: ", cert.CertId, ", userId: ", userId, ", courseId: ", courseId)
+		crd := models.Courses{CourseId: courseId}
+		ccp := models.CoursesChapter{CourseId: courseId}
+		WriteCourseData(userId, "0", courseId, "", "Certificate issued", "", "success",
+			"certId: "+cert.CertId, 2, 2, &crd, &ccp)
+	}
+	return cert, nil
+}
+
+// SignCertificate returns the verifiable json of a stored certificate
+func SignCertificate(cert models.Certificate) SignedCertificate {
+	body := certificateBody(cert)
+	payload, _ := json.Marshal(body)
+	sc := SignedCertificate{Certificate: body, Payload: base64.StdEncoding.EncodeToString(payload),
+		Algorithm: common.AlgEd25519, Signature: cert.Signature}
+	if verifyUrl := beego.AppConfig.String("certificate::verify_url"); len(verifyUrl) > 0 {
+		sc.VerifyUrl = fmt.Sprintf(verifyUrl, cert.CertId)
+	}
+	return sc
+}
+
+// UserCertificate returns the certificate of a user for a course, it is
+// issued first if the course was completed before certificates were
+func UserCertificate(userId int64, courseId string) (SignedCertificate, error) {
+	cert, err := IssueCertificate(userId, courseId)
+	if err != nil {
+		return SignedCertificate{}, err
+	}
+	return SignCertificate(cert), nil
+}
+
+// VerifyCertificate checks the signature of a certificate by its id with the
+// public key it was signed with
+func VerifyCertificate(certId string) (CertificateVerification, error) {
+	cv := CertificateVerification{}
+	cert := models.Certificate{CertId: certId}
+	if models.QueryCertificate(&cert, "CertId") != nil {
+		return cv, ErrCertificateNotFound
+	}
+	cv.Signed = SignCertificate(cert)
+	keys, keyErr := common.LoadVerifyKeys()
+	if keyErr != nil {
+		logs.Error("VerifyCertificate, keyErr: ", keyErr)
+		return cv, keyErr
+	}
+	publicKey, ok := keys[cert.KeyId]
+	if !ok {
+		cv.Message = "The key the certificate was signed with is unknown, keyId: " + cert.KeyId
+		return cv, nil
+	}
+	cv.PublicKey = base64.StdEncoding.EncodeToString(publicKey)
+	signature, sigErr := base64.StdEncoding.DecodeString(cert.Signature)
+	payload, _ := base64.StdEncoding.DecodeString(cv.Signed.Payload)
+	if sigErr != nil || !ed25519.Verify(publicKey, payload, signature) {
+		cv.Message = "The signature of the certificate is invalid"
+		return cv, nil
+	}
+	cv.Valid = true
+	cv.Message = "The certificate is valid"
+	return cv, nil
+}
+
+var certificateSvg = template.Must(template.New("certificate").Parse(`<svg xmlns="http://www.w3.org/2000/svg" width="1000" height="700" viewBox="0 0 1000 700">
+  <rect x="0" y="0" width="1000" height="700" fill="#ffffff"/>
+  <rect x="24" y="24" width="952" height="652" fill="none" stroke="#002fa7" stroke-width="4"/>
+  <text x="500" y="130" font-family="sans-serif" font-size="44" text-anchor="middle" fill="#002fa7">Certificate of Completion</text>
+  <text x="500" y="210" font-family="sans-serif" font-size="22" text-anchor="middle" fill="#555555">This certifies that</text>
+  <text x="500" y="280" font-family="sans-serif" font-size="40" text-anchor="middle" fill="#000000">{{.UserName}}</text>
+  <text x="500" y="340" font-family="sans-serif" font-size="22" text-anchor="middle" fill="#555555">has completed the course</text>
+  <text x="500" y="400" font-family="sans-serif" font-size="32" text-anchor="middle" fill="#000000">{{.CourseTitle}}</text>
+  <text x="500" y="470" font-family="sans-serif" font-size="20" text-anchor="middle" fill="#555555">on {{.CompletedDate}}, study time {{.StudyHours}}</text>
+  <text x="500" y="600" font-family="sans-serif" font-size="18" text-anchor="middle" fill="#333333">{{.Issuer}}</text>
+  <text x="500" y="640" font-family="monospace" font-size="14" text-anchor="middle" fill="#777777">Certificate {{.CertId}}{{if .VerifyUrl}}, verify at {{.VerifyUrl}}{{end}}</text>
+</svg>
+`))
+
+// formatStudyTime renders study seconds as hours and minutes
+func formatStudyTime(seconds int64) string {
+	return fmt.Sprintf("%dh %02dm", seconds/3600, seconds%3600/60)
+}
+
+// RenderCertificateSvg renders a certificate as an svg image
+func RenderCertificateSvg(sc SignedCertificate) ([]byte, error) {
+	var buf bytes.Buffer
+	err := certificateSvg.Execute(&buf, struct {
+		CertificateBody
+		StudyHours string
+		VerifyUrl  string
+	}{sc.Certificate, formatStudyTime(sc.Certificate.StudyTime), sc.VerifyUrl})
+	if err != nil {
+		logs.Error("RenderCertificateSvg, err: ", err)
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
@@ -0,0 +1,344 @@
+package handler
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"playground_backend/common"
+	"playground_backend/models"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/astaxie/beego"
+	"github.com/astaxie/beego/logs"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/httpstream"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/kubernetes/scheme"
+	"k8s.io/client-go/tools/remotecommand"
+	"k8s.io/client-go/transport/spdy"
+	utilexec "k8s.io/client-go/util/exec"
+)
+
+// MaxCheckTimeout is the longest a chapter check may run, in seconds
+const MaxCheckTimeout = 300
+
+// checkOutputLimit caps the output of a check that is kept
+const checkOutputLimit = 4096
+
+// checkWrapper runs the command of a check, $0, under timeout with the limit
+// in $1, so it ends in the instance too. Images without timeout run it as is.
+const checkWrapper = `command -v timeout >/dev/null 2>&1 && exec timeout "$1" sh -c "$0"; exec sh -c "$0"`
+
+// checkGraceSeconds is how long the manager waits for a check past its
+// timeout before it closes the connection
+const checkGraceSeconds = 5
+
+var (
+	ErrChapterNoCheck  = errors.New("The chapter declares no completion check")
+	ErrCheckNoInstance = errors.New("The user has no running instance for the course")
+)
+
+type ChapterCheckReq struct {
+	UserId    int64  `json:"userId"`
+	Token     string `json:"token"`
+	CourseId  string `json:"courseId"`
+	ChapterId string `json:"chapterId"`
+}
+
+type RspChapterCheck struct {
+	CourseId        string `json:"courseId"`
+	ChapterId       string `json:"chapterId"`
+	Passed          bool   `json:"passed"`
+	ExitCode        int    `json:"exitCode"`
+	Output          string `json:"output"`
+	Message         string `json:"message"`
+	CourseCompleted bool   `json:"courseCompleted"`
+}
+
+// ChapterCheck returns the completion check of a chapter, or nil without one
+func ChapterCheck(courseId, chapterId string) *ChapterCheckMeta {
+	ccp := models.CoursesChapter{CourseId: courseId, ChapterId: chapterId}
+	if models.QueryCourseChapter(&ccp, "CourseId", "ChapterId") != nil || len(ccp.CheckSpec) == 0 {
+		return nil
+	}
+	var check ChapterCheckMeta
+	if jsErr := json.Unmarshal([]byte(ccp.CheckSpec), &check); jsErr != nil {
+		logs.Error("ChapterCheck, jsErr: ", jsErr, ",chapterId: ", chapterId)
+		return nil
+	}
+	return &check
+}
+
+// checkedStatus keeps chapters with a check from being completed by the
+// client, only a passed check completes them
+func checkedStatus(courseId, chapterId string, status, current int) int {
+	if ChapterCheck(courseId, chapterId) == nil {
+		return status
+	}
+	if current == 2 {
+		return current
+	}
+	if status == 2 {
+		logs.Info("The chapter is completed by its check, courseId: ", courseId, ", chapterId: ", chapterId)
+	}
+	return 1
+}
+
+// learnerInstance returns the instance the user is bound to for a course and
+// the template it was created from, the latest one if there are several
+func learnerInstance(userId int64, courseId string) (models.ResourceInfo, string, error) {
+	riList := UserCourseInstances(userId, courseId)
+	curTime := time.Now().Unix()
+	ri := models.ResourceInfo{}
+	for _, r := range riList {
+		if r.CompleteTime > curTime && common.PraseTimeInt(r.CreateTime) >= common.PraseTimeInt(ri.CreateTime) {
+			ri = r
+		}
+	}
+	if ri.Id == 0 {
+		return ri, "", ErrCheckNoInstance
+	}
+	ure := models.UserResourceEnv{UserId: userId, CourseId: courseId, ResourceId: ri.ResourceId}
+	if queryErr := models.QueryUserResourceEnv(&ure, "UserId", "CourseId", "ResourceId"); queryErr != nil {
+		logs.Error("learnerInstance, queryErr: ", queryErr)
+		return ri, "", ErrCheckNoInstance
+	}
+	return ri, ure.TemplatePath, nil
+}
+
+// instancePod returns the namespace and the running pod of a bound instance,
+// the pods are found with courses::check_pod_selector
+func instancePod(ri models.ResourceInfo, courseId, templatePath string, clientset *kubernetes.Clientset) (string, string, error) {
+	rd := ResourceData{EnvResource: templatePath, ResourceId: ri.ResourceId, CourseId: courseId}
+	dr, err := PoolResClient(&rd)
+	if err != nil {
+		return "", "", err
+	}
+	obj, getErr := dr.Get(context.TODO(), ri.ResourceAlias, metav1.GetOptions{})
+	if getErr != nil {
+		logs.Error("instancePod, getErr: ", getErr, ",resName: ", ri.ResourceAlias)
+		return "", "", ErrCheckNoInstance
+	}
+	if obj.GetAnnotations()["resourceName"] != ri.ResourceName {
+		logs.Error("instancePod, the instance is bound to another user, resName: ", ri.ResourceAlias)
+		return "", "", ErrCheckNoInstance
+	}
+	selector := fmt.Sprintf(beego.AppConfig.DefaultString("courses::check_pod_selector", "app=%v"), ri.ResourceAlias)
+	pods, listErr := clientset.CoreV1().Pods(obj.GetNamespace()).List(context.TODO(),
+		metav1.ListOptions{LabelSelector: selector})
+	if listErr != nil {
+		logs.Error("instancePod, listErr: ", listErr)
+		return "", "", listErr
+	}
+	for _, pod := range pods.Items {
+		if pod.Status.Phase == corev1.PodRunning && pod.DeletionTimestamp == nil {
+			return obj.GetNamespace(), pod.Name, nil
+		}
+	}
+	return "", "", ErrCheckNoInstance
+}
+
+// limitedBuffer keeps the first bytes written to it and drops the rest
+type limitedBuffer struct {
+	bytes.Buffer
+	limit int
+}
+
+func (b *limitedBuffer) Write(p []byte) (int, error) {
+	if free := b.limit - b.Len(); free > 0 {
+		if len(p) > free {
+			b.Buffer.Write(p[:free])
+		} else {
+			b.Buffer.Write(p)
+		}
+	}
+	return len(p), nil
+}
+
+// closingUpgrader keeps the connection of an exec, so that it can be closed
+// when the check runs past its timeout and the stream ends with it
+type closingUpgrader struct {
+	spdy.Upgrader
+	mu     sync.Mutex
+	conn   httpstream.Connection
+	closed bool
+}
+
+func (u *closingUpgrader) NewConnection(resp *http.Response) (httpstream.Connection, error) {
+	conn, err := u.Upgrader.NewConnection(resp)
+	if err != nil {
+		return conn, err
+	}
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	u.conn = conn
+	if u.closed {
+		conn.Close()
+	}
+	return conn, nil
+}
+
+func (u *closingUpgrader) Close() {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	u.closed = true
+	if u.conn != nil {
+		u.conn.Close()
+	}
+}
+
+// ExecInInstance runs the command of a check in the learner's instance and
+// returns its exit code and output
+func ExecInInstance(ri models.ResourceInfo, courseId, templatePath string, check ChapterCheckMeta) (int, string, error) {
+	config, err := GetResConfig(ri.ResourceId)
+	if err != nil {
+		return 0, "", err
+	}
+	clientset, err := kubernetes.NewForConfig(config)
+	if err != nil {
+		logs.Error("ExecInInstance, err: ", err)
+		return 0, "", err
+	}
+	namespace, podName, podErr := instancePod(ri, courseId, templatePath, clientset)
+	if podErr != nil {
+		return 0, "", podErr
+	}
+	timeout := check.Timeout
+	if timeout <= 0 {
+		timeout = beego.AppConfig.DefaultInt("courses::check_timeout_seconds", 30)
+	}
+	req := clientset.CoreV1().RESTClient().Post().Resource("pods").Name(podName).
+		Namespace(namespace).SubResource("exec").
+		VersionedParams(&corev1.PodExecOptions{Container: check.Container,
+			Command: []string{"sh", "-c", checkWrapper, check.Command, strconv.Itoa(timeout)},
+			Stdout:  true, Stderr: true}, scheme.ParameterCodec)
+	transport, upgrader, err := spdy.RoundTripperFor(config)
+	if err != nil {
+		logs.Error("ExecInInstance, err: ", err)
+		return 0, "", err
+	}
+	cu := &closingUpgrader{Upgrader: upgrader}
+	executor, err := remotecommand.NewSPDYExecutorForTransports(transport, cu, "POST", req.URL())
+	if err != nil {
+		logs.Error("ExecInInstance, err: ", err)
+		return 0, "", err
+	}
+	output := &limitedBuffer{limit: checkOutputLimit}
+	done := make(chan error, 1)
+	go func() {
+		done <- executor.Stream(remotecommand.StreamOptions{Stdout: output, Stderr: output})
+	}()
+	select {
+	case streamErr := <-done:
+		if exitErr, ok := streamErr.(utilexec.ExitError); ok {
+			return exitErr.ExitStatus(), output.String(), nil
+		}
+		if streamErr != nil {
+			logs.Error("ExecInInstance, streamErr: ", streamErr, ",pod: ", podName)
+			return 0, output.String(), streamErr
+		}
+		return 0, output.String(), nil
+	case <-time.After(time.Duration(timeout+checkGraceSeconds) * time.Second):
+		// Closing the connection ends the stream, and the goroutine with it
+		cu.Close()
+		logs.Error("ExecInInstance, the check timed out, pod: ", podName)
+		timeoutErr := fmt.Errorf("The check did not finish within %d seconds", timeout)
+		select {
+		case <-done:
+			return 0, output.String(), timeoutErr
+		case <-time.After(checkGraceSeconds * time.Second):
+			// The stream did not end, its output may still be written to
+			return 0, "", timeoutErr
+		}
+	}
+}
+
+// checkPassed compares the outcome of a check with what the chapter expects
+func checkPassed(check ChapterCheckMeta, exitCode int, output string) (bool, string) {
+	expected := 0
+	if check.ExitCode != nil {
+		expected = *check.ExitCode
+	}
+	if exitCode != expected {
+		return false, fmt.Sprintf("The check exited with %d, %d is expected", exitCode, expected)
+	}
+	if len(check.Output) > 0 && !strings.Contains(output, strings.TrimSpace(check.Output)) {
+		return false, "The output of the check does not contain the expected output"
+	}
+	return true, "The check passed"
+}
+
+// RunChapterCheck runs the check of a chapter in the learner's instance and
+// records the result. A passed check completes the chapter, and the course
+// once all of its chapters are completed.
+func RunChapterCheck(req ChapterCheckReq) (RspChapterCheck, error) {
+	rsp := RspChapterCheck{CourseId: req.CourseId, ChapterId: req.ChapterId}
+	ucp := models.UserCourseChapter{UserId: req.UserId, CourseId: req.CourseId, ChapterId: req.ChapterId, Status: 1}
+	if queryErr := models.QueryUserCourseChapter(&ucp, "UserId", "CourseId", "ChapterId", "Status"); queryErr != nil {
+		return rsp, ErrStudyChapterNotBound
+	}
+	check := ChapterCheck(req.CourseId, req.ChapterId)
+	if check == nil {
+		return rsp, ErrChapterNoCheck
+	}
+	ri, templatePath, riErr := learnerInstance(req.UserId, req.CourseId)
+	if riErr != nil {
+		return rsp, riErr
+	}
+	ccr := models.ChapterCheckResult{UserId: req.UserId, CourseId: req.CourseId, ChapterId: req.ChapterId,
+		ResName: ri.ResourceAlias, CreateTime: common.GetCurTime()}
+	exitCode, output, execErr := ExecInInstance(ri, req.CourseId, templatePath, *check)
+	rsp.ExitCode, rsp.Output = exitCode, output
+	ccr.ExitCode, ccr.Output = exitCode, output
+	if execErr != nil {
+		ccr.Result = models.CheckError
+		ccr.Message = execErr.Error()
+	} else {
+		rsp.Passed, rsp.Message = checkPassed(*check, exitCode, output)
+		ccr.Result = models.CheckFailed
+		if rsp.Passed {
+			ccr.Result = models.CheckPassed
+		}
+		ccr.Message = rsp.Message
+	}
+	if len(ccr.Message) > 512 {
+		ccr.Message = ccr.Message[:512]
+	}
+	if _, inErr := models.InsertChapterCheckResult(&ccr); inErr != nil {
+		logs.Error("RunChapterCheck, inErr: ", inErr)
+	}
+	crd := models.Courses{CourseId: req.CourseId}
+	ccp := models.CoursesChapter{CourseId: req.CourseId, ChapterId: req.ChapterId}
+	if execErr != nil {
+		WriteCourseData(req.UserId, "0", req.CourseId, req.ChapterId, "Chapter check",
+			ri.ResourceAlias, "failed", execErr.Error(), 1, ucp.CompletedFlag, &crd, &ccp)
+		return rsp, execErr
+	}
+	state := "failed"
+	if rsp.Passed {
+		state = "success"
+		if ucp.CompletedFlag != 2 {
+			ucp.CompletedFlag = 2
+			ucp.UpdateTime = common.GetCurTime()
+			if upErr := models.UpdateUserCourseChapter(&ucp, "CompletedFlag", "UpdateTime"); upErr != nil {
+				logs.Error("RunChapterCheck, upErr: ", upErr)
+				return rsp, upErr
+			}
+		}
+		IsCompleteCourse(req.CourseId, req.UserId)
+		uc := models.UserCourse{UserId: req.UserId, CourseId: req.CourseId}
+		if models.QueryUserCourse(&uc, "UserId", "CourseId") == nil {
+			rsp.CourseCompleted = uc.CompletedFlag == 2
+		}
+	}
+	WriteCourseData(req.UserId, "0", req.CourseId, req.ChapterId, "Chapter check",
+		ri.ResourceAlias, state, rsp.Message, 1, ucp.CompletedFlag, &crd, &ccp)
+	return rsp, nil
+}
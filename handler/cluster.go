@@ -0,0 +1,295 @@
+package handler
+
+import (
+	"errors"
+	"playground_backend/common"
+	"playground_backend/models"
+	"strconv"
+	"time"
+
+	"github.com/astaxie/beego/logs"
+)
+
+var ErrClusterNotFound = errors.New("the cluster does not exist")
+
+// ClusterReq registers or updates a cluster and its image mapping. Credential
+// is the plaintext kubeconfig, or the TokenCredential JSON with the token type.
+type ClusterReq struct {
+	ResourceId     string `json:"resourceId"`
+	ClusterName    string `json:"clusterName"`
+	Region         string `json:"region"`
+	Weight         *int   `json:"weight"`
+	Capacity       *int   `json:"capacity"`
+	Status         *int8  `json:"status"`
+	EulerBranch    string `json:"eulerBranch"`
+	ResourcePath   string `json:"resourcePath"`
+	CredentialType string `json:"credentialType"`
+	Credential     string `json:"credential"`
+}
+
+// ClusterView is a cluster as returned by the admin interfaces, it never
+// carries the credentials
+type ClusterView struct {
+	ResourceId     string `json:"resourceId"`
+	ClusterName    string `json:"clusterName"`
+	Region         string `json:"region"`
+	Weight         int    `json:"weight"`
+	Capacity       int    `json:"capacity"`
+	Status         int8   `json:"status"`
+	EulerBranch    string `json:"eulerBranch"`
+	ResourcePath   string `json:"resourcePath"`
+	CredentialType string `json:"credentialType"`
+	Healthy        bool   `json:"healthy"`
+}
+
+type ClusterTestResult struct {
+	ResourceId string `json:"resourceId"`
+	LatencyMs  int64  `json:"latencyMs"`
+	Error      string `json:"error"`
+}
+
+func NewClusterView(rcp models.ResourceConfigPath) ClusterView {
+	return ClusterView{ResourceId: rcp.ResourceId, ClusterName: rcp.ClusterName, Region: rcp.Region,
+		Weight: rcp.Weight, Capacity: rcp.Capacity, Status: rcp.Status, EulerBranch: rcp.EulerBranch,
+		ResourcePath: rcp.ResourcePath, CredentialType: CredentialTypeOf(rcp.CredentialType),
+		Healthy: ClusterHealthy(rcp.ResourceId)}
+}
+
+// ValidateClusterCredential connects with the credentials and checks the CodeServer CRD
+func ValidateClusterCredential(credentialType string, plaintext []byte) error {
+	config, err := BuildResConfig(credentialType, plaintext)
+	if err != nil {
+		return err
+	}
+	_, err = ProbeResConfig(config, time.Duration(GetHealthConfig().ProbeTimeout)*time.Second)
+	return err
+}
+
+// applyCredential validates and encrypts the credentials of a request into rcp,
+// a request without a credential type is a kubeconfig
+func applyCredential(rcp *models.ResourceConfigPath, req ClusterReq) error {
+	credentialType := CredentialTypeOf(req.CredentialType)
+	if credentialType != CredentialInCluster && len(req.Credential) == 0 {
+		return errors.New("the credential is required for the " + credentialType + " credential type")
+	}
+	valErr := ValidateClusterCredential(credentialType, []byte(req.Credential))
+	if valErr != nil {
+		return errors.New("cluster validation failed: " + valErr.Error())
+	}
+	rcp.CredentialType = credentialType
+	rcp.ResourceContent = ""
+	if len(req.Credential) > 0 {
+		content, alg, encErr := EncryptResourceContent([]byte(req.Credential))
+		if encErr != nil {
+			return encErr
+		}
+		rcp.ResourceContent = content
+		rcp.EncryptionType = alg
+	}
+	return nil
+}
+
+func QueryCluster(resourceId string) (models.ResourceConfigPath, error) {
+	rcp := models.ResourceConfigPath{ResourceId: resourceId}
+	queryErr := models.QueryResourceConfigPath(&rcp, "ResourceId")
+	if queryErr != nil || rcp.Id == 0 {
+		return rcp, ErrClusterNotFound
+	}
+	return rcp, nil
+}
+
+// RegisterCluster validates the connection to a new cluster and stores it with
+// its credentials encrypted under the app key
+func RegisterCluster(req ClusterReq) (ClusterView, error) {
+	if len(req.ClusterName) == 0 || len(req.EulerBranch) == 0 || len(req.ResourcePath) == 0 {
+		return ClusterView{}, errors.New("clusterName, eulerBranch and resourcePath are required")
+	}
+	if len(req.ResourceId) == 0 {
+		req.ResourceId = common.EncryptMd5(req.ClusterName + "|" + req.EulerBranch + "|" +
+			req.ResourcePath + "|" + strconv.FormatInt(time.Now().UnixNano(), 10))
+	}
+	if len(req.ResourceId) > 32 {
+		return ClusterView{}, errors.New("resourceId must not be longer than 32 characters")
+	}
+	if _, queryErr := QueryCluster(req.ResourceId); queryErr == nil {
+		return ClusterView{}, errors.New("the resourceId is already registered")
+	}
+	rcp := models.ResourceConfigPath{ResourceId: req.ResourceId, ClusterName: req.ClusterName,
+		Region: req.Region, EulerBranch: req.EulerBranch, ResourcePath: req.ResourcePath,
+		Weight: 1, Status: models.ClusterStatusOnline}
+	if req.Weight != nil {
+		rcp.Weight = *req.Weight
+	}
+	if req.Capacity != nil {
+		rcp.Capacity = *req.Capacity
+	}
+	credErr := applyCredential(&rcp, req)
+	if credErr != nil {
+		return ClusterView{}, credErr
+	}
+	_, inErr := models.InsertResourceConfigPath(&rcp)
+	if inErr != nil {
+		logs.Error("RegisterCluster, inErr: ", inErr)
+		return ClusterView{}, inErr
+	}
+	logs.Info("Cluster registered, resourceId: ", rcp.ResourceId, ",cluster: ", rcp.ClusterName)
+	return NewClusterView(rcp), nil
+}
+
+// UpdateCluster changes the fields present in the request, new credentials are
+// validated before they replace the stored ones
+func UpdateCluster(resourceId string, req ClusterReq) (ClusterView, error) {
+	rcp, queryErr := QueryCluster(resourceId)
+	if queryErr != nil {
+		return ClusterView{}, queryErr
+	}
+	fields := []string{}
+	if len(req.ClusterName) > 0 {
+		rcp.ClusterName = req.ClusterName
+		fields = append(fields, "ClusterName")
+	}
+	if len(req.Region) > 0 {
+		rcp.Region = req.Region
+		fields = append(fields, "Region")
+	}
+	if len(req.EulerBranch) > 0 {
+		rcp.EulerBranch = req.EulerBranch
+		fields = append(fields, "EulerBranch")
+	}
+	if len(req.ResourcePath) > 0 {
+		rcp.ResourcePath = req.ResourcePath
+		fields = append(fields, "ResourcePath")
+	}
+	if req.Weight != nil {
+		rcp.Weight = *req.Weight
+		fields = append(fields, "Weight")
+	}
+	if req.Capacity != nil {
+		rcp.Capacity = *req.Capacity
+		fields = append(fields, "Capacity")
+	}
+	if req.Status != nil {
+		if *req.Status != models.ClusterStatusOnline && *req.Status != models.ClusterStatusOffline {
+			return ClusterView{}, errors.New("status must be 1 or 2")
+		}
+		rcp.Status = *req.Status
+		fields = append(fields, "Status")
+	}
+	if len(req.Credential) > 0 || len(req.CredentialType) > 0 {
+		// A credential rotation keeps the type the cluster was stored with,
+		// rows stored without one are kubeconfigs
+		if len(req.CredentialType) == 0 {
+			req.CredentialType = rcp.CredentialType
+		}
+		credErr := applyCredential(&rcp, req)
+		if credErr != nil {
+			return ClusterView{}, credErr
+		}
+		fields = append(fields, "CredentialType", "ResourceContent", "EncryptionType")
+	}
+	if len(fields) == 0 {
+		return NewClusterView(rcp), nil
+	}
+	upErr := models.UpdateResourceConfigPath(&rcp, fields...)
+	if upErr != nil {
+		logs.Error("UpdateCluster, upErr: ", upErr)
+		return ClusterView{}, upErr
+	}
+	logs.Info("Cluster updated, resourceId: ", resourceId, ",fields: ", fields)
+	return NewClusterView(rcp), nil
+}
+
+// TestCluster probes a registered cluster with its stored credentials
+func TestCluster(resourceId string) (ClusterTestResult, error) {
+	if _, queryErr := QueryCluster(resourceId); queryErr != nil {
+		return ClusterTestResult{}, queryErr
+	}
+	latency, probeErr := ProbeCluster(resourceId, time.Duration(GetHealthConfig().ProbeTimeout)*time.Second)
+	ctr := ClusterTestResult{ResourceId: resourceId, LatencyMs: latency.Milliseconds()}
+	if probeErr != nil {
+		ctr.Error = probeErr.Error()
+	}
+	return ctr, nil
+}
+
+// RetireCluster stops scheduling onto a cluster. Its idle members are drained
+// by the next pool refill, bound instances run until they are recycled.
+func RetireCluster(resourceId string) error {
+	rcp, queryErr := QueryCluster(resourceId)
+	if queryErr != nil {
+		return queryErr
+	}
+	rcp.Status = models.ClusterStatusOffline
+	upErr := models.UpdateResourceConfigPath(&rcp, "Status")
+	if upErr != nil {
+		logs.Error("RetireCluster, upErr: ", upErr)
+		return upErr
+	}
+	logs.Info("Cluster retired, resourceId: ", resourceId, ",cluster: ", rcp.ClusterName)
+	return nil
+}
+
+func ClusterList() ([]ClusterView, error) {
+	rcpList, _, queryErr := models.QueryResourceConfigPathAll()
+	if queryErr != nil {
+		return nil, queryErr
+	}
+	cvList := make([]ClusterView, 0, len(rcpList))
+	for _, rcp := range rcpList {
+		cvList = append(cvList, NewClusterView(rcp))
+	}
+	return cvList, nil
+}
+
+type RotateResult struct {
+	ActiveKey string   `json:"activeKey"`
+	Rotated   int      `json:"rotated"`
+	Skipped   int      `json:"skipped"`
+	Failed    []string `json:"failed"`
+}
+
+// RotateClusterSecrets re-encrypts the credentials of every cluster that is not
+// yet under the active key. Replicas keep reading both keys while it runs, and
+// a row changed in the meantime is left to the next run.
+func RotateClusterSecrets() (RotateResult, error) {
+	activeKey := common.ActiveKeyId()
+	rr := RotateResult{ActiveKey: activeKey, Failed: []string{}}
+	if activeKey == common.LegacyKeyId {
+		return rr, errors.New("crypto::active_key is not configured")
+	}
+	rcpList, _, queryErr := models.QueryResourceConfigPathAll()
+	if queryErr != nil {
+		return rr, queryErr
+	}
+	for _, rcp := range rcpList {
+		if len(rcp.ResourceContent) == 0 {
+			rr.Skipped++
+			continue
+		}
+		plaintext, keyId, decErr := common.DecryptSecret(rcp.ResourceContent)
+		if decErr != nil {
+			logs.Error("RotateClusterSecrets, decErr: ", decErr, ",resourceId: ", rcp.ResourceId)
+			rr.Failed = append(rr.Failed, rcp.ResourceId)
+			continue
+		}
+		if keyId == activeKey {
+			rr.Skipped++
+			continue
+		}
+		content, alg, encErr := common.EncryptSecret(plaintext)
+		if encErr != nil {
+			logs.Error("RotateClusterSecrets, encErr: ", encErr, ",resourceId: ", rcp.ResourceId)
+			rr.Failed = append(rr.Failed, rcp.ResourceId)
+			continue
+		}
+		ok, upErr := models.UpdateResourceContentIfUnchanged(rcp.Id, rcp.ResourceContent, content, alg)
+		if upErr != nil || !ok {
+			logs.Error("RotateClusterSecrets, upErr: ", upErr, ",resourceId: ", rcp.ResourceId)
+			rr.Failed = append(rr.Failed, rcp.ResourceId)
+			continue
+		}
+		rr.Rotated++
+	}
+	logs.Info("RotateClusterSecrets, result: ", rr)
+	return rr, nil
+}
@@ -2,9 +2,7 @@ package handler
 
 import (
 	"fmt"
-	"os"
 	"playground_backend/common"
-	"playground_backend/http"
 	"playground_backend/models"
 	"strings"
 
@@ -47,6 +45,7 @@ type RspCourseData struct {
 	CourseName  string                 `json:"courseName"`
 	Status      int                    `json:"status"`
 	IsOnline    int8                   `json:"isOnline"`
+	StudyTime   int64                  `json:"studyTime"`
 	ChapterData []RspCourseChapterData `json:"chapterInfo"`
 }
 
@@ -55,26 +54,19 @@ type RspCourseChapterData struct {
 	ChapterName string `json:"chapterName"`
 	Status      int    `json:"status"`
 	IsOnline    int8   `json:"isOnline"`
+	StudyTime   int64  `json:"studyTime"`
 }
 
-type EnvPrams struct {
-	OnlineEnv        string
-	OfflineEnv       string
-	CourseUrl        string
-	ChapterUrl       string
-	ChapterDetailUrl string
-}
-
-type EulerBranch struct {
-	imageid string
-}
+// Statistics events of learner rows following their course offline and back
+const (
+	LearnerOfflineEvent = "Learner progress offline"
+	LearnerRestoreEvent = "Learner progress restored"
+)
 
-type ChapterDetailData struct {
-	Title       string
-	Description string
-	Details     interface{}
-	Environment interface{}
-	Backend     EulerBranch
+type EnvPrams struct {
+	OnlineEnv  string
+	OfflineEnv string
+	Source     CourseSource
 }
 
 func addUserCourse(crp CourseReqParameter, uc *models.UserCourse, flag int) {
@@ -90,12 +82,20 @@ func addUserCourse(crp CourseReqParameter, uc *models.UserCourse, flag int) {
 	}
 }
 
-func UserBoundBourse(crp CourseReqParameter) int64 {
+// UserBoundBourse binds a course to a user, the error is an *UnmetRules
+// when the user has not completed its prerequisites
+func UserBoundBourse(crp CourseReqParameter) (int64, error) {
 	crd := models.Courses{CourseId: crp.CourseId}
 	ccp := models.CoursesChapter{CourseId: crp.CourseId, ChapterId: ""}
 	WriteCourseData(crp.UserId, "0", crp.CourseId, "", "User bound course",
 		"", "Processing", "",
 		crp.Status, crp.Status, &crd, &ccp)
+	if ruleErr := CheckLearnRules(crp.UserId, crp.CourseId, ""); ruleErr != nil {
+		WriteCourseData(crp.UserId, "0", crp.CourseId, "", "User bound course",
+			"", "failed", ruleErr.Error(),
+			crp.Status, crp.Status, &crd, &ccp)
+		return 0, ruleErr
+	}
 	uc := models.UserCourse{UserId: crp.UserId, CourseId: crp.CourseId}
 	ucId := int64(0)
 	queryErr := models.QueryUserCourse(&uc, "UserId", "CourseId")
@@ -108,7 +108,7 @@ func UserBoundBourse(crp CourseReqParameter) int64 {
 			WriteCourseData(crp.UserId, "0", crp.CourseId, "", "User bound course",
 				"", "failed", "User binding course failed",
 				crp.Status, crp.Status, &crd, &ccp)
-			return 0
+			return 0, upErr
 		}
 		ucId = uc.Id
 	} else {
@@ -120,7 +120,7 @@ func UserBoundBourse(crp CourseReqParameter) int64 {
 			WriteCourseData(crp.UserId, "0", crp.CourseId, "", "User bound course",
 				"", "failed", "User binding course failed",
 				crp.Status, crp.Status, &crd, &ccp)
-			return 0
+			return 0, inErr
 		}
 		ucId = id
 	}
@@ -129,7 +129,7 @@ func UserBoundBourse(crp CourseReqParameter) int64 {
 	WriteCourseData(crp.UserId, "0", crp.CourseId, "", "User bound course",
 		"", "success", "User binding course successfully",
 		crp.Status, crp.Status, &crd, &ccp)
-	return ucId
+	return ucId, nil
 }
 
 func IsCompleteCourse(courseId string, userId int64) {
@@ -148,6 +148,9 @@ func IsCompleteCourse(courseId string, userId int64) {
 		}
 		if completeFlag {
 			models.UpdateUserCourseCompleted(2, courseId, userId)
+			if _, certErr := IssueCertificate(userId, courseId); certErr != nil && certErr != ErrCertificateDisabled {
+				logs.Error("IsCompleteCourse, certErr: ", certErr)
+			}
 		}
 	}
 }
@@ -165,14 +168,23 @@ func addUserCourseChapter(crp ChapterReqParameter, uc *models.UserCourseChapter,
 	uc.UpdateTime = common.GetCurTime()
 }
 
-func UserBoundBourseChapter(crp ChapterReqParameter, ucId, userId int64, courseId string, courseStatus int) {
+// UserBoundBourseChapter binds a chapter to a user, the error is an
+// *UnmetRules when the chapters before it in a sequential course are not completed
+func UserBoundBourseChapter(crp ChapterReqParameter, ucId, userId int64, courseId string, courseStatus int) error {
 	crd := models.Courses{CourseId: courseId}
 	ccp := models.CoursesChapter{CourseId: courseId, ChapterId: crp.ChapterId}
 	WriteCourseData(userId, "0", courseId, crp.ChapterId, "User bound chapter",
 		"", "Processing", "",
 		courseStatus, crp.Status, &crd, &ccp)
+	if ruleErr := CheckLearnRules(userId, courseId, crp.ChapterId); ruleErr != nil {
+		WriteCourseData(userId, "0", courseId, crp.ChapterId, "User bound chapter",
+			"", "failed", ruleErr.Error(),
+			courseStatus, crp.Status, &crd, &ccp)
+		return ruleErr
+	}
 	uc := models.UserCourseChapter{UserId: userId, CourseId: courseId, ChapterId: crp.ChapterId}
 	queryErr := models.QueryUserCourseChapter(&uc, "UserId", "CourseId", "ChapterId")
+	crp.Status = checkedStatus(courseId, crp.ChapterId, crp.Status, uc.CompletedFlag)
 	if uc.Id > 0 || queryErr == nil {
 		uc.CId = crd.Id
 		uc.TId = ccp.Id
@@ -185,7 +197,7 @@ func UserBoundBourseChapter(crp ChapterReqParameter, ucId, userId int64, courseI
 			WriteCourseData(userId, "0", courseId, crp.ChapterId, "User bound chapter",
 				"", "failed", "User binding course chapter failed",
 				courseStatus, crp.Status, &crd, &ccp)
-			return
+			return upErr
 		}
 	} else {
 		uc.CId = crd.Id
@@ -198,123 +210,254 @@ func UserBoundBourseChapter(crp ChapterReqParameter, ucId, userId int64, courseI
 			WriteCourseData(userId, "0", courseId, crp.ChapterId, "User bound chapter",
 				"", "failed", "User binding course chapter failed",
 				courseStatus, crp.Status, &crd, &ccp)
-			return
+			return inErr
 		}
 	}
 	WriteCourseData(userId, "0", courseId, crp.ChapterId, "User bound chapter",
 		"", "success", "User binding course chapter successfully",
 		courseStatus, crp.Status, &crd, &ccp)
+	return nil
+}
+
+// rejectCourse reports an invalid course, a course already in the database
+// keeps its previous content
+func (ep EnvPrams) rejectCourse(errs []SyncError, report *SyncReport) {
+	for _, e := range errs {
+		logs.Error("AddCourseToDb, rejected, ", e.Error())
+	}
+	report.Reject(errs)
+}
+
+// offlineCourse takes an online course and its chapters offline
+func (ep EnvPrams) offlineCourse(courseId string, report *SyncReport) {
+	cr := models.Courses{}
+	cr.CourseId = courseId
+	queryErr := models.QueryCourse(&cr, "CourseId")
+	if cr.Id > 0 {
+		if cr.Status == 2 {
+			return
+		}
+		cr.Status = 2
+		cr.DeleteTime = common.GetCurTime()
+		cr.Flag = 1
+		delErr := models.UpdateCourse(&cr, "Status", "DeleteTime", "Flag")
+		if delErr != nil {
+			logs.Error("AddCourseToDb, delErr: ", delErr)
+			return
+		}
+		delChapterErr := models.UpdateCourseAllChapter(cr.Status, 1, cr.CourseId)
+		if delChapterErr != nil {
+			logs.Error("AddCourseToDb, delChapterErr: ", delChapterErr)
+		}
+		report.Offline = append(report.Offline, courseId)
+		report.Diffs = append(report.Diffs, syncDiff(courseId, "", SyncActionOffline))
+	} else {
+		logs.Info("AddCourseToDb, The course does not exist, "+
+			"no need to go offline, queryErr: ", queryErr)
+	}
 }
 
-func (ep EnvPrams) AddCourseToDb(cr interface{}) {
-	cor := cr.(map[string]interface{})
-	statusList := cor["status"].([]interface{})
+// loadCourseContent reads the content of a course and the detail of each of
+// its chapters, the course is only saved when all of them are valid
+func (ep EnvPrams) loadCourseContent(cm CourseMeta) (CourseContentMeta, []ChapterDetailMeta, []SyncError) {
+	content := CourseContentMeta{}
+	base := SyncError{CourseId: cm.Id, ContentDir: cm.ContentDir, Stage: SyncStageContent}
+	body, resErr := ep.Source.Chapters(cm.ContentDir)
+	if resErr != nil {
+		base.Message = resErr.Error()
+		return content, nil, []SyncError{base}
+	}
+	if decErr := decodeMeta(body, &content); decErr != nil {
+		base.Message = decErr.Error()
+		return content, nil, []SyncError{base}
+	}
+	if errs := content.Validate(cm); len(errs) > 0 {
+		return content, nil, errs
+	}
+	var errs []SyncError
+	details := make([]ChapterDetailMeta, 0, len(content.Chapters))
+	for _, chapter := range content.Chapters {
+		detail, detailErrs := ep.GetChapterDetail(cm, chapter.ContentDir)
+		errs = append(errs, detailErrs...)
+		details = append(details, detail)
+	}
+	return content, details, errs
+}
+
+// AddCourseToDb saves or takes offline one course of the course list, an
+// invalid course is rejected into the report and nothing of it is saved
+func (ep EnvPrams) AddCourseToDb(cm CourseMeta, report *SyncReport) {
+	if errs := cm.Validate(); len(errs) > 0 {
+		ep.rejectCourse(errs, report)
+		return
+	}
+	online := false
 	onEnvList := strings.Split(ep.OnlineEnv, ",")
-	if len(statusList) > 0 && len(onEnvList) > 0 {
-		for _, st := range statusList {
-			status := st.(string)
-			status = strings.ToLower(status)
-			if status == ep.OfflineEnv {
-				cr := models.Courses{}
-				cr.CourseId = cor["id"].(string)
-				queryErr := models.QueryCourse(&cr, "CourseId")
-				if cr.Id > 0 {
-					cr.Status = 2
-					cr.DeleteTime = common.GetCurTime()
-					cr.Flag = 1
-					delErr := models.UpdateCourse(&cr, "Status", "DeleteTime", "Flag")
-					if delErr == nil {
-						delChapterErr := models.UpdateCourseAllChapter(cr.Status, 1, cr.CourseId)
-						if delChapterErr != nil {
-							logs.Error("AddCourseToDb, delChapterErr: ", delChapterErr)
-						}
-					}
-				} else {
-					logs.Info("AddCourseToDb, The course does not exist, "+
-						"no need to go offline, queryErr: ", queryErr)
-				}
+	for _, st := range cm.Status {
+		status := strings.ToLower(st)
+		if status == ep.OfflineEnv {
+			ep.offlineCourse(cm.Id, report)
+		}
+		for _, env := range onEnvList {
+			if status == env {
+				online = true
 			}
-			for _, env := range onEnvList {
-				if status == env {
-					imageid := ""
-					coursePathName := cor["content_dir"].(string)
-					courseId := cor["id"].(string)
-					chapterUrl := fmt.Sprintf(ep.ChapterUrl, coursePathName)
-					body, resErr := http.HTTPGitGet(chapterUrl)
-					logs.Error(body, "----------------:chapterUrl:", chapterUrl)
-					if resErr != nil {
-						logs.Error("AddCourseToDb, resErr: ", resErr, ",body: ", body)
-						continue
-					}
-					cId := int64(0)
-					cr := models.Courses{}
-					cr.CourseId = courseId
-					queryErr := models.QueryCourse(&cr, "CourseId")
-					if cr.Id > 0 {
-						cr.Name = cor["content_dir"].(string)
-						AddCourseData(body, &cr)
-						upErr := models.UpdateCourse(&cr, "Status", "Name",
-							"Title", "Description", "Icon", "Poster", "Banner",
-							"Estimated", "UpdateTime", "Flag")
-						if upErr != nil {
-							logs.Error("AddCourseToDb, upErr: ", upErr)
-						}
-						cId = cr.Id
-					} else {
-						cr.CourseId = courseId
-						cr.Name = cor["content_dir"].(string)
-						AddCourseData(body, &cr)
-						id, inErr := models.InsertCourse(&cr)
-						if inErr != nil {
-							logs.Error("AddCourseToDb, inErr: ", inErr, ",queryErr: ", queryErr)
-						}
-						cId = id
-					}
-					upChapterErr := models.UpdateCourseAllChapter(2, 2, cr.CourseId)
-					if upChapterErr != nil {
-						logs.Error("AddCourseToDb, delChapterErr: ", upChapterErr)
-					}
-					chapterList := body["chapters"].([]interface{})
-					if len(chapterList) > 0 {
-						for _, ct := range chapterList {
-							chapter := ct.(map[string]interface{})
-							cdd := ChapterDetailData{}
-							chapterId := chapter["content_dir"].(string)
-							ep.GetChapterDetail(coursePathName, chapterId, &cdd)
-							imageid = cdd.Backend.imageid
-							cp := models.CoursesChapter{CourseId: cr.CourseId, ChapterId: chapterId, EulerBranch: cdd.Backend.imageid}
-							querychapterErr := models.QueryCourseChapter(&cp, "CourseId", "ChapterId")
-							if cp.Id > 0 {
-								AddChapterData(chapter, &cp, cId)
-								cp.EulerBranch = cdd.Backend.imageid
-								upChapterErr := models.UpdateCourseChapter(&cp,
-									"Status", "Title", "Description", "Estimated", "UpdateTime", "EulerBranch")
-								if upChapterErr != nil {
-									logs.Error("UpdateCourseChapter, upChapterErr: ", upChapterErr)
-								}
-							} else {
-								cp.CourseId = cr.CourseId
-								cp.EulerBranch = cdd.Backend.imageid
-								AddChapterData(chapter, &cp, cId)
-								_, inChapterErr := models.InsertCourseChapter(&cp)
-								if inChapterErr != nil {
-									logs.Error("InsertCourseChapter, inChapterErr: ",
-										inChapterErr, ",querychapterErr: ", querychapterErr)
-								}
-							}
-						}
-					}
-					if len(imageid) > 1 {
-						upErr := models.UpdateCourseByCId(courseId, imageid)
-						if upErr != nil {
-							logs.Error("UpdateCourseByCId,upErr: ", upErr, courseId, imageid)
-						}
-						ProcCourseAndResRel(courseId, coursePathName, imageid)
-					}
+		}
+	}
+	if online {
+		ep.saveCourse(cm, report)
+	}
+}
+
+// saveCourse writes the columns of a course and its chapters that changed
+// and records the changes in the report
+func (ep EnvPrams) saveCourse(cm CourseMeta, report *SyncReport) {
+	content, details, errs := ep.loadCourseContent(cm)
+	if len(errs) > 0 {
+		ep.rejectCourse(errs, report)
+		return
+	}
+	saveErr := SyncError{CourseId: cm.Id, ContentDir: cm.ContentDir, Stage: SyncStageSave}
+	imageid := ""
+	for _, detail := range details {
+		imageid = detail.ImageId()
+	}
+	courseId := cm.Id
+	cr := models.Courses{}
+	cr.CourseId = courseId
+	queryErr := models.QueryCourse(&cr, "CourseId")
+	nc := cr
+	nc.Name = cm.ContentDir
+	nc.DeleteTime = ""
+	AddCourseData(content, &nc)
+	if len(imageid) > 1 {
+		nc.EulerBranch = imageid
+	}
+	var diffs []models.CourseSyncDiff
+	if cr.Id > 0 {
+		diffs = diffFields(courseId, "", []syncField{
+			{"Name", cr.Name, nc.Name}, {"Title", cr.Title, nc.Title},
+			{"Description", cr.Description, nc.Description}, {"Icon", cr.Icon, nc.Icon},
+			{"Poster", cr.Poster, nc.Poster}, {"Banner", cr.Banner, nc.Banner},
+			{"Estimated", cr.Estimated, nc.Estimated}, {"EulerBranch", cr.EulerBranch, nc.EulerBranch},
+			{"Requires", cr.Requires, nc.Requires}, {"Ordering", cr.Ordering, nc.Ordering},
+			{"Status", fmt.Sprint(cr.Status), fmt.Sprint(nc.Status)},
+			{"DeleteTime", cr.DeleteTime, nc.DeleteTime}})
+		if len(diffs) > 0 {
+			upErr := models.UpdateCourse(&nc, diffColumns(diffs)...)
+			if upErr != nil {
+				logs.Error("AddCourseToDb, upErr: ", upErr)
+				saveErr.Message = upErr.Error()
+				ep.rejectCourse([]SyncError{saveErr}, report)
+				return
+			}
+		}
+		if cr.Status == 2 {
+			// The course is back under the same id, so are its learners
+			courseNum, reErr := models.RestoreUserCourseByCourseId(courseId, models.OfflineByCourse)
+			if reErr != nil {
+				logs.Error("AddCourseToDb, reErr: ", reErr)
+			}
+			logLearnerTransition(courseId, "", LearnerRestoreEvent, courseNum, 0, 1, 1)
+		}
+	} else {
+		id, inErr := models.InsertCourse(&nc)
+		if inErr != nil {
+			logs.Error("AddCourseToDb, inErr: ", inErr, ",queryErr: ", queryErr)
+			saveErr.Message = inErr.Error()
+			ep.rejectCourse([]SyncError{saveErr}, report)
+			return
+		}
+		nc.Id = id
+		diffs = append(diffs, syncDiff(courseId, "", SyncActionAdded))
+	}
+	diffs = append(diffs, saveChapters(nc, content, details)...)
+	report.Diffs = append(report.Diffs, diffs...)
+	if cr.Id == 0 {
+		report.Added = append(report.Added, courseId)
+	} else if len(diffs) > 0 {
+		report.Updated = append(report.Updated, courseId)
+	} else {
+		report.Unchanged = append(report.Unchanged, courseId)
+	}
+	if len(imageid) > 1 {
+		// A changed course moves to the current content of the templates it follows
+		if len(diffs) > 0 {
+			RefreshCourseTemplates(courseId)
+		}
+		ProcCourseAndResRel(courseId, cm.ContentDir, imageid)
+	}
+}
+
+// saveChapters writes the chapters of a course that changed, chapters no
+// longer in its content are taken offline
+func saveChapters(cr models.Courses, content CourseContentMeta, details []ChapterDetailMeta) []models.CourseSyncDiff {
+	diffs := []models.CourseSyncDiff{}
+	existing := models.QueryAllCourseChapterById(cr.CourseId)
+	current := map[string]bool{}
+	for i, chapter := range content.Chapters {
+		chapterId := chapter.ContentDir
+		current[chapterId] = true
+		cp := models.CoursesChapter{CourseId: cr.CourseId, ChapterId: chapterId}
+		for _, ec := range existing {
+			if ec.ChapterId == chapterId {
+				cp = ec
+				break
+			}
+		}
+		nc := cp
+		nc.DeleteTime = ""
+		AddChapterData(chapter, &nc, cr.Id)
+		nc.EulerBranch = details[i].ImageId()
+		nc.CheckSpec = details[i].CheckSpec()
+		nc.Position = i + 1
+		if cp.Id > 0 {
+			chapterDiffs := diffFields(cr.CourseId, chapterId, []syncField{
+				{"CId", fmt.Sprint(cp.CId), fmt.Sprint(nc.CId)}, {"Title", cp.Title, nc.Title},
+				{"Description", cp.Description, nc.Description}, {"Estimated", cp.Estimated, nc.Estimated},
+				{"EulerBranch", cp.EulerBranch, nc.EulerBranch}, {"CheckSpec", cp.CheckSpec, nc.CheckSpec},
+				{"Position", fmt.Sprint(cp.Position), fmt.Sprint(nc.Position)},
+				{"Status", fmt.Sprint(cp.Status), fmt.Sprint(nc.Status)},
+				{"DeleteTime", cp.DeleteTime, nc.DeleteTime}})
+			if len(chapterDiffs) == 0 {
+				continue
+			}
+			upChapterErr := models.UpdateCourseChapter(&nc, diffColumns(chapterDiffs)...)
+			if upChapterErr != nil {
+				logs.Error("UpdateCourseChapter, upChapterErr: ", upChapterErr)
+				continue
+			}
+			diffs = append(diffs, chapterDiffs...)
+			if cp.Status == 2 {
+				chapterNum, reErr := models.RestoreUserCourseChapterByChapterId(cr.CourseId, chapterId)
+				if reErr != nil {
+					logs.Error("UpdateCourseChapter, reErr: ", reErr)
 				}
+				logLearnerTransition(cr.CourseId, chapterId, LearnerRestoreEvent, 0, chapterNum, 1, 1)
+			}
+		} else {
+			_, inChapterErr := models.InsertCourseChapter(&nc)
+			if inChapterErr != nil {
+				logs.Error("InsertCourseChapter, inChapterErr: ", inChapterErr)
+				continue
 			}
+			diffs = append(diffs, syncDiff(cr.CourseId, chapterId, SyncActionAdded))
 		}
 	}
+	for _, ec := range existing {
+		if current[ec.ChapterId] || ec.Status != 1 {
+			continue
+		}
+		ec.Status = 2
+		ec.DeleteTime = common.GetCurTime()
+		upChapterErr := models.UpdateCourseChapter(&ec, "Status", "DeleteTime")
+		if upChapterErr != nil {
+			logs.Error("UpdateCourseChapter, upChapterErr: ", upChapterErr)
+			continue
+		}
+		diffs = append(diffs, syncDiff(cr.CourseId, ec.ChapterId, SyncActionOffline))
+	}
+	return diffs
 }
 
 func ProcCourseAndResRel(courseId, courseDir, eulerBranch string) {
@@ -327,137 +470,144 @@ func ProcCourseAndResRel(courseId, courseDir, eulerBranch string) {
 	}
 }
 
+// SaveCourseAndResRel binds the course to the template version it is mapped
+// to, see ResolveCourseTemplate, on every cluster serving the template
 func (rr *ReqResource) SaveCourseAndResRel(rcp *models.ResourceConfigPath, courseDir string) error {
-	trymePath := fmt.Sprintf("%v/%v.tmpl", TRYME, rcp.EulerBranch)
-	originTemplatePath := fmt.Sprintf("%v", rcp.EulerBranch)
-	defTemplatePath := fmt.Sprintf("%v/%v", DEFAULT, rcp.EulerBranch)
-	defContainerTemplatePath := fmt.Sprintf("%v/%v_%v", DEFAULT, rcp.EulerBranch, CONTAINER)
-	customTemplatePath := fmt.Sprintf("%v/%v_%v_%v", CUSTOMIZATION, rcp.EulerBranch, courseDir, CONTAINER)
-	oldTemplatePath := fmt.Sprintf("%v/%v", rcp.EulerBranch, LXD)
-	rcp.ResourcePath = trymePath
-	logs.Info("试  :", rcp.ResourcePath)
-	rcpErr := models.QueryResourceConfigPath(rcp, "EulerBranch", "ResourcePath")
-	if rcp.Id > 0 {
-		rr.EnvResource = rcp.ResourcePath
-		rr.ResourceId = rcp.ResourceId
-		saveErr := SaveResourceTemplate(rr)
-		return saveErr
-	}
-	rcp.ResourcePath = originTemplatePath
-	logs.Info("试  :", rcp.ResourcePath)
-	rcpErr = models.QueryResourceConfigPath(rcp, "EulerBranch", "ResourcePath")
-	if rcp.Id > 0 {
-		rr.EnvResource = rcp.ResourcePath
-		rr.ResourceId = rcp.ResourceId
-		saveErr := SaveResourceTemplate(rr)
-		return saveErr
-	}
-	rcp.ResourcePath = defTemplatePath
-	logs.Info("试  :", rcp.ResourcePath)
-	rcpErr = models.QueryResourceConfigPath(rcp, "EulerBranch", "ResourcePath")
-	if rcp.Id > 0 {
-		rr.EnvResource = rcp.ResourcePath
-		rr.ResourceId = rcp.ResourceId
-		saveErr := SaveResourceTemplate(rr)
-		return saveErr
-	}
-
-	rcp.ResourcePath = defContainerTemplatePath
-	logs.Info("试  :", rcp.ResourcePath)
-	rcpErr = models.QueryResourceConfigPath(rcp, "EulerBranch", "ResourcePath")
-	if rcp.Id > 0 {
-		rr.EnvResource = rcp.ResourcePath
-		rr.ResourceId = rcp.ResourceId
-		saveErr := SaveResourceTemplate(rr)
-		return saveErr
-	}
-	rcp.ResourcePath = customTemplatePath
-	logs.Info("试  :", rcp.ResourcePath)
-	rcpErr = models.QueryResourceConfigPath(rcp, "EulerBranch", "ResourcePath")
-	if rcp.Id > 0 {
-		rr.EnvResource = rcp.ResourcePath
-		rr.ResourceId = rcp.ResourceId
-		saveErr := SaveResourceTemplate(rr)
-		return saveErr
-	}
-
-	rcp.ResourcePath = oldTemplatePath
-	logs.Info("试  :", rcp.ResourcePath)
-	rcpErr = models.QueryResourceConfigPath(rcp, "EulerBranch", "ResourcePath")
-	if rcp.Id > 0 {
-		rr.EnvResource = rcp.ResourcePath
-		rr.ResourceId = rcp.ResourceId
-		saveErr := SaveResourceTemplate(rr)
-		return saveErr
+	tr, resErr := ResolveCourseTemplate(rr.CourseId, rr.ChapterId, rcp.EulerBranch, courseDir)
+	if resErr != nil {
+		logs.Error("SaveCourseAndResRel, resErr: ", resErr, ",courseId: ", rr.CourseId,
+			",eulerBranch: ", rcp.EulerBranch)
+		return resErr
 	}
-	if rcpErr != nil {
-		logs.Error("QueryResourceConfigPath, rcpErr: ", rcpErr)
+	rcp.EulerBranch = tr.EulerBranch
+	rcp.ResourcePath = tr.Name
+	return rr.BindClusters(rcp, VersionedPath(tr.Name, tr.Version))
+}
+
+// BindClusters saves the course on every cluster serving the matched template,
+// so each of them keeps a pool, and schedules the request onto one of them.
+// The course resources refer to the template version in resourcePath.
+func (rr *ReqResource) BindClusters(rcp *models.ResourceConfigPath, resourcePath string) error {
+	rcpList, _, listErr := models.QueryResourceConfigPathList(rcp.EulerBranch, rcp.ResourcePath)
+	if len(rcpList) == 0 {
+		logs.Error("BindClusters, no cluster is schedulable, listErr: ", listErr, ",path: ", rcp.ResourcePath)
+		return errors.New("no cluster is schedulable")
 	}
-	return rcpErr
+	for _, cluster := range rcpList {
+		crr := *rr
+		crr.EnvResource = resourcePath
+		crr.ResourceId = cluster.ResourceId
+		moveTemplateRel(rr.CourseId, cluster.ResourceId, resourcePath)
+		saveErr := SaveResourceTemplate(&crr)
+		if saveErr != nil {
+			return saveErr
+		}
+	}
+	chosen, schErr := ScheduleCluster(*rr, rcpList)
+	if schErr != nil {
+		logs.Error("BindClusters, schErr: ", schErr, ",path: ", rcp.ResourcePath)
+		return schErr
+	}
+	*rcp = chosen
+	rcp.ResourcePath = resourcePath
+	rr.EnvResource = resourcePath
+	rr.ResourceId = chosen.ResourceId
+	return nil
 }
 
-func (ep EnvPrams) GetChapterDetail(coursePathName, chapterId string, cdd *ChapterDetailData) {
-	chapterDetailUrl := fmt.Sprintf(ep.ChapterDetailUrl, coursePathName, chapterId)
-	body, resErr := http.HTTPGitGet(chapterDetailUrl)
+func (ep EnvPrams) GetChapterDetail(cm CourseMeta, chapterId string) (ChapterDetailMeta, []SyncError) {
+	detail := ChapterDetailMeta{}
+	base := SyncError{CourseId: cm.Id, ContentDir: cm.ContentDir, ChapterId: chapterId, Stage: SyncStageDetail}
+	body, resErr := ep.Source.ChapterDetail(cm.ContentDir, chapterId)
 	if resErr != nil {
-		logs.Error("AddCourseToDb, resErr: ", resErr, ",body: ", body)
-		return
+		logs.Error("GetChapterDetail, resErr: ", resErr, ",body: ", body)
+		base.Message = resErr.Error()
+		return detail, []SyncError{base}
 	}
-	cdd.Title = body["title"].(string)
-	cdd.Description = body["description"].(string)
-	eulerBranch := body["backend"].(map[string]interface{})
-	imageid, ok := eulerBranch["image_id"]
-	if ok {
-		cdd.Backend.imageid = imageid.(string)
+	if decErr := decodeMeta(body, &detail); decErr != nil {
+		base.Message = decErr.Error()
+		return detail, []SyncError{base}
 	}
+	return detail, detail.Validate(cm, chapterId)
 }
 
-func AddChapterData(cor map[string]interface{}, cr *models.CoursesChapter, cId int64) {
+func AddChapterData(ch ChapterMeta, cr *models.CoursesChapter, cId int64) {
 	cr.Status = 1
 	cr.CId = cId
-	cr.ChapterId = cor["content_dir"].(string)
-	cr.Title = cor["title"].(string)
-	cr.Description = cor["description"].(string)
-	cr.Estimated = cor["estimated_time"].(string)
+	cr.ChapterId = ch.ContentDir
+	cr.Title = ch.Title
+	cr.Description = ch.Description
+	cr.Estimated = string(ch.EstimatedTime)
 	cr.UpdateTime = common.GetCurTime()
 	cr.CreateTime = common.GetCurTime()
 }
 
-func AddCourseData(cor map[string]interface{}, cr *models.Courses) {
+func AddCourseData(content CourseContentMeta, cr *models.Courses) {
 	cr.Status = 1
 	cr.Flag = 1
-	cr.Title = cor["title"].(string)
-	cr.Description = cor["description"].(string)
-	cr.Icon = cor["logo"].(string)
-	cr.Poster = cor["poster"].(string)
-	cr.Banner = cor["cover"].(string)
-	cr.Estimated = cor["container_live_time"].(string)
+	cr.Title = content.Title
+	cr.Description = content.Description
+	cr.Icon = content.Logo
+	cr.Poster = content.Poster
+	cr.Banner = content.Cover
+	cr.Estimated = string(content.ContainerLiveTime)
+	cr.Requires = strings.Join(content.Prerequisites, ",")
+	cr.Ordering = content.ChapterOrder
+	if len(cr.Ordering) == 0 {
+		cr.Ordering = ChapterOrderFree
+	}
 	cr.UpdateTime = common.GetCurTime()
 	cr.CreateTime = common.GetCurTime()
 }
 
-func (ep EnvPrams) ParsingCourse(body map[string]interface{}) error {
-	courses, ok := body["courses"]
+// ParsingCourse saves every valid course of the course list and takes the
+// courses missing from it offline, the outcome is added to the report. With
+// courseIds only those courses are synced.
+func (ep EnvPrams) ParsingCourse(body map[string]interface{}, report *SyncReport, courseIds ...string) error {
+	courses, ok := body["courses"].([]interface{})
 	if !ok {
 		logs.Error("The course list file is abnormal and cannot be parsed")
 		return errors.New("The course list file is abnormal and cannot be parsed")
 	}
-	cousrseList := courses.([]interface{})
-	if len(cousrseList) > 0 {
-		models.UpdateCourseFlag(2)
-		for _, cousrse := range cousrseList {
-			ep.AddCourseToDb(cousrse)
+	if len(courses) > 0 {
+		scope := map[string]bool{}
+		for _, courseId := range courseIds {
+			scope[courseId] = true
 		}
-		courseList := models.QueryAllCourseData(0)
-		if len(courseList) > 0 {
-			for _, cs := range courseList {
-				if cs.Flag == 2 {
-					cs.Status = 2
-					cs.DeleteTime = common.GetCurTime()
-					models.UpdateCourse(&cs, "Status", "DeleteTime")
-					models.UpdateCourseAllChapter(2, 1, cs.CourseId)
+		// Courses in the list, rejected ones included, are not taken offline
+		listed := map[string]bool{}
+		for i, course := range courses {
+			cm := CourseMeta{}
+			entry, isMap := course.(map[string]interface{})
+			if isMap && len(scope) > 0 {
+				if id, _ := entry["id"].(string); !scope[id] {
+					continue
 				}
 			}
+			if !isMap {
+				ep.rejectCourse([]SyncError{{Stage: SyncStageList, Field: fmt.Sprintf("courses[%d]", i),
+					Message: "is not an object"}}, report)
+				continue
+			}
+			if decErr := decodeMeta(entry, &cm); decErr != nil {
+				id, _ := entry["id"].(string)
+				dir, _ := entry["content_dir"].(string)
+				listed[id] = true
+				ep.rejectCourse([]SyncError{{CourseId: id, ContentDir: dir, Stage: SyncStageList,
+					Field: fmt.Sprintf("courses[%d]", i), Message: decErr.Error()}}, report)
+				continue
+			}
+			listed[cm.Id] = true
+			ep.AddCourseToDb(cm, report)
+		}
+		courseList := models.QueryAllCourseData(1)
+		for _, cs := range courseList {
+			if len(scope) > 0 && !scope[cs.CourseId] {
+				continue
+			}
+			if !listed[cs.CourseId] {
+				ep.offlineCourse(cs.CourseId, report)
+			}
 		}
 		return nil
 	}
@@ -465,72 +615,130 @@ func (ep EnvPrams) ParsingCourse(body map[string]interface{}) error {
 	return errors.New("ParsingCourse, Course list is empty")
 }
 
-func SyncCourse() error {
+// SyncCourse loads the course catalog and returns a report of the courses it
+// added, updated, took offline or rejected, all of them or those in courseIds.
+// Every run is recorded with its changes, see CourseSyncHistory. Runs are
+// started through TriggerCourseSync so that they never overlap.
+func SyncCourse(trigger string, courseIds []string) (report SyncReport, err error) {
+	report = NewSyncReport()
+	run := startSyncRun(trigger, courseIds)
+	revision := ""
+	defer func() {
+		finishSyncRun(&run, report, revision, err)
+	}()
 	onlineEnv := beego.AppConfig.String("courses::online_env")
 	offlineEnv := beego.AppConfig.String("courses::offline_env")
-	courseUrl := beego.AppConfig.String("courses::course_url")
-	chapterUrl := beego.AppConfig.String("courses::chapter_url")
-	chapterDetailUrl := beego.AppConfig.String("courses::chapter_detail_url")
-	if os.Getenv("COURSE_URL") != "" {
-		courseUrl = os.Getenv("COURSE_URL")
-	}
-	if os.Getenv("CHAPTER_URL") != "" {
-		chapterUrl = os.Getenv("CHAPTER_URL")
-	}
-	if os.Getenv("CHAPTER_DETAIL_URL") != "" {
-		chapterDetailUrl = os.Getenv("CHAPTER_DETAIL_URL")
+	source, srcErr := GetCourseSource()
+	if srcErr != nil {
+		logs.Error("SyncCourse, srcErr: ", srcErr)
+		return report, srcErr
 	}
-	logs.Error("---------------:courseUrl:", courseUrl)
-	body, resErr := http.HTTPGitGet(courseUrl)
+	rs := newRevisionSource(source)
+	body, resErr := rs.CourseList()
 	if resErr != nil {
 		logs.Error("SyncCourse, resErr: ", resErr)
-		return resErr
+		return report, resErr
 	}
-	ep := EnvPrams{OnlineEnv: onlineEnv, OfflineEnv: offlineEnv, CourseUrl: courseUrl,
-		ChapterUrl: chapterUrl, ChapterDetailUrl: chapterDetailUrl}
-	pErr := ep.ParsingCourse(body)
+	ep := EnvPrams{OnlineEnv: onlineEnv, OfflineEnv: offlineEnv, Source: rs}
+	pErr := ep.ParsingCourse(body, &report, courseIds...)
 	if pErr != nil {
 		logs.Error("pErr: ", pErr)
 	}
+	// Only the whole catalog was hashed by a full run
+	if len(courseIds) == 0 {
+		revision = rs.Revision()
+		if prevRevision, _ := CatalogRevision(); pErr == nil && revision != prevRevision {
+			refreshUnchangedCourses(report)
+		}
+	}
+	logs.Info("SyncCourse, revision: ", revision, ", ", report.String())
 	// Operations related to clearing offline courses
 	CleanUpCoursePool()
-	return pErr
+	return report, pErr
+}
+
+// refreshUnchangedCourses moves the online courses the sync left unchanged to
+// the current content of the templates they follow, the changed ones were
+// refreshed while they were saved
+func refreshUnchangedCourses(report SyncReport) {
+	for _, courseId := range report.Unchanged {
+		for _, eulerBranch := range RefreshCourseTemplates(courseId) {
+			if bindErr := rebindCourse(courseId, eulerBranch); bindErr != nil {
+				logs.Error("refreshUnchangedCourses, bindErr: ", bindErr, ",courseId: ", courseId)
+			}
+		}
+	}
+}
+
+// SyncCourseTask queues a sync of all courses as a timed task
+func SyncCourseTask() error {
+	TriggerCourseSync(SyncTriggerCron, nil)
+	return nil
 }
 
 func CleanUpCoursePool() {
 	courseData := models.QueryAllCourseData(2)
 	if len(courseData) > 0 {
 		for _, cs := range courseData {
-			// 1. Clear environment configuration
-			rtr := models.ResourceTempathRel{CourseId: cs.CourseId}
-			delErr := models.DeleteResourceTempathRel(&rtr, "CourseId")
-			if delErr != nil {
-				logs.Error("delErr: ", delErr)
+			// 1. Clear environment configuration, then the pools and instances on the clusters
+			relList, _, queryErr := models.QueryCourseTemplateRelList(cs.CourseId)
+			if queryErr != nil {
+				logs.Error("queryErr: ", queryErr)
 			}
-			// 2. Clear User Courses
-			upErr := models.UpdateUserCourseByCourseId(2, cs.CourseId)
-			if upErr == nil {
-				upErr = models.UpdateUserCourseChapterByCourseId(2, cs.CourseId)
-				if upErr != nil {
-					logs.Error("upErr: ", upErr)
+			if queryErr == nil && PendingCourseTeardown(relList) == nil {
+				rtr := models.ResourceTempathRel{CourseId: cs.CourseId}
+				delErr := models.DeleteResourceTempathRel(&rtr, "CourseId")
+				if delErr != nil {
+					logs.Error("delErr: ", delErr)
+				} else if len(relList) > 0 {
+					TeardownOfflineCourse(cs.CourseId, relList)
 				}
 			}
+			// 2. Clear User Courses, they are restored when the course comes back
+			courseNum, upErr := models.OfflineUserCourseByCourseId(cs.CourseId, models.OfflineByCourse)
+			if upErr != nil {
+				logs.Error("upErr: ", upErr)
+				continue
+			}
+			chapterNum, upErr := models.OfflineUserCourseChapterByCourseId(cs.CourseId, models.OfflineByCourse)
+			if upErr != nil {
+				logs.Error("upErr: ", upErr)
+			}
+			logLearnerTransition(cs.CourseId, "", LearnerOfflineEvent, courseNum, chapterNum, 2, 2)
 		}
 	}
 	// 1. Clear User Chapters
 	chapterData := models.QueryAllCourseChapterData(2)
 	if len(chapterData) > 0 {
 		for _, cd := range chapterData {
-			upErr := models.UpdateUserCourseChapterByChapterId(2, cd.CourseId, cd.ChapterId)
+			chapterNum, upErr := models.OfflineUserCourseChapterByChapterId(cd.CourseId, cd.ChapterId, models.OfflineByChapter)
 			if upErr != nil {
 				logs.Error("upErr: ", upErr)
+				continue
 			}
+			logLearnerTransition(cd.CourseId, cd.ChapterId, LearnerOfflineEvent, 0, chapterNum, 1, 2)
 		}
 	}
 }
 
+// logLearnerTransition records in the statistics log how many learner rows
+// went offline with a course or chapter, or came back with it
+func logLearnerTransition(courseId, chapterId, eventType string, courseNum, chapterNum int64,
+	courseStatus, chapterStatus int) {
+	if courseNum == 0 && chapterNum == 0 {
+		return
+	}
+	logs.Info(eventType, ", courseId: ", courseId, ", chapterId: ", chapterId,
+		", user courses: ", courseNum, ", user chapters: ", chapterNum)
+	crd := models.Courses{CourseId: courseId}
+	ccp := models.CoursesChapter{CourseId: courseId, ChapterId: chapterId}
+	WriteCourseData(0, "0", courseId, chapterId, eventType, "", "success",
+		fmt.Sprintf("user courses: %d, user chapters: %d", courseNum, chapterNum),
+		courseStatus, chapterStatus, &crd, &ccp)
+}
+
 func SyncCourseData() {
-	syncErr := SyncCourse()
+	syncErr := runLockedSync(SyncTriggerStartup, nil)
 	if syncErr != nil {
 		logs.Error("syncErr: ", syncErr)
 	}
@@ -593,6 +801,7 @@ func AddRspCourse(uc models.UserCourse, rcd *RspCourseData) {
 	rcd.Status = uc.CompletedFlag
 	rcd.CourseId = uc.CourseId
 	rcd.CourseName = uc.CourseName
+	rcd.StudyTime = uc.StudyTime
 }
 
 func RspChapter(ucp models.UserCourseChapter, rccd *RspCourseChapterData) {
@@ -600,4 +809,5 @@ func RspChapter(ucp models.UserCourseChapter, rccd *RspCourseChapterData) {
 	rccd.ChapterName = ucp.ChapterName
 	rccd.ChapterId = ucp.ChapterId
 	rccd.IsOnline = ucp.Status
+	rccd.StudyTime = ucp.StudyTime
 }
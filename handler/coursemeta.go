@@ -0,0 +1,290 @@
+package handler
+
+import (
+	"encoding/json"
+	"fmt"
+	"playground_backend/models"
+	"strings"
+)
+
+// Chapter orders of a course, in a sequential course a chapter is only open
+// once the chapters before it are completed
+const (
+	ChapterOrderFree       = "free"
+	ChapterOrderSequential = "sequential"
+)
+
+// Stages of a course sync an error is reported for
+const (
+	SyncStageList    = "course-list"
+	SyncStageContent = "course-content"
+	SyncStageDetail  = "chapter-detail"
+	SyncStageSave    = "save"
+)
+
+// FlexString accepts a json string, number or boolean, the metadata files
+// write estimated times both as "30" and as 30
+type FlexString string
+
+func (f *FlexString) UnmarshalJSON(data []byte) error {
+	var value interface{}
+	if err := json.Unmarshal(data, &value); err != nil {
+		return err
+	}
+	switch v := value.(type) {
+	case nil:
+		*f = ""
+	case string:
+		*f = FlexString(v)
+	case float64, bool:
+		*f = FlexString(fmt.Sprint(v))
+	default:
+		return fmt.Errorf("expected a string, got %s", string(data))
+	}
+	return nil
+}
+
+type CourseListMeta struct {
+	Courses []CourseMeta `json:"courses"`
+}
+
+type CourseMeta struct {
+	Id         string   `json:"id"`
+	ContentDir string   `json:"content_dir"`
+	Status     []string `json:"status"`
+}
+
+type CourseContentMeta struct {
+	Title             string        `json:"title"`
+	Description       string        `json:"description"`
+	Logo              string        `json:"logo"`
+	Poster            string        `json:"poster"`
+	Cover             string        `json:"cover"`
+	ContainerLiveTime FlexString    `json:"container_live_time"`
+	Prerequisites     []string      `json:"prerequisites"`
+	ChapterOrder      string        `json:"chapter_order"`
+	Chapters          []ChapterMeta `json:"chapters"`
+}
+
+type ChapterMeta struct {
+	ContentDir    string     `json:"content_dir"`
+	Title         string     `json:"title"`
+	Description   string     `json:"description"`
+	EstimatedTime FlexString `json:"estimated_time"`
+}
+
+type ChapterBackendMeta struct {
+	ImageId string `json:"image_id"`
+}
+
+// ChapterCheckMeta is the completion check of a chapter, the command runs in
+// the learner's instance and passes with the expected exit code and output
+type ChapterCheckMeta struct {
+	Command   string `json:"command"`
+	ExitCode  *int   `json:"exit_code,omitempty"`
+	Output    string `json:"output,omitempty"`
+	Container string `json:"container,omitempty"`
+	Timeout   int    `json:"timeout,omitempty"`
+}
+
+type ChapterDetailMeta struct {
+	Title       string              `json:"title"`
+	Description string              `json:"description"`
+	Backend     *ChapterBackendMeta `json:"backend"`
+	Check       *ChapterCheckMeta   `json:"check"`
+}
+
+// SyncError describes why a course was rejected by the sync
+type SyncError struct {
+	CourseId   string `json:"courseId"`
+	ContentDir string `json:"contentDir"`
+	ChapterId  string `json:"chapterId,omitempty"`
+	Stage      string `json:"stage"`
+	Field      string `json:"field,omitempty"`
+	Message    string `json:"message"`
+}
+
+func (e SyncError) Error() string {
+	msg := "course " + e.CourseId + ", " + e.Stage
+	if len(e.ChapterId) > 0 {
+		msg += ", chapter " + e.ChapterId
+	}
+	if len(e.Field) > 0 {
+		msg += ", " + e.Field
+	}
+	return msg + ": " + e.Message
+}
+
+// SyncReport lists the courses a sync added, updated, left unchanged, took
+// offline or rejected, with the changes it made
+type SyncReport struct {
+	Added     []string                `json:"added"`
+	Updated   []string                `json:"updated"`
+	Unchanged []string                `json:"unchanged"`
+	Offline   []string                `json:"offline"`
+	Rejected  []string                `json:"rejected"`
+	Errors    []SyncError             `json:"errors"`
+	Diffs     []models.CourseSyncDiff `json:"diffs"`
+}
+
+func NewSyncReport() SyncReport {
+	return SyncReport{Added: []string{}, Updated: []string{}, Unchanged: []string{},
+		Offline: []string{}, Rejected: []string{}, Errors: []SyncError{}, Diffs: []models.CourseSyncDiff{}}
+}
+
+func (r *SyncReport) Reject(errs []SyncError) {
+	if len(errs) == 0 {
+		return
+	}
+	name := errs[0].CourseId
+	if len(name) == 0 {
+		name = errs[0].Field
+	}
+	r.Rejected = append(r.Rejected, name)
+	r.Errors = append(r.Errors, errs...)
+}
+
+func (r SyncReport) String() string {
+	return fmt.Sprintf("added: %d, updated: %d, unchanged: %d, offline: %d, rejected: %d",
+		len(r.Added), len(r.Updated), len(r.Unchanged), len(r.Offline), len(r.Rejected))
+}
+
+// decodeMeta converts a json document read by a CourseSource into one of the
+// typed metadata structs, a field of the wrong type is an error
+func decodeMeta(body map[string]interface{}, v interface{}) error {
+	content, err := json.Marshal(body)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(content, v)
+}
+
+type metaChecker struct {
+	base SyncError
+	errs []SyncError
+}
+
+func (m *metaChecker) add(field, format string, args ...interface{}) {
+	e := m.base
+	e.Field = field
+	e.Message = fmt.Sprintf(format, args...)
+	m.errs = append(m.errs, e)
+}
+
+func (m *metaChecker) required(field, value string) {
+	if len(strings.TrimSpace(value)) == 0 {
+		m.add(field, "is required")
+	}
+}
+
+// maxLen keeps values within the size of their database column
+func (m *metaChecker) maxLen(field, value string, size int) {
+	if len(value) > size {
+		m.add(field, "is longer than %d characters", size)
+	}
+}
+
+// dirName rejects names that are used as a path segment but are not one
+func (m *metaChecker) dirName(field, value string) {
+	if value == "." || value == ".." || strings.ContainsAny(value, "/\\") {
+		m.add(field, "%q is not a valid directory name", value)
+	}
+}
+
+func (c CourseMeta) Validate() []SyncError {
+	m := metaChecker{base: SyncError{CourseId: c.Id, ContentDir: c.ContentDir, Stage: SyncStageList}}
+	m.required("id", c.Id)
+	m.maxLen("id", c.Id, 128)
+	m.required("content_dir", c.ContentDir)
+	m.maxLen("content_dir", c.ContentDir, 256)
+	m.dirName("content_dir", c.ContentDir)
+	if len(c.Status) == 0 {
+		m.add("status", "is required")
+	}
+	return m.errs
+}
+
+func (c CourseContentMeta) Validate(cm CourseMeta) []SyncError {
+	m := metaChecker{base: SyncError{CourseId: cm.Id, ContentDir: cm.ContentDir, Stage: SyncStageContent}}
+	m.required("title", c.Title)
+	m.maxLen("title", c.Title, 256)
+	m.maxLen("logo", c.Logo, 256)
+	m.maxLen("poster", c.Poster, 256)
+	m.maxLen("cover", c.Cover, 256)
+	m.maxLen("container_live_time", string(c.ContainerLiveTime), 32)
+	switch c.ChapterOrder {
+	case "", ChapterOrderFree, ChapterOrderSequential:
+	default:
+		m.add("chapter_order", "%q is neither %q nor %q", c.ChapterOrder, ChapterOrderFree, ChapterOrderSequential)
+	}
+	required := map[string]bool{}
+	for i, courseId := range c.Prerequisites {
+		field := fmt.Sprintf("prerequisites[%d]", i)
+		m.required(field, courseId)
+		if courseId == cm.Id {
+			m.add(field, "a course cannot require itself")
+		}
+		if required[courseId] {
+			m.add(field, "%q is duplicated", courseId)
+		}
+		required[courseId] = true
+	}
+	m.maxLen("prerequisites", strings.Join(c.Prerequisites, ","), 1024)
+	seen := map[string]bool{}
+	for i, ch := range c.Chapters {
+		field := fmt.Sprintf("chapters[%d]", i)
+		m.required(field+".content_dir", ch.ContentDir)
+		m.maxLen(field+".content_dir", ch.ContentDir, 256)
+		m.dirName(field+".content_dir", ch.ContentDir)
+		if seen[ch.ContentDir] {
+			m.add(field+".content_dir", "%q is duplicated", ch.ContentDir)
+		}
+		seen[ch.ContentDir] = true
+		m.required(field+".title", ch.Title)
+		m.maxLen(field+".title", ch.Title, 256)
+		m.maxLen(field+".estimated_time", string(ch.EstimatedTime), 32)
+	}
+	return m.errs
+}
+
+func (c ChapterDetailMeta) Validate(cm CourseMeta, chapterId string) []SyncError {
+	m := metaChecker{base: SyncError{CourseId: cm.Id, ContentDir: cm.ContentDir,
+		ChapterId: chapterId, Stage: SyncStageDetail}}
+	m.required("title", c.Title)
+	if c.Backend == nil {
+		m.add("backend", "is required")
+	} else {
+		m.maxLen("backend.image_id", c.Backend.ImageId, 512)
+	}
+	if c.Check != nil {
+		m.required("check.command", c.Check.Command)
+		m.maxLen("check.command", c.Check.Command, 4096)
+		m.maxLen("check.output", c.Check.Output, 4096)
+		m.maxLen("check.container", c.Check.Container, 253)
+		if c.Check.ExitCode != nil && (*c.Check.ExitCode < 0 || *c.Check.ExitCode > 255) {
+			m.add("check.exit_code", "%d is not an exit code", *c.Check.ExitCode)
+		}
+		if c.Check.Timeout < 0 || c.Check.Timeout > MaxCheckTimeout {
+			m.add("check.timeout", "must be between 0 and %d seconds", MaxCheckTimeout)
+		}
+	}
+	return m.errs
+}
+
+// CheckSpec returns the check of a chapter as stored with the chapter, or ""
+// without one
+func (c ChapterDetailMeta) CheckSpec() string {
+	if c.Check == nil {
+		return ""
+	}
+	content, _ := json.Marshal(c.Check)
+	return string(content)
+}
+
+// ImageId returns the euler branch a chapter runs on, or "" without one
+func (c ChapterDetailMeta) ImageId() string {
+	if c.Backend == nil {
+		return ""
+	}
+	return c.Backend.ImageId
+}
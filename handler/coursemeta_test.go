@@ -0,0 +1,172 @@
+package handler
+
+import (
+	"encoding/json"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func errorFields(errs []SyncError) []string {
+	fields := []string{}
+	for _, e := range errs {
+		fields = append(fields, e.Field)
+	}
+	return fields
+}
+
+func TestCourseMetaValidate(t *testing.T) {
+	cases := []struct {
+		name string
+		meta CourseMeta
+		want []string
+	}{
+		{"valid", CourseMeta{Id: "course1", ContentDir: "course1", Status: []string{"online"}}, []string{}},
+		{"missing everything", CourseMeta{}, []string{"id", "content_dir", "status"}},
+		{"blank id", CourseMeta{Id: "  ", ContentDir: "course1", Status: []string{"online"}}, []string{"id"}},
+		{"long id", CourseMeta{Id: strings.Repeat("c", 129), ContentDir: "course1", Status: []string{"online"}},
+			[]string{"id"}},
+		{"content dir with a path", CourseMeta{Id: "course1", ContentDir: "../course1", Status: []string{"online"}},
+			[]string{"content_dir"}},
+		{"content dir is a parent", CourseMeta{Id: "course1", ContentDir: "..", Status: []string{"online"}},
+			[]string{"content_dir"}},
+		{"long content dir", CourseMeta{Id: "course1", ContentDir: strings.Repeat("d", 257), Status: []string{"online"}},
+			[]string{"content_dir"}},
+	}
+	for _, c := range cases {
+		errs := c.meta.Validate()
+		if got := errorFields(errs); !reflect.DeepEqual(got, c.want) {
+			t.Errorf("%s: Validate() fields = %v, want %v", c.name, got, c.want)
+		}
+		for _, e := range errs {
+			if e.Stage != SyncStageList || e.CourseId != c.meta.Id {
+				t.Errorf("%s: Validate() = %+v, want stage %s of course %q", c.name, e, SyncStageList, c.meta.Id)
+			}
+		}
+	}
+}
+
+func TestCourseContentMetaValidate(t *testing.T) {
+	cm := CourseMeta{Id: "course1", ContentDir: "course1", Status: []string{"online"}}
+	valid := func(change func(*CourseContentMeta)) CourseContentMeta {
+		c := CourseContentMeta{Title: "Course", ContainerLiveTime: "60", ChapterOrder: ChapterOrderSequential,
+			Prerequisites: []string{"course0"},
+			Chapters: []ChapterMeta{{ContentDir: "chapter1", Title: "One", EstimatedTime: "30"},
+				{ContentDir: "chapter2", Title: "Two"}}}
+		if change != nil {
+			change(&c)
+		}
+		return c
+	}
+	cases := []struct {
+		name string
+		meta CourseContentMeta
+		want []string
+	}{
+		{"valid", valid(nil), []string{}},
+		{"free order", valid(func(c *CourseContentMeta) { c.ChapterOrder = ChapterOrderFree }), []string{}},
+		{"default order", valid(func(c *CourseContentMeta) { c.ChapterOrder = "" }), []string{}},
+		{"missing title", valid(func(c *CourseContentMeta) { c.Title = "" }), []string{"title"}},
+		{"long logo", valid(func(c *CourseContentMeta) { c.Logo = strings.Repeat("l", 257) }), []string{"logo"}},
+		{"long live time", valid(func(c *CourseContentMeta) { c.ContainerLiveTime = FlexString(strings.Repeat("9", 33)) }),
+			[]string{"container_live_time"}},
+		{"unknown order", valid(func(c *CourseContentMeta) { c.ChapterOrder = "random" }), []string{"chapter_order"}},
+		{"requires itself", valid(func(c *CourseContentMeta) { c.Prerequisites = []string{"course1"} }),
+			[]string{"prerequisites[0]"}},
+		{"duplicated prerequisite", valid(func(c *CourseContentMeta) { c.Prerequisites = []string{"course0", "course0"} }),
+			[]string{"prerequisites[1]"}},
+		{"blank prerequisite", valid(func(c *CourseContentMeta) { c.Prerequisites = []string{"course0", ""} }),
+			[]string{"prerequisites[1]"}},
+		{"long prerequisites", valid(func(c *CourseContentMeta) { c.Prerequisites = []string{strings.Repeat("p", 1025)} }),
+			[]string{"prerequisites"}},
+		{"chapter without a dir", valid(func(c *CourseContentMeta) { c.Chapters[1].ContentDir = "" }),
+			[]string{"chapters[1].content_dir"}},
+		{"chapter dir with a path", valid(func(c *CourseContentMeta) { c.Chapters[0].ContentDir = "a/b" }),
+			[]string{"chapters[0].content_dir"}},
+		{"duplicated chapter", valid(func(c *CourseContentMeta) { c.Chapters[1].ContentDir = "chapter1" }),
+			[]string{"chapters[1].content_dir"}},
+		{"chapter without a title", valid(func(c *CourseContentMeta) { c.Chapters[0].Title = " " }),
+			[]string{"chapters[0].title"}},
+		{"long estimated time", valid(func(c *CourseContentMeta) { c.Chapters[0].EstimatedTime = FlexString(strings.Repeat("1", 33)) }),
+			[]string{"chapters[0].estimated_time"}},
+	}
+	for _, c := range cases {
+		errs := c.meta.Validate(cm)
+		if got := errorFields(errs); !reflect.DeepEqual(got, c.want) {
+			t.Errorf("%s: Validate() fields = %v, want %v", c.name, got, c.want)
+		}
+		for _, e := range errs {
+			if e.Stage != SyncStageContent || e.CourseId != cm.Id || e.ContentDir != cm.ContentDir {
+				t.Errorf("%s: Validate() = %+v, want stage %s of course %s", c.name, e, SyncStageContent, cm.Id)
+			}
+		}
+	}
+}
+
+func TestChapterDetailMetaValidate(t *testing.T) {
+	cm := CourseMeta{Id: "course1", ContentDir: "course1", Status: []string{"online"}}
+	exitCode := func(code int) *int {
+		return &code
+	}
+	cases := []struct {
+		name string
+		meta ChapterDetailMeta
+		want []string
+	}{
+		{"valid without a check", ChapterDetailMeta{Title: "One", Backend: &ChapterBackendMeta{ImageId: "openEuler-21.03"}},
+			[]string{}},
+		{"valid with a check", ChapterDetailMeta{Title: "One", Backend: &ChapterBackendMeta{ImageId: "openEuler-21.03"},
+			Check: &ChapterCheckMeta{Command: "test -f /done", ExitCode: exitCode(0), Timeout: MaxCheckTimeout}},
+			[]string{}},
+		{"missing title and backend", ChapterDetailMeta{}, []string{"title", "backend"}},
+		{"long image id", ChapterDetailMeta{Title: "One", Backend: &ChapterBackendMeta{ImageId: strings.Repeat("i", 513)}},
+			[]string{"backend.image_id"}},
+		{"check without a command", ChapterDetailMeta{Title: "One", Backend: &ChapterBackendMeta{},
+			Check: &ChapterCheckMeta{}}, []string{"check.command"}},
+		{"long check output", ChapterDetailMeta{Title: "One", Backend: &ChapterBackendMeta{},
+			Check: &ChapterCheckMeta{Command: "cat /done", Output: strings.Repeat("o", 4097)}}, []string{"check.output"}},
+		{"long container", ChapterDetailMeta{Title: "One", Backend: &ChapterBackendMeta{},
+			Check: &ChapterCheckMeta{Command: "true", Container: strings.Repeat("c", 254)}}, []string{"check.container"}},
+		{"negative exit code", ChapterDetailMeta{Title: "One", Backend: &ChapterBackendMeta{},
+			Check: &ChapterCheckMeta{Command: "true", ExitCode: exitCode(-1)}}, []string{"check.exit_code"}},
+		{"exit code over 255", ChapterDetailMeta{Title: "One", Backend: &ChapterBackendMeta{},
+			Check: &ChapterCheckMeta{Command: "true", ExitCode: exitCode(256)}}, []string{"check.exit_code"}},
+		{"timeout over the maximum", ChapterDetailMeta{Title: "One", Backend: &ChapterBackendMeta{},
+			Check: &ChapterCheckMeta{Command: "true", Timeout: MaxCheckTimeout + 1}}, []string{"check.timeout"}},
+		{"negative timeout", ChapterDetailMeta{Title: "One", Backend: &ChapterBackendMeta{},
+			Check: &ChapterCheckMeta{Command: "true", Timeout: -1}}, []string{"check.timeout"}},
+	}
+	for _, c := range cases {
+		errs := c.meta.Validate(cm, "chapter1")
+		if got := errorFields(errs); !reflect.DeepEqual(got, c.want) {
+			t.Errorf("%s: Validate() fields = %v, want %v", c.name, got, c.want)
+		}
+		for _, e := range errs {
+			if e.Stage != SyncStageDetail || e.ChapterId != "chapter1" {
+				t.Errorf("%s: Validate() = %+v, want stage %s of chapter1", c.name, e, SyncStageDetail)
+			}
+		}
+	}
+}
+
+func TestFlexString(t *testing.T) {
+	cases := []struct {
+		json    string
+		want    FlexString
+		wantErr bool
+	}{
+		{`{"estimated_time": "30"}`, "30", false},
+		{`{"estimated_time": 30}`, "30", false},
+		{`{"estimated_time": 1.5}`, "1.5", false},
+		{`{"estimated_time": true}`, "true", false},
+		{`{"estimated_time": null}`, "", false},
+		{`{"estimated_time": [30]}`, "", true},
+	}
+	for _, c := range cases {
+		var ch ChapterMeta
+		err := json.Unmarshal([]byte(c.json), &ch)
+		if (err != nil) != c.wantErr || ch.EstimatedTime != c.want {
+			t.Errorf("Unmarshal(%s) = %q, %v, want %q, error %v", c.json, ch.EstimatedTime, err, c.want, c.wantErr)
+		}
+	}
+}
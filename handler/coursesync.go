@@ -0,0 +1,215 @@
+package handler
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash"
+	"playground_backend/common"
+	"playground_backend/models"
+	"strings"
+	"time"
+
+	"github.com/astaxie/beego"
+	"github.com/astaxie/beego/logs"
+)
+
+// Changes a sync run records for a course or chapter
+const (
+	SyncActionAdded    = "added"
+	SyncActionUpdated  = "updated"
+	SyncActionOffline  = "offline"
+	SyncActionRejected = "rejected"
+)
+
+var ErrSyncRunNotFound = errors.New("The sync run does not exist")
+
+// syncField is a column of a course or chapter compared by the sync
+type syncField struct {
+	name     string
+	oldValue string
+	newValue string
+}
+
+func syncDiff(courseId, chapterId, action string) models.CourseSyncDiff {
+	return models.CourseSyncDiff{CourseId: courseId, ChapterId: chapterId, Action: action}
+}
+
+// diffFields returns a diff for every field whose value changed
+func diffFields(courseId, chapterId string, fields []syncField) []models.CourseSyncDiff {
+	diffs := []models.CourseSyncDiff{}
+	for _, f := range fields {
+		if f.oldValue != f.newValue {
+			d := syncDiff(courseId, chapterId, SyncActionUpdated)
+			d.Field = f.name
+			d.OldValue = f.oldValue
+			d.NewValue = f.newValue
+			diffs = append(diffs, d)
+		}
+	}
+	return diffs
+}
+
+// diffColumns returns the columns to update for a list of diffs
+func diffColumns(diffs []models.CourseSyncDiff) []string {
+	columns := make([]string, 0, len(diffs)+1)
+	for _, d := range diffs {
+		columns = append(columns, d.Field)
+	}
+	return append(columns, "UpdateTime")
+}
+
+// revisionSource hashes every document read from a source, the hash is the
+// catalog revision of sources without one of their own
+type revisionSource struct {
+	CourseSource
+	hash hash.Hash
+}
+
+func newRevisionSource(source CourseSource) *revisionSource {
+	return &revisionSource{CourseSource: source, hash: sha256.New()}
+}
+
+func (s *revisionSource) record(body map[string]interface{}, err error) (map[string]interface{}, error) {
+	if err == nil {
+		// Map keys are encoded sorted, so the same document hashes the same
+		content, _ := json.Marshal(body)
+		s.hash.Write(content)
+	}
+	return body, err
+}
+
+func (s *revisionSource) CourseList() (map[string]interface{}, error) {
+	return s.record(s.CourseSource.CourseList())
+}
+
+func (s *revisionSource) Chapters(coursePathName string) (map[string]interface{}, error) {
+	return s.record(s.CourseSource.Chapters(coursePathName))
+}
+
+func (s *revisionSource) ChapterDetail(coursePathName, chapterId string) (map[string]interface{}, error) {
+	return s.record(s.CourseSource.ChapterDetail(coursePathName, chapterId))
+}
+
+// Revision returns the commit of a git source or the hash of the documents read
+func (s *revisionSource) Revision() string {
+	if rs, ok := s.CourseSource.(interface{ Revision() (string, error) }); ok {
+		if rev, err := rs.Revision(); err == nil {
+			return rev
+		}
+	}
+	return hex.EncodeToString(s.hash.Sum(nil))
+}
+
+func startSyncRun(trigger string, courseIds []string) models.CourseSyncRun {
+	run := models.CourseSyncRun{Source: CourseSourceKind(), Trigger: trigger,
+		Scope: strings.Join(courseIds, ","), Status: models.SyncRunRunning, StartTime: common.GetCurTime()}
+	id, inErr := models.InsertCourseSyncRun(&run)
+	if inErr != nil {
+		logs.Error("startSyncRun, inErr: ", inErr)
+	}
+	run.Id = id
+	return run
+}
+
+// finishSyncRun saves the outcome and the diffs of a run and removes the runs
+// older than courses::sync_history_days
+func finishSyncRun(run *models.CourseSyncRun, report SyncReport, revision string, syncErr error) {
+	run.Revision = revision
+	run.Added = len(report.Added)
+	run.Updated = len(report.Updated)
+	run.Unchanged = len(report.Unchanged)
+	run.Offline = len(report.Offline)
+	run.Rejected = len(report.Rejected)
+	run.EndTime = common.GetCurTime()
+	run.Status = models.SyncRunSuccess
+	run.Message = report.String()
+	if syncErr != nil {
+		run.Status = models.SyncRunFailed
+		run.Message = syncErr.Error()
+	}
+	if run.Id < 1 {
+		return
+	}
+	upErr := models.UpdateCourseSyncRun(run, "Revision", "Status", "Message", "Added",
+		"Updated", "Unchanged", "Offline", "Rejected", "EndTime")
+	if upErr != nil {
+		logs.Error("finishSyncRun, upErr: ", upErr)
+	}
+	diffs := make([]models.CourseSyncDiff, 0, len(report.Diffs)+len(report.Errors))
+	diffs = append(diffs, report.Diffs...)
+	for _, e := range report.Errors {
+		d := syncDiff(e.CourseId, e.ChapterId, SyncActionRejected)
+		d.Field = e.Stage
+		if len(e.Field) > 0 {
+			d.Field += "." + e.Field
+		}
+		d.NewValue = e.Message
+		diffs = append(diffs, d)
+	}
+	for i := range diffs {
+		diffs[i].RunId = run.Id
+	}
+	if inErr := models.InsertCourseSyncDiffs(diffs); inErr != nil {
+		logs.Error("finishSyncRun, inErr: ", inErr)
+	}
+	days := beego.AppConfig.DefaultInt("courses::sync_history_days", 7)
+	before := time.Now().AddDate(0, 0, -days).Format(common.DATE_T_Z_FORMAT)
+	if delErr := models.DeleteCourseSyncRunBefore(before); delErr != nil {
+		logs.Error("finishSyncRun, delErr: ", delErr)
+	}
+}
+
+type CourseSyncStatus struct {
+	Revision   string                 `json:"revision"`
+	LastSyncAt string                 `json:"lastSyncAt"`
+	Runs       []models.CourseSyncRun `json:"runs"`
+}
+
+type CourseSyncRunView struct {
+	Run   models.CourseSyncRun    `json:"run"`
+	Diffs []models.CourseSyncDiff `json:"diffs"`
+}
+
+// CourseSyncHistory returns the last limit sync runs and the catalog revision
+// of the last successful run of the whole catalog
+func CourseSyncHistory(limit int) (CourseSyncStatus, error) {
+	status := CourseSyncStatus{Runs: []models.CourseSyncRun{}}
+	runs, _, err := models.QueryCourseSyncRunList(limit)
+	if err != nil {
+		return status, err
+	}
+	if len(runs) > 0 {
+		status.Runs = runs
+	}
+	status.Revision, status.LastSyncAt = CatalogRevision()
+	return status, nil
+}
+
+// CatalogRevision returns the revision of the last successful run of the whole
+// catalog and when it ended, a run scoped to some courses has no revision
+func CatalogRevision() (string, string) {
+	last, lastErr := models.QueryLastFullCourseSyncRun(models.SyncRunSuccess)
+	if lastErr != nil {
+		return "", ""
+	}
+	return last.Revision, last.EndTime
+}
+
+func CourseSyncRunDetail(runId int64) (CourseSyncRunView, error) {
+	view := CourseSyncRunView{Run: models.CourseSyncRun{Id: runId}, Diffs: []models.CourseSyncDiff{}}
+	if queryErr := models.QueryCourseSyncRun(&view.Run); queryErr != nil {
+		logs.Error("CourseSyncRunDetail, queryErr: ", queryErr, ",runId: ", runId)
+		return view, ErrSyncRunNotFound
+	}
+	diffs, _, err := models.QueryCourseSyncDiffList(runId)
+	if err != nil {
+		return view, fmt.Errorf("query the diffs of run %d: %v", runId, err)
+	}
+	if len(diffs) > 0 {
+		view.Diffs = diffs
+	}
+	return view, nil
+}
@@ -0,0 +1,135 @@
+package handler
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"path/filepath"
+	"playground_backend/common"
+	"strings"
+
+	"github.com/astaxie/beego"
+	"k8s.io/client-go/rest"
+	"k8s.io/client-go/tools/clientcmd"
+)
+
+// Credential types of a cluster, stored in ResourceConfigPath.CredentialType
+const (
+	CredentialKubeconfig = "kubeconfig"
+	CredentialInCluster  = "incluster"
+	CredentialToken      = "token"
+	CredentialExec       = "exec"
+)
+
+// DefaultExecCommands are the exec plugins allowed without credential::exec_commands
+const DefaultExecCommands = "kubelogin,gke-gcloud-auth-plugin,aws-iam-authenticator"
+
+// TokenCredential is the plaintext of a token credential
+type TokenCredential struct {
+	Server   string `json:"server"`
+	Token    string `json:"token"`
+	CAData   string `json:"caData"`
+	Insecure bool   `json:"insecure"`
+}
+
+// CredentialTypeOf maps an empty credential type to the kubeconfig rows created before it existed
+func CredentialTypeOf(credentialType string) string {
+	if len(credentialType) == 0 {
+		return CredentialKubeconfig
+	}
+	return credentialType
+}
+
+// DecryptResourceContent returns the plaintext credentials of a cluster
+func DecryptResourceContent(content string) ([]byte, error) {
+	plaintext, _, err := common.DecryptSecret(content)
+	if err != nil {
+		return nil, err
+	}
+	if len(plaintext) == 0 {
+		return nil, errors.New("the cluster credentials are empty")
+	}
+	return plaintext, nil
+}
+
+// execAllowed checks the exec plugin of every user against credential::exec_commands
+func execAllowed(kubeConfig []byte) (bool, error) {
+	apiConfig, err := clientcmd.Load(kubeConfig)
+	if err != nil {
+		return false, err
+	}
+	allowed := make(map[string]bool)
+	for _, cmd := range strings.Split(beego.AppConfig.DefaultString("credential::exec_commands", DefaultExecCommands), ",") {
+		if cmd = strings.TrimSpace(cmd); len(cmd) > 0 {
+			allowed[cmd] = true
+		}
+	}
+	hasExec := false
+	for name, authInfo := range apiConfig.AuthInfos {
+		if authInfo.Exec == nil {
+			continue
+		}
+		hasExec = true
+		if !allowed[filepath.Base(authInfo.Exec.Command)] {
+			return true, errors.New("exec plugin is not allowed, user: " + name + ", command: " + authInfo.Exec.Command)
+		}
+	}
+	return hasExec, nil
+}
+
+// BuildResConfig builds the client config of a cluster from its credential type
+// and plaintext credentials. Kubeconfigs may only run an exec plugin with the
+// exec type, and only the plugins listed in credential::exec_commands. Rows
+// stored before credential types existed have no type and keep running their
+// allowed plugins.
+func BuildResConfig(credentialType string, plaintext []byte) (*rest.Config, error) {
+	switch CredentialTypeOf(credentialType) {
+	case CredentialInCluster:
+		return rest.InClusterConfig()
+	case CredentialToken:
+		var tc TokenCredential
+		jsErr := json.Unmarshal(plaintext, &tc)
+		if jsErr != nil {
+			return nil, jsErr
+		}
+		if len(tc.Server) == 0 || len(tc.Token) == 0 {
+			return nil, errors.New("the token credential needs a server and a token")
+		}
+		config := &rest.Config{Host: tc.Server, BearerToken: tc.Token}
+		config.TLSClientConfig.Insecure = tc.Insecure
+		if len(tc.CAData) > 0 {
+			caData, baseErr := base64.StdEncoding.DecodeString(tc.CAData)
+			if baseErr != nil {
+				// Take the bundle as plain PEM
+				caData = []byte(tc.CAData)
+			}
+			config.TLSClientConfig.CAData = caData
+		}
+		return config, nil
+	case CredentialKubeconfig:
+		hasExec, err := execAllowed(plaintext)
+		if err != nil {
+			return nil, err
+		}
+		if hasExec && len(credentialType) > 0 {
+			return nil, errors.New("the kubeconfig runs an exec plugin, register it with the exec credential type")
+		}
+		return clientcmd.RESTConfigFromKubeConfig(plaintext)
+	case CredentialExec:
+		hasExec, err := execAllowed(plaintext)
+		if err != nil {
+			return nil, err
+		}
+		if !hasExec {
+			return nil, errors.New("the kubeconfig has no exec plugin")
+		}
+		return clientcmd.RESTConfigFromKubeConfig(plaintext)
+	}
+	return nil, errors.New("unknown credential type: " + credentialType)
+}
+
+// EncryptResourceContent encrypts plaintext credentials with the active key and
+// returns the algorithm used, see common.EncryptSecret
+func EncryptResourceContent(plaintext []byte) (string, string, error) {
+	return common.EncryptSecret(plaintext)
+}
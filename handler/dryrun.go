@@ -0,0 +1,128 @@
+package handler
+
+import (
+	"context"
+	"errors"
+	"io/ioutil"
+	"path/filepath"
+	"playground_backend/common"
+	"playground_backend/models"
+	"time"
+
+	"github.com/astaxie/beego"
+	"github.com/astaxie/beego/logs"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime/serializer/yaml"
+)
+
+// DryRunReq is a template to check, either the path it is downloaded from or
+// its raw content. Without a resourceId the first online cluster is used.
+type DryRunReq struct {
+	TemplatePath string `json:"templatePath"`
+	Content      string `json:"content"`
+	ResourceId   string `json:"resourceId"`
+	CourseId     string `json:"courseId"`
+}
+
+type DryRunResult struct {
+	ResourceId string            `json:"resourceId"`
+	Gvk        string            `json:"gvk"`
+	Name       string            `json:"name"`
+	Namespace  string            `json:"namespace"`
+	Yaml       string            `json:"yaml"`
+	Violations []PolicyViolation `json:"violations"`
+	Errors     []string          `json:"errors"`
+	Valid      bool              `json:"valid"`
+}
+
+// dryRunTemplate puts the template of a request into yamlDir the way
+// DownLoadTemplate does and returns its local path
+func dryRunTemplate(yamlDir string, req DryRunReq) (string, error) {
+	if len(req.Content) > 0 {
+		localPath := filepath.Join(yamlDir, common.GetRandomString(8)+"-dryrun.tmpl")
+		err := ioutil.WriteFile(localPath, []byte(req.Content), 0600)
+		return localPath, err
+	}
+	if len(req.TemplatePath) == 0 {
+		return "", errors.New("templatePath or content is required")
+	}
+	downLock.Lock()
+	downErr, localPath := DownLoadTemplate(yamlDir, req.TemplatePath)
+	downLock.Unlock()
+	return localPath, downErr
+}
+
+// dryRunCluster returns the cluster a dry run is sent to
+func dryRunCluster(resourceId string) (string, error) {
+	if len(resourceId) > 0 {
+		return resourceId, nil
+	}
+	rcpList, _, err := models.QueryResourceConfigPathAll()
+	if err != nil {
+		return "", err
+	}
+	for _, rcp := range rcpList {
+		if ClusterSchedulable(rcp) {
+			return rcp.ResourceId, nil
+		}
+	}
+	return "", errors.New("no online cluster for the dry run")
+}
+
+// DryRunTemplate renders a template with sample data through RenderTmpl, runs
+// the policy checks and a server side dry run create against the cluster
+func DryRunTemplate(req DryRunReq) DryRunResult {
+	result := DryRunResult{Violations: []PolicyViolation{}, Errors: []string{}}
+	yamlDir := beego.AppConfig.DefaultString("template::local_dir", "template")
+	common.CreateDir(yamlDir)
+	localPath, tmplErr := dryRunTemplate(yamlDir, req)
+	if tmplErr != nil {
+		if common.FileExists(localPath) {
+			DeleteFile(localPath)
+		}
+		result.Errors = append(result.Errors, "template: "+tmplErr.Error())
+		return result
+	}
+	sample := ReqTmplParase{Name: "dryrun-" + common.GetRandomString(8),
+		Subdomain: "dryrun" + common.GetRandomString(16), NamePassword: "sample:sample",
+		UserId: "sample-user", ContactEmail: beego.AppConfig.DefaultString("template::contact_email", "contact@openeuler.io")}
+	cr := CourseResources{CourseId: req.CourseId, ResourceName: req.TemplatePath, UserId: "0"}
+	content, renderErr := RenderTmpl(yamlDir, localPath, sample, &cr)
+	if renderErr != nil {
+		result.Errors = append(result.Errors, "render: "+renderErr.Error())
+		return result
+	}
+	result.Yaml = string(content)
+	obj := &unstructured.Unstructured{}
+	_, gvk, decErr := yaml.NewDecodingSerializer(unstructured.UnstructuredJSONScheme).Decode(content, nil, obj)
+	if decErr != nil {
+		result.Errors = append(result.Errors, "decode: "+decErr.Error())
+		return result
+	}
+	result.Gvk = gvk.String()
+	result.Name = obj.GetName()
+	result.Namespace = obj.GetNamespace()
+	result.Violations = append(result.Violations, CheckTemplatePolicy(GetTemplatePolicy(), content)...)
+	resourceId, clusterErr := dryRunCluster(req.ResourceId)
+	if clusterErr != nil {
+		result.Errors = append(result.Errors, "cluster: "+clusterErr.Error())
+		return result
+	}
+	result.ResourceId = resourceId
+	dr, drErr := GetGVRdyClient(gvk, obj.GetNamespace(), resourceId)
+	if drErr != nil {
+		result.Errors = append(result.Errors, "client: "+drErr.Error())
+		return result
+	}
+	ctx, cancel := context.WithTimeout(context.TODO(), time.Duration(GetHealthConfig().ProbeTimeout)*time.Second)
+	defer cancel()
+	_, createErr := dr.Create(ctx, obj, metav1.CreateOptions{DryRun: []string{metav1.DryRunAll}})
+	if createErr != nil {
+		logs.Error("DryRunTemplate, createErr: ", createErr, ",resourceId: ", resourceId)
+		result.Errors = append(result.Errors, "dry run: "+createErr.Error())
+		return result
+	}
+	result.Valid = len(result.Violations) == 0
+	return result
+}
@@ -0,0 +1,214 @@
+package handler
+
+import (
+	"errors"
+	"playground_backend/common"
+	"playground_backend/models"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/astaxie/beego"
+	"github.com/astaxie/beego/logs"
+	"k8s.io/client-go/discovery"
+	"k8s.io/client-go/rest"
+)
+
+const (
+	CodeServerGroupVersion = "cs.opensourceways.com/v1alpha1"
+	CodeServerKind         = "CodeServer"
+)
+
+type HealthConfig struct {
+	ProbeTimeout     int
+	WindowSize       int
+	FailThreshold    int
+	RecoverThreshold int
+	MaxErrorPercent  int
+}
+
+// ClusterHealth is the probe record of one ResourceConfigPath entry
+type ClusterHealth struct {
+	ResourceId    string  `json:"resourceId"`
+	ClusterName   string  `json:"clusterName"`
+	Region        string  `json:"region"`
+	Status        int8    `json:"status"`
+	Healthy       bool    `json:"healthy"`
+	LatencyMs     int64   `json:"latencyMs"`
+	ErrorRate     float64 `json:"errorRate"`
+	Failures      int     `json:"consecutiveFailures"`
+	Successes     int     `json:"consecutiveSuccesses"`
+	LastError     string  `json:"lastError"`
+	LastProbeTime string  `json:"lastProbeTime"`
+	ChangeTime    string  `json:"changeTime"`
+	results       []bool
+}
+
+var healthLock sync.RWMutex
+var clusterHealthMap = make(map[string]*ClusterHealth)
+
+func GetHealthConfig() HealthConfig {
+	hc := HealthConfig{}
+	hc.ProbeTimeout = beego.AppConfig.DefaultInt("health::probe_timeout", 5)
+	hc.WindowSize = beego.AppConfig.DefaultInt("health::window_size", 10)
+	hc.FailThreshold = beego.AppConfig.DefaultInt("health::fail_threshold", 3)
+	hc.RecoverThreshold = beego.AppConfig.DefaultInt("health::recover_threshold", 2)
+	hc.MaxErrorPercent = beego.AppConfig.DefaultInt("health::max_error_percent", 50)
+	if hc.WindowSize < 1 {
+		hc.WindowSize = 1
+	}
+	return hc
+}
+
+// ClusterHealthy reports whether a cluster passes its probes, clusters that
+// have not been probed yet are taken as healthy
+func ClusterHealthy(resourceId string) bool {
+	healthLock.RLock()
+	defer healthLock.RUnlock()
+	ch, ok := clusterHealthMap[resourceId]
+	if !ok {
+		return true
+	}
+	return ch.Healthy
+}
+
+// ProbeCluster checks that the API server answers discovery and serves the CodeServer CRD
+func ProbeCluster(resourceId string, timeout time.Duration) (time.Duration, error) {
+	start := time.Now()
+	config, err := GetResConfig(resourceId)
+	if err != nil {
+		return time.Since(start), err
+	}
+	if config == nil {
+		return time.Since(start), errors.New("the cluster has no usable credentials")
+	}
+	_, err = ProbeResConfig(config, timeout)
+	return time.Since(start), err
+}
+
+// ProbeResConfig runs the health probe against a client config
+func ProbeResConfig(config *rest.Config, timeout time.Duration) (time.Duration, error) {
+	start := time.Now()
+	config.Timeout = timeout
+	dc, err := discovery.NewDiscoveryClientForConfig(config)
+	if err != nil {
+		return time.Since(start), err
+	}
+	if _, err = dc.ServerVersion(); err != nil {
+		return time.Since(start), err
+	}
+	resList, err := dc.ServerResourcesForGroupVersion(CodeServerGroupVersion)
+	if err != nil {
+		return time.Since(start), err
+	}
+	for _, res := range resList.APIResources {
+		if res.Kind == CodeServerKind {
+			return time.Since(start), nil
+		}
+	}
+	return time.Since(start), errors.New("the CodeServer CRD is not installed")
+}
+
+// recordProbe adds a probe result to the window of a cluster and flips its
+// health once the failure or recovery thresholds are reached
+func recordProbe(hc HealthConfig, rcp models.ResourceConfigPath, latency time.Duration, probeErr error) {
+	healthLock.Lock()
+	defer healthLock.Unlock()
+	ch, ok := clusterHealthMap[rcp.ResourceId]
+	if !ok {
+		ch = &ClusterHealth{ResourceId: rcp.ResourceId, Healthy: true, ChangeTime: common.GetCurTime()}
+		clusterHealthMap[rcp.ResourceId] = ch
+	}
+	ch.ClusterName = rcp.ClusterName
+	ch.Region = rcp.Region
+	ch.Status = rcp.Status
+	ch.LatencyMs = latency.Milliseconds()
+	ch.LastProbeTime = common.GetCurTime()
+	ch.results = append(ch.results, probeErr == nil)
+	if len(ch.results) > hc.WindowSize {
+		ch.results = ch.results[len(ch.results)-hc.WindowSize:]
+	}
+	failed := 0
+	for _, ok := range ch.results {
+		if !ok {
+			failed++
+		}
+	}
+	ch.ErrorRate = float64(failed) / float64(len(ch.results))
+	if probeErr != nil {
+		ch.LastError = probeErr.Error()
+		ch.Failures++
+		ch.Successes = 0
+	} else {
+		ch.Failures = 0
+		ch.Successes++
+	}
+	if ch.Healthy && (ch.Failures >= hc.FailThreshold ||
+		(len(ch.results) >= hc.WindowSize && ch.ErrorRate*100 > float64(hc.MaxErrorPercent))) {
+		ch.Healthy = false
+		ch.ChangeTime = common.GetCurTime()
+		logs.Error("Cluster is unhealthy, resourceId: ", ch.ResourceId, ",cluster: ", ch.ClusterName,
+			",errorRate: ", ch.ErrorRate, ",lastError: ", ch.LastError)
+	} else if !ch.Healthy && ch.Successes >= hc.RecoverThreshold {
+		ch.Healthy = true
+		ch.ChangeTime = common.GetCurTime()
+		// Start over so that old failures do not mark the cluster down again
+		ch.results = ch.results[:0]
+		ch.ErrorRate = 0
+		logs.Info("Cluster is healthy again, resourceId: ", ch.ResourceId, ",cluster: ", ch.ClusterName)
+	}
+}
+
+// ClusterHealthTask probes every configured cluster. Each replica runs it for
+// itself so that followers also stop scheduling onto failed clusters.
+func ClusterHealthTask() error {
+	rcpList, _, queryErr := models.QueryResourceConfigPathAll()
+	if queryErr != nil {
+		logs.Error("ClusterHealthTask, queryErr: ", queryErr)
+		return queryErr
+	}
+	pruneClusterHealth(rcpList)
+	hc := GetHealthConfig()
+	timeout := time.Duration(hc.ProbeTimeout) * time.Second
+	var wg sync.WaitGroup
+	for _, rcp := range rcpList {
+		wg.Add(1)
+		go func(rcp models.ResourceConfigPath) {
+			defer wg.Done()
+			latency, probeErr := ProbeCluster(rcp.ResourceId, timeout)
+			recordProbe(hc, rcp, latency, probeErr)
+		}(rcp)
+	}
+	wg.Wait()
+	return nil
+}
+
+// pruneClusterHealth forgets the clusters that are no longer configured
+func pruneClusterHealth(rcpList []models.ResourceConfigPath) {
+	configured := make(map[string]bool, len(rcpList))
+	for _, rcp := range rcpList {
+		configured[rcp.ResourceId] = true
+	}
+	healthLock.Lock()
+	defer healthLock.Unlock()
+	for resourceId := range clusterHealthMap {
+		if !configured[resourceId] {
+			delete(clusterHealthMap, resourceId)
+			logs.Info("pruneClusterHealth, the cluster is removed, resourceId: ", resourceId)
+		}
+	}
+}
+
+// ClusterHealthList returns the probe records sorted by resource id
+func ClusterHealthList() []ClusterHealth {
+	healthLock.RLock()
+	defer healthLock.RUnlock()
+	chList := make([]ClusterHealth, 0, len(clusterHealthMap))
+	for _, ch := range clusterHealthMap {
+		chList = append(chList, *ch)
+	}
+	sort.Slice(chList, func(i, j int) bool {
+		return chList[i].ResourceId < chList[j].ResourceId
+	})
+	return chList
+}
@@ -0,0 +1,205 @@
+package handler
+
+import (
+	"fmt"
+	"os"
+	"playground_backend/common"
+	"playground_backend/models"
+	"sync"
+	"time"
+
+	"github.com/astaxie/beego"
+	"github.com/astaxie/beego/logs"
+)
+
+type LeaderConfig struct {
+	Enable       bool
+	LockName     string
+	LeaseSeconds int64
+	RenewSeconds int64
+}
+
+type leaderState struct {
+	lock      sync.RWMutex
+	isLeader  bool
+	identity  string
+	renewTime time.Time
+}
+
+var leader = leaderState{}
+
+func GetLeaderConfig() LeaderConfig {
+	lc := LeaderConfig{}
+	enable, err := beego.AppConfig.Int("leader::enable")
+	lc.Enable = err == nil && enable == 1
+	lc.LockName = beego.AppConfig.DefaultString("leader::lock_name", "playground-manager")
+	lc.LeaseSeconds = beego.AppConfig.DefaultInt64("leader::lease_seconds", 30)
+	lc.RenewSeconds = beego.AppConfig.DefaultInt64("leader::renew_seconds", 10)
+	if lc.RenewSeconds < 1 {
+		lc.RenewSeconds = 1
+	}
+	if lc.LeaseSeconds <= lc.RenewSeconds {
+		lc.LeaseSeconds = lc.RenewSeconds * 3
+	}
+	return lc
+}
+
+// LeaderIdentity names this replica in the lock row
+func LeaderIdentity() string {
+	leader.lock.Lock()
+	defer leader.lock.Unlock()
+	if len(leader.identity) == 0 {
+		hostName, _ := os.Hostname()
+		leader.identity = fmt.Sprintf("%s-%d-%s", hostName, os.Getpid(), common.RandomString(8))
+	}
+	return leader.identity
+}
+
+// IsLeader reports whether this replica may run cron tasks and refill pools.
+// Without leader::enable every replica behaves as the leader.
+func IsLeader() bool {
+	if !GetLeaderConfig().Enable {
+		return true
+	}
+	leader.lock.RLock()
+	defer leader.lock.RUnlock()
+	return leader.isLeader
+}
+
+func setLeader(isLeader bool) bool {
+	leader.lock.Lock()
+	defer leader.lock.Unlock()
+	changed := leader.isLeader != isLeader
+	leader.isLeader = isLeader
+	if isLeader {
+		leader.renewTime = time.Now()
+	}
+	return changed
+}
+
+func leaseExpired(lc LeaderConfig) bool {
+	leader.lock.RLock()
+	defer leader.lock.RUnlock()
+	return time.Since(leader.renewTime) >= time.Duration(lc.LeaseSeconds)*time.Second
+}
+
+// onStartedLeading rebuilds the pools from the members that exist on the clusters,
+// so a follower taking over continues with the pools the old leader left behind
+func onStartedLeading() {
+	logs.Info("onStartedLeading, identity: ", LeaderIdentity())
+	CoursePoolVar.Reset()
+	InitialResourcePool()
+}
+
+// onStoppedLeading drops the pools in memory, the new leader owns them from now on
+func onStoppedLeading() {
+	logs.Info("onStoppedLeading, identity: ", LeaderIdentity())
+	CoursePoolVar.Reset()
+}
+
+func tryLeading(lc LeaderConfig) {
+	ok, err := models.AcquireLeaderLock(lc.LockName, LeaderIdentity(), lc.LeaseSeconds)
+	if err != nil {
+		logs.Error("tryLeading, err: ", err)
+		// Keep leading until our own lease runs out, the row may still be ours
+		if IsLeader() && leaseExpired(lc) && setLeader(false) {
+			onStoppedLeading()
+		}
+		return
+	}
+	if setLeader(ok) {
+		if ok {
+			go onStartedLeading()
+		} else {
+			onStoppedLeading()
+		}
+	}
+}
+
+// StartLeaderElection competes for the lock row and keeps renewing it. Without
+// leader::enable the pools are initialized at once, as with a single replica.
+func StartLeaderElection() {
+	lc := GetLeaderConfig()
+	if !lc.Enable {
+		InitialResourcePool()
+		return
+	}
+	tryLeading(lc)
+	go func() {
+		for {
+			time.Sleep(time.Duration(lc.RenewSeconds) * time.Second)
+			tryLeading(lc)
+		}
+	}()
+}
+
+// StopLeaderElection releases the lease on shutdown so a follower takes over at once
+func StopLeaderElection() {
+	lc := GetLeaderConfig()
+	if !lc.Enable || !IsLeader() {
+		return
+	}
+	relErr := models.ReleaseLeaderLock(lc.LockName, LeaderIdentity())
+	if relErr != nil {
+		logs.Error("StopLeaderElection, relErr: ", relErr)
+	}
+	setLeader(false)
+}
+
+// LeaderTask wraps a cron task so that only the leader runs it
+func LeaderTask(name string, f func() error) func() error {
+	return func() error {
+		if !IsLeader() {
+			logs.Info(name, ", not the leader, skip")
+			return nil
+		}
+		return f()
+	}
+}
+
+// runLocked runs f under the lock row lockName, renewing the lease while f
+// runs. It returns false without running f when another replica holds the lock.
+func runLocked(lockName string, lease int64, f func() error) (bool, error) {
+	ok, lockErr := models.AcquireLeaderLock(lockName, LeaderIdentity(), lease)
+	if lockErr != nil || !ok {
+		return false, lockErr
+	}
+	defer func() {
+		if relErr := models.ReleaseLeaderLock(lockName, LeaderIdentity()); relErr != nil {
+			logs.Error("runLocked, relErr: ", relErr, ",lockName: ", lockName)
+		}
+	}()
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		ticker := time.NewTicker(time.Duration(lease) * time.Second / 3)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-done:
+				return
+			case <-ticker.C:
+				if _, renewErr := models.AcquireLeaderLock(lockName, LeaderIdentity(), lease); renewErr != nil {
+					logs.Error("runLocked, renewErr: ", renewErr, ",lockName: ", lockName)
+				}
+			}
+		}
+	}()
+	return true, f()
+}
+
+// MigrateAuthPII runs models.MigrateAuthPII on one replica at a time. Lookups
+// fall back to the plaintext columns until every row has been migrated, so the
+// replicas that skip it keep working meanwhile.
+func MigrateAuthPII() {
+	lockName := GetLeaderConfig().LockName + "-migrate-pii"
+	lease := beego.AppConfig.DefaultInt64("crypto::migrate_lock_seconds", 600)
+	ok, err := runLocked(lockName, lease, models.MigrateAuthPII)
+	if err != nil {
+		logs.Error("MigrateAuthPII, err: ", err)
+		return
+	}
+	if !ok {
+		logs.Info("MigrateAuthPII, running on another replica, skipped")
+	}
+}
@@ -0,0 +1,188 @@
+package handler
+
+import (
+	"playground_backend/models"
+	"sort"
+	"strings"
+
+	"github.com/astaxie/beego/logs"
+)
+
+// UnmetRules lists what a learner has to complete before a course or a
+// chapter is open to them
+type UnmetRules struct {
+	CourseId      string   `json:"courseId"`
+	ChapterId     string   `json:"chapterId,omitempty"`
+	Prerequisites []string `json:"prerequisites,omitempty"`
+	Chapters      []string `json:"chapters,omitempty"`
+}
+
+func (u *UnmetRules) Error() string {
+	msg := []string{}
+	if len(u.Prerequisites) > 0 {
+		msg = append(msg, "Complete the prerequisite courses first: "+strings.Join(u.Prerequisites, ", "))
+	}
+	if len(u.Chapters) > 0 {
+		msg = append(msg, "Complete the previous chapters first: "+strings.Join(u.Chapters, ", "))
+	}
+	return strings.Join(msg, "; ")
+}
+
+// CourseRequires returns the prerequisite courses of a course
+func CourseRequires(cs models.Courses) []string {
+	requires := []string{}
+	for _, courseId := range strings.Split(cs.Requires, ",") {
+		if courseId = strings.TrimSpace(courseId); len(courseId) > 0 {
+			requires = append(requires, courseId)
+		}
+	}
+	return requires
+}
+
+// prerequisiteCycles returns the prerequisites of courseId that require
+// courseId again, directly or through other courses
+func prerequisiteCycles(courseId string, requires func(string) []string) map[string]bool {
+	cyclic := map[string]bool{}
+	for _, pre := range requires(courseId) {
+		visited := map[string]bool{}
+		stack := []string{pre}
+		for len(stack) > 0 {
+			cur := stack[len(stack)-1]
+			stack = stack[:len(stack)-1]
+			if cur == courseId {
+				cyclic[pre] = true
+				break
+			}
+			if visited[cur] {
+				continue
+			}
+			visited[cur] = true
+			stack = append(stack, requires(cur)...)
+		}
+	}
+	return cyclic
+}
+
+// catalogRequires returns the prerequisites of a course as stored, courses
+// that are not found have none
+func catalogRequires() func(string) []string {
+	cache := map[string][]string{}
+	return func(courseId string) []string {
+		if requires, ok := cache[courseId]; ok {
+			return requires
+		}
+		rc := models.Courses{CourseId: courseId}
+		requires := []string{}
+		if models.QueryCourse(&rc, "CourseId") == nil {
+			requires = CourseRequires(rc)
+		}
+		cache[courseId] = requires
+		return requires
+	}
+}
+
+// unmetPrerequisites returns the prerequisites of a course the user has not
+// completed, see prerequisitesUnmet
+func unmetPrerequisites(userId int64, cs models.Courses) []string {
+	if len(CourseRequires(cs)) == 0 {
+		return []string{}
+	}
+	online := func(courseId string) bool {
+		rc := models.Courses{CourseId: courseId}
+		return models.QueryCourse(&rc, "CourseId") == nil && rc.Status == 1
+	}
+	completed := func(courseId string) bool {
+		uc := models.UserCourse{UserId: userId, CourseId: courseId}
+		return models.QueryUserCourse(&uc, "UserId", "CourseId") == nil && uc.CompletedFlag == 2
+	}
+	return prerequisitesUnmet(cs, catalogRequires(), online, completed)
+}
+
+// prerequisitesUnmet returns the prerequisites of cs that are not completed.
+// Prerequisites that are not online courses cannot be taken, and
+// prerequisites that require the course again can never be completed first,
+// so neither is required.
+func prerequisitesUnmet(cs models.Courses, requires func(string) []string,
+	online, completed func(string) bool) []string {
+	unmet := []string{}
+	cyclic := prerequisiteCycles(cs.CourseId, requires)
+	for _, courseId := range CourseRequires(cs) {
+		if cyclic[courseId] {
+			logs.Info("The prerequisite requires the course again, courseId: ", cs.CourseId, ", prerequisite: ", courseId)
+			continue
+		}
+		if !online(courseId) {
+			logs.Info("The prerequisite is not an online course, courseId: ", cs.CourseId, ", prerequisite: ", courseId)
+			continue
+		}
+		if !completed(courseId) {
+			unmet = append(unmet, courseId)
+		}
+	}
+	return unmet
+}
+
+// unmetChapters returns the chapters before chapterId the user has not
+// completed in a sequential course, see chaptersUnmet
+func unmetChapters(userId int64, cs models.Courses, chapterId string) []string {
+	if cs.Ordering != ChapterOrderSequential || len(chapterId) == 0 {
+		return []string{}
+	}
+	return chaptersUnmet(chapterId, models.QueryAllCourseChapterById(cs.CourseId),
+		models.QueryChapterByCourseId(cs.CourseId, userId))
+}
+
+// chaptersUnmet returns the online chapters ordered before chapterId that
+// are not completed in userChapters. Chapters the user has bound before stay
+// open, and chapters the course does not have are left to the callers.
+func chaptersUnmet(chapterId string, courseChapters []models.CoursesChapter,
+	userChapters []models.UserCourseChapter) []string {
+	unmet := []string{}
+	completed := map[string]bool{}
+	for _, ucp := range userChapters {
+		if ucp.Status != 1 {
+			continue
+		}
+		if ucp.ChapterId == chapterId {
+			return unmet
+		}
+		completed[ucp.ChapterId] = ucp.CompletedFlag == 2
+	}
+	chapters := []models.CoursesChapter{}
+	for _, cp := range courseChapters {
+		if cp.Status == 1 {
+			chapters = append(chapters, cp)
+		}
+	}
+	sort.SliceStable(chapters, func(i, j int) bool {
+		if chapters[i].Position != chapters[j].Position {
+			return chapters[i].Position < chapters[j].Position
+		}
+		return chapters[i].Id < chapters[j].Id
+	})
+	for _, cp := range chapters {
+		if cp.ChapterId == chapterId {
+			return unmet
+		}
+		if !completed[cp.ChapterId] {
+			unmet = append(unmet, cp.ChapterId)
+		}
+	}
+	return []string{}
+}
+
+// CheckLearnRules checks the prerequisites of a course and, with a chapter,
+// the chapter order of the course. The error is an *UnmetRules.
+func CheckLearnRules(userId int64, courseId, chapterId string) error {
+	cs := models.Courses{CourseId: courseId}
+	if models.QueryCourse(&cs, "CourseId") != nil {
+		return nil
+	}
+	unmet := UnmetRules{CourseId: courseId, ChapterId: chapterId,
+		Prerequisites: unmetPrerequisites(userId, cs), Chapters: unmetChapters(userId, cs, chapterId)}
+	if len(unmet.Prerequisites) == 0 && len(unmet.Chapters) == 0 {
+		return nil
+	}
+	logs.Info("CheckLearnRules, userId: ", userId, ", ", unmet.Error())
+	return &unmet
+}
@@ -0,0 +1,161 @@
+package handler
+
+import (
+	"playground_backend/models"
+	"reflect"
+	"sort"
+	"testing"
+)
+
+func TestChaptersUnmet(t *testing.T) {
+	courseChapters := []models.CoursesChapter{
+		{Id: 4, ChapterId: "ch4", Position: 4, Status: 1},
+		{Id: 1, ChapterId: "ch1", Position: 1, Status: 1},
+		{Id: 2, ChapterId: "ch2", Position: 2, Status: 1},
+		{Id: 3, ChapterId: "ch3", Position: 3, Status: 2},
+		{Id: 5, ChapterId: "ch5", Position: 0, Status: 1},
+		{Id: 6, ChapterId: "ch6", Position: 0, Status: 1},
+	}
+	done := func(chapterId string) models.UserCourseChapter {
+		return models.UserCourseChapter{ChapterId: chapterId, CompletedFlag: 2, Status: 1}
+	}
+	learning := func(chapterId string) models.UserCourseChapter {
+		return models.UserCourseChapter{ChapterId: chapterId, CompletedFlag: 1, Status: 1}
+	}
+	cases := []struct {
+		name         string
+		chapterId    string
+		userChapters []models.UserCourseChapter
+		want         []string
+	}{
+		{"first chapter", "ch5", nil, []string{}},
+		{"nothing completed", "ch2", nil, []string{"ch5", "ch6", "ch1"}},
+		{"unpositioned chapters by id", "ch6", nil, []string{"ch5"}},
+		{"previous chapters completed", "ch2", []models.UserCourseChapter{done("ch5"), done("ch6"), done("ch1")},
+			[]string{}},
+		{"previous chapter still learning", "ch2", []models.UserCourseChapter{done("ch5"), done("ch6"), learning("ch1")},
+			[]string{"ch1"}},
+		{"offline chapters are skipped", "ch4",
+			[]models.UserCourseChapter{done("ch5"), done("ch6"), done("ch1"), done("ch2")}, []string{}},
+		{"bound chapter stays open", "ch4", []models.UserCourseChapter{learning("ch4")}, []string{}},
+		{"offline binding does not count", "ch2",
+			[]models.UserCourseChapter{{ChapterId: "ch2", Status: 2}, done("ch5"), done("ch6")}, []string{"ch1"}},
+		{"offline completion does not count", "ch2",
+			[]models.UserCourseChapter{done("ch5"), done("ch6"), {ChapterId: "ch1", CompletedFlag: 2, Status: 2}},
+			[]string{"ch1"}},
+		{"unknown chapter", "ch9", nil, []string{}},
+	}
+	for _, c := range cases {
+		chapters := append([]models.CoursesChapter(nil), courseChapters...)
+		if got := chaptersUnmet(c.chapterId, chapters, c.userChapters); !reflect.DeepEqual(got, c.want) {
+			t.Errorf("%s: chaptersUnmet() = %v, want %v", c.name, got, c.want)
+		}
+	}
+}
+
+func TestUnmetChaptersFreeOrder(t *testing.T) {
+	cases := []struct {
+		name      string
+		cs        models.Courses
+		chapterId string
+	}{
+		{"free order", models.Courses{CourseId: "course", Ordering: ChapterOrderFree}, "ch2"},
+		{"default order", models.Courses{CourseId: "course"}, "ch2"},
+		{"no chapter", models.Courses{CourseId: "course", Ordering: ChapterOrderSequential}, ""},
+	}
+	for _, c := range cases {
+		if got := unmetChapters(1, c.cs, c.chapterId); len(got) != 0 {
+			t.Errorf("%s: unmetChapters() = %v, want none", c.name, got)
+		}
+	}
+}
+
+func TestPrerequisitesUnmet(t *testing.T) {
+	catalog := map[string]models.Courses{
+		"basics":   {CourseId: "basics", Status: 1},
+		"shell":    {CourseId: "shell", Status: 1, Requires: "basics"},
+		"kernel":   {CourseId: "kernel", Status: 1, Requires: "basics, shell"},
+		"retired":  {CourseId: "retired", Status: 2},
+		"chicken":  {CourseId: "chicken", Status: 1, Requires: "egg"},
+		"egg":      {CourseId: "egg", Status: 1, Requires: "chicken"},
+		"a":        {CourseId: "a", Status: 1, Requires: "b,basics"},
+		"b":        {CourseId: "b", Status: 1, Requires: "c"},
+		"c":        {CourseId: "c", Status: 1, Requires: "a"},
+		"advanced": {CourseId: "advanced", Status: 1, Requires: "kernel,retired,missing"},
+	}
+	requires := func(courseId string) []string {
+		return CourseRequires(catalog[courseId])
+	}
+	online := func(courseId string) bool {
+		cs, ok := catalog[courseId]
+		return ok && cs.Status == 1
+	}
+	cases := []struct {
+		name      string
+		courseId  string
+		completed []string
+		want      []string
+	}{
+		{"no prerequisites", "basics", nil, []string{}},
+		{"one missing", "shell", nil, []string{"basics"}},
+		{"completed", "shell", []string{"basics"}, []string{}},
+		{"several missing", "kernel", nil, []string{"basics", "shell"}},
+		{"partly completed", "kernel", []string{"shell"}, []string{"basics"}},
+		{"offline and unknown are not required", "advanced", nil, []string{"kernel"}},
+		{"two courses requiring each other", "chicken", nil, []string{}},
+		{"longer cycle", "a", nil, []string{"basics"}},
+		{"cycle elsewhere is still required", "kernel", []string{"basics"}, []string{"shell"}},
+	}
+	for _, c := range cases {
+		completed := func(courseId string) bool {
+			for _, done := range c.completed {
+				if done == courseId {
+					return true
+				}
+			}
+			return false
+		}
+		got := prerequisitesUnmet(catalog[c.courseId], requires, online, completed)
+		if !reflect.DeepEqual(got, c.want) {
+			t.Errorf("%s: prerequisitesUnmet() = %v, want %v", c.name, got, c.want)
+		}
+	}
+}
+
+func TestPrerequisiteCycles(t *testing.T) {
+	graph := map[string][]string{
+		"a": {"b", "x"},
+		"b": {"c"},
+		"c": {"a", "y"},
+		"x": {"y"},
+		"y": {},
+		"s": {"s"},
+		"p": {"q"},
+		"q": {"r"},
+		"r": {"q"},
+	}
+	requires := func(courseId string) []string {
+		return graph[courseId]
+	}
+	cases := []struct {
+		courseId string
+		want     []string
+	}{
+		{"a", []string{"b"}},
+		{"b", []string{"c"}},
+		{"x", []string{}},
+		{"s", []string{"s"}},
+		{"p", []string{}},
+		{"unknown", []string{}},
+	}
+	for _, c := range cases {
+		got := []string{}
+		for courseId := range prerequisiteCycles(c.courseId, requires) {
+			got = append(got, courseId)
+		}
+		sort.Strings(got)
+		if !reflect.DeepEqual(got, c.want) {
+			t.Errorf("prerequisiteCycles(%s) = %v, want %v", c.courseId, got, c.want)
+		}
+	}
+}
@@ -0,0 +1,229 @@
+package handler
+
+import (
+	"errors"
+	"fmt"
+	"playground_backend/common"
+	"sort"
+	"strings"
+
+	"github.com/astaxie/beego"
+	"github.com/astaxie/beego/logs"
+	"k8s.io/apimachinery/pkg/api/resource"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime/serializer/yaml"
+)
+
+// Statistics event recorded when a rendered template is rejected
+const PolicyEventType = "Template Policy Violation"
+
+// Registry of images without an explicit registry host
+const DefaultRegistry = "docker.io"
+
+type TemplatePolicy struct {
+	Enable            bool
+	MaxCpu            string
+	MaxMemory         string
+	MaxBandwidth      string
+	ForbidPrivileged  bool
+	ForbidHostPath    bool
+	RequireLimits     bool
+	RequireInactive   bool
+	AllowedRegistries []string
+}
+
+type PolicyViolation struct {
+	Rule    string `json:"rule"`
+	Path    string `json:"path"`
+	Message string `json:"message"`
+}
+
+func GetTemplatePolicy() TemplatePolicy {
+	tp := TemplatePolicy{}
+	tp.Enable = beego.AppConfig.DefaultInt("policy::enable", 1) == 1
+	tp.MaxCpu = beego.AppConfig.DefaultString("policy::max_cpu", "2")
+	tp.MaxMemory = beego.AppConfig.DefaultString("policy::max_memory", "4Gi")
+	tp.MaxBandwidth = beego.AppConfig.DefaultString("policy::max_bandwidth", "100M")
+	tp.ForbidPrivileged = beego.AppConfig.DefaultInt("policy::forbid_privileged", 1) == 1
+	tp.ForbidHostPath = beego.AppConfig.DefaultInt("policy::forbid_host_path", 1) == 1
+	tp.RequireLimits = beego.AppConfig.DefaultInt("policy::require_limits", 1) == 1
+	tp.RequireInactive = beego.AppConfig.DefaultInt("policy::require_inactive", 1) == 1
+	for _, registry := range strings.Split(beego.AppConfig.String("policy::allowed_registries"), ",") {
+		registry = strings.TrimSpace(registry)
+		if len(registry) > 0 {
+			tp.AllowedRegistries = append(tp.AllowedRegistries, registry)
+		}
+	}
+	return tp
+}
+
+// ImageRegistry returns the registry host of an image reference, references
+// without a host come from DefaultRegistry
+func ImageRegistry(image string) string {
+	parts := strings.SplitN(image, "/", 2)
+	if len(parts) < 2 {
+		return DefaultRegistry
+	}
+	host := parts[0]
+	if !strings.ContainsAny(host, ".:") && host != "localhost" {
+		return DefaultRegistry
+	}
+	return host
+}
+
+func registryAllowed(allowed []string, registry string) bool {
+	for _, a := range allowed {
+		if a == registry {
+			return true
+		}
+	}
+	return false
+}
+
+// exceeds reports whether a quantity is above the limit, values that cannot
+// be parsed count as exceeding so that they are rejected too
+func exceeds(value interface{}, limit string) (bool, string) {
+	str := fmt.Sprint(value)
+	quantity, err := resource.ParseQuantity(str)
+	if err != nil {
+		return true, str
+	}
+	max, err := resource.ParseQuantity(limit)
+	if err != nil {
+		logs.Error("exceeds, invalid policy limit: ", limit)
+		return false, str
+	}
+	return quantity.Cmp(max) > 0, str
+}
+
+type policyWalker struct {
+	tp         TemplatePolicy
+	violations []PolicyViolation
+	limitsSeen bool
+}
+
+func (w *policyWalker) add(rule, path, format string, args ...interface{}) {
+	w.violations = append(w.violations, PolicyViolation{Rule: rule, Path: path,
+		Message: fmt.Sprintf(format, args...)})
+}
+
+func (w *policyWalker) checkResources(path string, resources map[string]interface{}) {
+	for _, part := range []string{"limits", "requests"} {
+		values, ok := ParsingMap(resources, part)
+		if !ok {
+			continue
+		}
+		if part == "limits" {
+			if _, ok := values["cpu"]; ok {
+				if _, ok := values["memory"]; ok {
+					w.limitsSeen = true
+				}
+			}
+		}
+		if cpu, ok := values["cpu"]; ok {
+			if over, str := exceeds(cpu, w.tp.MaxCpu); over {
+				w.add("max_cpu", path+"."+part+".cpu", "cpu %s exceeds the maximum %s", str, w.tp.MaxCpu)
+			}
+		}
+		if memory, ok := values["memory"]; ok {
+			if over, str := exceeds(memory, w.tp.MaxMemory); over {
+				w.add("max_memory", path+"."+part+".memory", "memory %s exceeds the maximum %s", str, w.tp.MaxMemory)
+			}
+		}
+	}
+}
+
+// walk visits every field of the rendered object, so the rules apply to
+// CodeServer specs and to plain pod templates alike
+func (w *policyWalker) walk(path string, value interface{}) {
+	switch v := value.(type) {
+	case map[string]interface{}:
+		keys := make([]string, 0, len(v))
+		for key := range v {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+		for _, key := range keys {
+			child := v[key]
+			childPath := path + "." + key
+			switch key {
+			case "privileged", "hostNetwork", "hostPID", "hostIPC":
+				if enabled, ok := child.(bool); ok && enabled && w.tp.ForbidPrivileged {
+					w.add("forbid_privileged", childPath, "%s must not be enabled", key)
+				}
+			case "hostPath":
+				if w.tp.ForbidHostPath {
+					w.add("forbid_host_path", childPath, "host path volumes are not allowed")
+				}
+			case "image":
+				image, ok := child.(string)
+				if ok && len(w.tp.AllowedRegistries) > 0 {
+					if !registryAllowed(w.tp.AllowedRegistries, ImageRegistry(image)) {
+						w.add("allowed_registries", childPath, "image %s is not from an allowed registry", image)
+					}
+				}
+			case "resources":
+				if resources, ok := child.(map[string]interface{}); ok {
+					w.checkResources(childPath, resources)
+				}
+			case "ingressBandwidth", "egressBandwidth":
+				if over, str := exceeds(child, w.tp.MaxBandwidth); over {
+					w.add("max_bandwidth", childPath, "%s %s exceeds the maximum %s", key, str, w.tp.MaxBandwidth)
+				}
+			}
+			w.walk(childPath, child)
+		}
+	case []interface{}:
+		for i, child := range v {
+			w.walk(fmt.Sprintf("%s[%d]", path, i), child)
+		}
+	}
+}
+
+// CheckTemplatePolicy checks a rendered template against the [policy] rules
+// and returns every violation found
+func CheckTemplatePolicy(tp TemplatePolicy, yamlData []byte) []PolicyViolation {
+	w := &policyWalker{tp: tp}
+	obj := &unstructured.Unstructured{}
+	_, _, err := yaml.NewDecodingSerializer(unstructured.UnstructuredJSONScheme).Decode(yamlData, nil, obj)
+	if err != nil {
+		w.add("parse", "", "the rendered template is not a valid object: %v", err)
+		return w.violations
+	}
+	w.walk(obj.GetKind(), obj.Object)
+	if tp.RequireLimits && !w.limitsSeen {
+		w.add("require_limits", obj.GetKind()+".spec.resources.limits", "cpu and memory limits are required")
+	}
+	if tp.RequireInactive {
+		spec, _ := ParsingMap(obj.Object, "spec")
+		if seconds, ok := spec["inactiveAfterSeconds"]; !ok || fmt.Sprint(seconds) == "0" {
+			w.add("require_inactive", obj.GetKind()+".spec.inactiveAfterSeconds", "inactiveAfterSeconds is required")
+		}
+	}
+	return w.violations
+}
+
+// EnforceTemplatePolicy rejects a rendered template that breaks the policy and
+// records the violations in the statistics log
+func EnforceTemplatePolicy(yamlData []byte, cd CourseData) error {
+	tp := GetTemplatePolicy()
+	if !tp.Enable {
+		return nil
+	}
+	violations := CheckTemplatePolicy(tp, yamlData)
+	if len(violations) == 0 {
+		return nil
+	}
+	messages := make([]string, 0, len(violations))
+	for _, v := range violations {
+		messages = append(messages, v.Path+": "+v.Message)
+	}
+	mesg := strings.Join(messages, "; ")
+	logs.Error("EnforceTemplatePolicy, courseId: ", cd.CourseId, ", resourceId: ", cd.ResourceId, ", ", mesg)
+	sd := StatisticsData{OperationTime: common.GetCurTime(), EventType: PolicyEventType,
+		State: "failed", StateMessage: mesg, Course: cd}
+	if sdErr := StatisticsLog(sd); sdErr != nil {
+		logs.Error("EnforceTemplatePolicy, sdErr: ", sdErr)
+	}
+	return errors.New("The template violates the policy, " + mesg)
+}
@@ -0,0 +1,127 @@
+package handler
+
+import (
+	"reflect"
+	"sort"
+	"strings"
+	"testing"
+)
+
+func testPolicy() TemplatePolicy {
+	return TemplatePolicy{Enable: true, MaxCpu: "2", MaxMemory: "4Gi", MaxBandwidth: "100M",
+		ForbidPrivileged: true, ForbidHostPath: true, RequireLimits: true, RequireInactive: true,
+		AllowedRegistries: []string{"swr.cn-north-4.myhuaweicloud.com"}}
+}
+
+// codeServer renders a CodeServer that passes testPolicy, replace swaps parts
+// of it for the case under test
+func codeServer(replace ...string) []byte {
+	yamlData := `apiVersion: cs.opensourceways.com/v1alpha1
+kind: CodeServer
+metadata:
+  name: test
+spec:
+  runtime: generic
+  inactiveAfterSeconds: 1800
+  ingressBandwidth: 10M
+  egressBandwidth: 10M
+  subdomain: test
+  image: swr.cn-north-4.myhuaweicloud.com/opensourceway/playground/openeuler:21.03
+  resources:
+    requests:
+      cpu: 500m
+      memory: 1Gi
+    limits:
+      cpu: "2"
+      memory: 4Gi
+  privileged: false
+`
+	return []byte(strings.NewReplacer(replace...).Replace(yamlData))
+}
+
+func violatedRules(violations []PolicyViolation) []string {
+	rules := []string{}
+	for _, v := range violations {
+		rules = append(rules, v.Rule)
+	}
+	sort.Strings(rules)
+	return rules
+}
+
+func TestCheckTemplatePolicy(t *testing.T) {
+	cases := []struct {
+		name     string
+		tp       func(*TemplatePolicy)
+		yamlData []byte
+		want     []string
+	}{
+		{"compliant", nil, codeServer(), []string{}},
+		{"cpu limit over the maximum", nil, codeServer(`cpu: "2"`, `cpu: "4"`), []string{"max_cpu"}},
+		{"cpu request over the maximum", nil, codeServer("cpu: 500m", "cpu: 2500m"), []string{"max_cpu"}},
+		{"memory over the maximum", nil, codeServer("memory: 4Gi", "memory: 8Gi"), []string{"max_memory"}},
+		{"unparsable memory", nil, codeServer("memory: 1Gi", "memory: lots"), []string{"max_memory"}},
+		{"bandwidth over the maximum", nil, codeServer("ingressBandwidth: 10M", "ingressBandwidth: 1G"),
+			[]string{"max_bandwidth"}},
+		{"privileged", nil, codeServer("privileged: false", "privileged: true"), []string{"forbid_privileged"}},
+		{"host network", nil, codeServer("privileged: false", "hostNetwork: true"), []string{"forbid_privileged"}},
+		{"privileged allowed", func(tp *TemplatePolicy) { tp.ForbidPrivileged = false },
+			codeServer("privileged: false", "privileged: true"), []string{}},
+		{"host path volume", nil, codeServer("privileged: false", "volumes:\n  - name: data\n    hostPath:\n      path: /data"),
+			[]string{"forbid_host_path"}},
+		{"image from another registry", nil, codeServer("swr.cn-north-4.myhuaweicloud.com/", "quay.io/"),
+			[]string{"allowed_registries"}},
+		{"image without a registry", nil, codeServer("swr.cn-north-4.myhuaweicloud.com/opensourceway/playground/", ""),
+			[]string{"allowed_registries"}},
+		{"any registry without an allowlist", func(tp *TemplatePolicy) { tp.AllowedRegistries = nil },
+			codeServer("swr.cn-north-4.myhuaweicloud.com/", "quay.io/"), []string{}},
+		{"missing limits", nil, codeServer("    limits:\n      cpu: \"2\"\n      memory: 4Gi\n", ""),
+			[]string{"require_limits"}},
+		{"memory limit missing", nil, codeServer("      memory: 4Gi\n", ""), []string{"require_limits"}},
+		{"limits not required", func(tp *TemplatePolicy) { tp.RequireLimits = false },
+			codeServer("    limits:\n      cpu: \"2\"\n      memory: 4Gi\n", ""), []string{}},
+		{"missing inactive timeout", nil, codeServer("  inactiveAfterSeconds: 1800\n", ""),
+			[]string{"require_inactive"}},
+		{"zero inactive timeout", nil, codeServer("inactiveAfterSeconds: 1800", "inactiveAfterSeconds: 0"),
+			[]string{"require_inactive"}},
+		{"several violations", nil, codeServer(`cpu: "2"`, `cpu: "8"`, "privileged: false", "privileged: true",
+			"swr.cn-north-4.myhuaweicloud.com/", "quay.io/"),
+			[]string{"allowed_registries", "forbid_privileged", "max_cpu"}},
+		{"not an object", nil, []byte("- just\n- a list\n"), []string{"parse"}},
+	}
+	for _, c := range cases {
+		tp := testPolicy()
+		if c.tp != nil {
+			c.tp(&tp)
+		}
+		got := violatedRules(CheckTemplatePolicy(tp, c.yamlData))
+		if !reflect.DeepEqual(got, c.want) {
+			t.Errorf("%s: CheckTemplatePolicy() rules = %v, want %v", c.name, got, c.want)
+		}
+	}
+}
+
+func TestCheckTemplatePolicyPath(t *testing.T) {
+	violations := CheckTemplatePolicy(testPolicy(), codeServer("memory: 4Gi", "memory: 8Gi"))
+	if len(violations) != 1 || violations[0].Path != "CodeServer.spec.resources.limits.memory" {
+		t.Errorf("CheckTemplatePolicy() = %+v, want the limit memory path", violations)
+	}
+}
+
+func TestImageRegistry(t *testing.T) {
+	cases := []struct {
+		image string
+		want  string
+	}{
+		{"openeuler/openeuler:21.03", DefaultRegistry},
+		{"nginx", DefaultRegistry},
+		{"quay.io/coreos/etcd:v3", "quay.io"},
+		{"localhost/test:latest", "localhost"},
+		{"registry:5000/test", "registry:5000"},
+		{"swr.cn-north-4.myhuaweicloud.com/opensourceway/playground/openeuler:21.03", "swr.cn-north-4.myhuaweicloud.com"},
+	}
+	for _, c := range cases {
+		if got := ImageRegistry(c.image); got != c.want {
+			t.Errorf("ImageRegistry(%q) = %s, want %s", c.image, got, c.want)
+		}
+	}
+}
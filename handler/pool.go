@@ -5,11 +5,6 @@ import (
 	"encoding/base64"
 	"errors"
 	"fmt"
-	"html/template"
-	"io/ioutil"
-	"os"
-	"path"
-	"path/filepath"
 	"playground_backend/common"
 	"playground_backend/models"
 	"strconv"
@@ -19,6 +14,7 @@ import (
 
 	"github.com/astaxie/beego"
 	"github.com/astaxie/beego/logs"
+	"github.com/astaxie/beego/orm"
 	ymV2 "gopkg.in/yaml.v2"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
@@ -33,6 +29,8 @@ type ResourceData struct {
 	ResourceName string
 	CourseId     string
 	ResPoolSize  int
+	PoolKey      string
+	TemplateHash string
 }
 
 type InitTmplResource struct {
@@ -46,49 +44,324 @@ type InitTmplResource struct {
 var CoursePoolVar = CoursePool{}
 var PoolSync sync.RWMutex
 
+// ErrPoolFull is returned for a member a pool has no room for
+var ErrPoolFull = errors.New("too many resources")
+
+// poolBackoff holds off the refill of a pool after its members failed to be
+// created. The wait doubles with every failure in a row, from one minute up to
+// courses::pool_backoff_max_minutes.
+var poolBackoff = struct {
+	sync.Mutex
+	failures map[string]int
+	until    map[string]time.Time
+}{failures: map[string]int{}, until: map[string]time.Time{}}
+
+// PoolBackoff returns how long the refill of a pool is still held off
+func PoolBackoff(poolKey string) time.Duration {
+	poolBackoff.Lock()
+	defer poolBackoff.Unlock()
+	return time.Until(poolBackoff.until[poolKey])
+}
+
+func poolCreateFailed(poolKey string) time.Duration {
+	poolBackoff.Lock()
+	defer poolBackoff.Unlock()
+	maxWait := time.Duration(beego.AppConfig.DefaultInt("courses::pool_backoff_max_minutes", 20)) * time.Minute
+	wait := time.Minute << uint(poolBackoff.failures[poolKey])
+	if wait > maxWait || wait <= 0 {
+		wait = maxWait
+	} else {
+		poolBackoff.failures[poolKey]++
+	}
+	poolBackoff.until[poolKey] = time.Now().Add(wait)
+	return wait
+}
+
+func poolCreateSucceeded(poolKey string) {
+	poolBackoff.Lock()
+	defer poolBackoff.Unlock()
+	delete(poolBackoff.failures, poolKey)
+	delete(poolBackoff.until, poolKey)
+}
+
+// poolApply lets one refill of the pools run at a time. The initial load and
+// the cron task would otherwise both see a pool short and fill it twice.
+var poolApply = make(chan struct{}, 1)
+
+// CoursePool tracks the warm pools of every course. Pools are keyed by
+// MakePoolKey, so courses rendering the same template on the same cluster share
+// one pool, and CourseKey records which pool a course draws from on each
+// cluster, see CourseClusterKey. The idle
+// members themselves live in pg_pool_instance, so that every replica can claim
+// them while only the leader keeps the target sizes.
 type CoursePool struct {
 	InitialFlag bool
-	CourseMap   map[string]chan InitTmplResource
+	PoolSize    map[string]int
+	CourseKey   map[string]string
+	Reserve     map[string]int
 }
 
 func NewCoursePool(n int) {
 	CoursePoolVar = CoursePool{
-		CourseMap:   make(map[string]chan InitTmplResource, n),
+		PoolSize:    make(map[string]int, n),
+		CourseKey:   make(map[string]string, n),
+		Reserve:     make(map[string]int, n),
 		InitialFlag: false,
 	}
 }
-func (c *CoursePool) Get(key string) (chan InitTmplResource, bool) {
+
+// Reset drops the pool state held in memory, used when this replica loses leadership
+func (c *CoursePool) Reset() {
+	PoolSync.Lock()
+	defer PoolSync.Unlock()
+	c.PoolSize = make(map[string]int)
+	c.CourseKey = make(map[string]string)
+	c.Reserve = make(map[string]int)
+	c.InitialFlag = false
+}
+
+// MakePoolKey identifies a shared pool by cluster, template path and template content
+func MakePoolKey(resourceId, resourcePath, templateHash string) string {
+	return "pool-" + common.EncryptMd5(resourceId+"|"+resourcePath+"|"+templateHash)
+}
+
+func (c *CoursePool) Delete(key string) {
+	PoolSync.Lock()
+	defer PoolSync.Unlock()
+	delete(c.PoolSize, key)
+}
+
+// RemoveCourse forgets the pool and the reservation of a course on a cluster
+func (c *CoursePool) RemoveCourse(courseId, resourceId string) {
+	PoolSync.Lock()
+	defer PoolSync.Unlock()
+	delete(c.CourseKey, CourseClusterKey(courseId, resourceId))
+	delete(c.Reserve, CourseClusterKey(courseId, resourceId))
+}
+
+func (c *CoursePool) Len() int {
 	PoolSync.RLock()
 	defer PoolSync.RUnlock()
-	v, existed := c.CourseMap[key]
-	return v, existed
+	return len(c.PoolSize)
+}
+
+// CourseClusterKey identifies a course on one of the clusters serving it
+func CourseClusterKey(courseId, resourceId string) string {
+	return courseId + "|" + resourceId
 }
 
-func (c *CoursePool) Set(key string, v chan InitTmplResource) {
+// SetCourseKey binds a course on a cluster to a pool and records its minimum reservation
+func (c *CoursePool) SetCourseKey(courseId, resourceId, key string, reserve int) {
 	PoolSync.Lock()
 	defer PoolSync.Unlock()
-	c.CourseMap[key] = v
+	c.CourseKey[CourseClusterKey(courseId, resourceId)] = key
+	c.Reserve[CourseClusterKey(courseId, resourceId)] = reserve
 }
 
-func (c *CoursePool) Delete(key string) {
+// GetCourseKey returns the pool of a course on a cluster. Replicas that have not
+// loaded the pools derive it from the template hash stored with the course.
+func (c *CoursePool) GetCourseKey(courseId, resourceId string) (string, bool) {
+	PoolSync.RLock()
+	key, existed := c.CourseKey[CourseClusterKey(courseId, resourceId)]
+	PoolSync.RUnlock()
+	if existed {
+		return key, true
+	}
+	rt := models.ResourceTempathRel{CourseId: courseId, ResourceId: resourceId}
+	queryErr := models.QueryResourceTempathRel(&rt, "CourseId", "ResourceId")
+	if queryErr != nil || len(rt.TemplateHash) < 1 {
+		return "", false
+	}
+	return MakePoolKey(rt.ResourceId, rt.ResourcePath, rt.TemplateHash), true
+}
+
+// SetSize sets the target size of a pool
+func (c *CoursePool) SetSize(key string, size int) {
 	PoolSync.Lock()
 	defer PoolSync.Unlock()
-	delete(c.CourseMap, key)
+	c.PoolSize[key] = size
 }
 
-func (c *CoursePool) Len() int {
+func (c *CoursePool) Size(key string) int {
 	PoolSync.RLock()
 	defer PoolSync.RUnlock()
-	return len(c.CourseMap)
+	return c.PoolSize[key]
+}
+
+// Free returns the number of idle instances in a pool
+func (c *CoursePool) Free(key string) int {
+	return models.CountFreePoolInstance(key)
+}
+
+// Put adds an idle instance rendered from the template with templateHash to a
+// pool, it returns false when the pool is full or the instance is already known
+func (c *CoursePool) Put(key, templateHash string, itr InitTmplResource) bool {
+	if size, ok := c.sizeOf(key); ok && c.Free(key) >= size {
+		return false
+	}
+	pi := models.PoolInstance{PoolKey: key, ResName: itr.Name, Subdomain: itr.Subdomain,
+		NamePassword: itr.NamePassword, ContactEmail: itr.ContactEmail, TemplateHash: templateHash,
+		Status: models.PoolInstanceFree, CreateTime: common.GetCurTime()}
+	created, inErr := models.InsertPoolInstanceIfAbsent(&pi)
+	if inErr != nil {
+		logs.Error("Put, inErr: ", inErr, ",name: ", itr.Name)
+		return false
+	}
+	return created
+}
+
+func (c *CoursePool) sizeOf(key string) (int, bool) {
+	PoolSync.RLock()
+	defer PoolSync.RUnlock()
+	size, ok := c.PoolSize[key]
+	return size, ok
+}
+
+// Drain claims up to n idle instances of a pool and returns them
+func (c *CoursePool) Drain(key string, n int) []InitTmplResource {
+	itrList := make([]InitTmplResource, 0)
+	for i := 0; i < n; i++ {
+		pi, claimErr := models.ClaimPoolInstance(key, "drain-"+LeaderIdentity())
+		if claimErr != nil {
+			return itrList
+		}
+		itrList = append(itrList, poolInstanceToItr(pi))
+	}
+	return itrList
+}
+
+func poolInstanceToItr(pi models.PoolInstance) InitTmplResource {
+	return InitTmplResource{Name: pi.ResName, Subdomain: pi.Subdomain,
+		NamePassword: pi.NamePassword, UserId: strconv.Itoa(0), ContactEmail: pi.ContactEmail}
+}
+
+// reservedByOthers sums the reservations other courses hold on the same pool
+func reservedByOthers(courseId, key string) int {
+	rtr, _, queryErr := models.QueryResourceTempathRelAll()
+	if queryErr != nil {
+		logs.Error("reservedByOthers, queryErr: ", queryErr)
+	}
+	reserved := 0
+	for _, rt := range rtr {
+		if rt.CourseId == courseId || len(rt.TemplateHash) < 1 {
+			continue
+		}
+		if MakePoolKey(rt.ResourceId, rt.ResourcePath, rt.TemplateHash) == key {
+			reserved += rt.ResReserveSize
+		}
+	}
+	return reserved
+}
+
+// prevCourseKey returns the pool a course used before its template changed
+func prevCourseKey(courseId, resourceId string) string {
+	rt := models.ResourceTempathRel{CourseId: courseId, ResourceId: resourceId}
+	if models.QueryResourceTempathRel(&rt, "CourseId", "ResourceId") != nil {
+		return ""
+	}
+	return rt.PrevPoolKey
+}
+
+// Take claims an idle instance for a course from its shared pool. Instances
+// reserved for the other courses of the pool are left alone, and the call
+// waits up to waitSeconds for the pool to be refilled. While the pool of a
+// changed template fills, members of the previous pool are handed out. The
+// claim is atomic across replicas, so two requests never get the same instance.
+func (c *CoursePool) Take(courseId, resourceId string, waitSeconds int64) (InitTmplResource, error) {
+	key, ok := c.GetCourseKey(courseId, resourceId)
+	prevKey := prevCourseKey(courseId, resourceId)
+	if !ok && len(prevKey) == 0 {
+		return InitTmplResource{}, errors.New("The course has no resource pool, courseId: " + courseId)
+	}
+	reserved := 0
+	if ok {
+		reserved = reservedByOthers(courseId, key)
+	}
+	deadline := time.Now().Add(time.Duration(waitSeconds) * time.Second)
+	for {
+		if ok && c.Free(key) > reserved {
+			pi, claimErr := models.ClaimPoolInstance(key, LeaderIdentity())
+			if claimErr == nil {
+				return poolInstanceToItr(pi), nil
+			}
+			if claimErr != orm.ErrNoRows {
+				logs.Error("Take, claimErr: ", claimErr)
+			}
+		}
+		if len(prevKey) > 0 && prevKey != key {
+			pi, claimErr := models.ClaimPoolInstance(prevKey, LeaderIdentity())
+			if claimErr == nil {
+				logs.Info("Take, served from the previous pool, courseId: ", courseId, ",resName: ", pi.ResName)
+				return poolInstanceToItr(pi), nil
+			}
+			if claimErr != orm.ErrNoRows {
+				logs.Error("Take, claimErr: ", claimErr)
+			}
+		}
+		if time.Now().After(deadline) {
+			return InitTmplResource{}, errors.New("Timed out waiting for a free instance, courseId: " + courseId)
+		}
+		time.Sleep(time.Second)
+	}
 }
 
 func (c *CoursePool) Each() {
+	psList, _, queryErr := models.QueryPoolInstanceStat()
+	if queryErr != nil {
+		logs.Error("Each, queryErr: ", queryErr)
+	}
+	for _, ps := range psList {
+		logs.Info("Pool key:", ps.PoolKey, ",status: ", ps.Status, ",total: ", ps.Total, ",size: ", c.Size(ps.PoolKey))
+	}
 	PoolSync.RLock()
 	defer PoolSync.RUnlock()
-	for key, val := range c.CourseMap {
-		logs.Info("Course id:", key, ",len(val): ", len(val))
-		logs.Info("val:", val)
+	for courseKey, key := range c.CourseKey {
+		logs.Info("Course:", courseKey, ",pool key: ", key, ",reserve: ", c.Reserve[courseKey])
+	}
+}
+
+// TemplateFileHash returns the content hash of a downloaded template
+func TemplateFileHash(localPath string) string {
+	content, fErr := common.ReadAll(localPath)
+	if fErr != nil {
+		logs.Error("TemplateFileHash, fErr: ", fErr)
+		return ""
 	}
+	return common.EncryptMd5(string(content))
+}
+
+// BindCoursePoolKey records the template hash of a course and binds the course to its pool
+func BindCoursePoolKey(rt *models.ResourceTempathRel, templateHash string) string {
+	if rt.TemplateHash != templateHash {
+		// The members of the old content are replaced gradually, see ReplaceStaleMembers
+		if len(rt.TemplateHash) > 0 {
+			rt.PrevPoolKey = MakePoolKey(rt.ResourceId, rt.ResourcePath, rt.TemplateHash)
+			logs.Info("BindCoursePoolKey, template changed, courseId: ", rt.CourseId, ", previous pool: ", rt.PrevPoolKey)
+		}
+		rt.TemplateHash = templateHash
+		rt.UpdateTime = common.GetCurTime()
+		upErr := models.UpdateResourceTempathRel(rt, "TemplateHash", "PrevPoolKey", "UpdateTime")
+		if upErr != nil {
+			logs.Error("BindCoursePoolKey, upErr: ", upErr)
+		}
+	}
+	key := MakePoolKey(rt.ResourceId, rt.ResourcePath, templateHash)
+	CoursePoolVar.SetCourseKey(rt.CourseId, rt.ResourceId, key, rt.ResReserveSize)
+	return key
+}
+
+// LoadPoolKey downloads the template of a course and binds the course to its pool
+func LoadPoolKey(rt *models.ResourceTempathRel) (string, error) {
+	yamlDir := beego.AppConfig.DefaultString("template::local_dir", "template")
+	downLock.Lock()
+	downErr, localPath := DownLoadTemplate(yamlDir, rt.ResourcePath)
+	downLock.Unlock()
+	if downErr != nil {
+		logs.Error("File download failed, path: ", rt.ResourcePath)
+		return "", downErr
+	}
+	defer DeleteFile(localPath)
+	return BindCoursePoolKey(rt, TemplateFileHash(localPath)), nil
 }
 
 func InitPoolTmplPrarse(rtp *InitTmplResource, rd *ResourceData, cr *CourseResources) {
@@ -98,8 +371,9 @@ func InitPoolTmplPrarse(rtp *InitTmplResource, rd *ResourceData, cr *CourseResou
 	rtp.UserId = "default"
 	resName = "res" + common.EncryptMd5(resName)
 	cr.UserId = rtp.UserId
-	cr.CourseId = rd.CourseId
 	cr.ResourceName = ResName(rd.EnvResource)
+	cr.PoolKey = rd.PoolKey
+	cr.TemplateHash = rd.TemplateHash
 	rtp.Name = resName
 	rd.ResourceName = resName
 	subDomain := resName + rd.EnvResource + common.RandomString(32)
@@ -120,64 +394,11 @@ func PoolParseTmpl(yamlDir string, rd *ResourceData, localPath string) []byte {
 	rtp := InitTmplResource{ContactEmail: contactEmail}
 	cr := CourseResources{}
 	InitPoolTmplPrarse(&rtp, rd, &cr)
-	var templates *template.Template
-	var allFiles []string
-	files, dirErr := ioutil.ReadDir(yamlDir)
-	if dirErr != nil {
-		logs.Error("dirErr: ", dirErr)
-		return []byte{}
-	}
-	tmpLocalPath := localPath
-	localPath = strings.ReplaceAll(localPath, "\\", "/")
-	fileName := path.Base(localPath)
-	for _, file := range files {
-		pFileName := file.Name()
-		if fileName == pFileName {
-			fullPath := filepath.Join(yamlDir, pFileName)
-			allFiles = append(allFiles, fullPath)
-		}
-	}
-	logs.Info("allFiles: ", allFiles)
-	tempErr := error(nil)
-	templates, tempErr = template.ParseFiles(allFiles...)
-	if tempErr != nil {
-		logs.Error("tempErr: ", tempErr)
-		return []byte{}
-	}
-	defer common.DelFile(allFiles)
-	s1 := templates.Lookup(fileName)
-	if s1 == nil {
-		logs.Error("fileName is nil")
-		return []byte{}
-	}
-	preFileName := common.GetRandomString(8)
-	outFileName := preFileName + "-" + rtp.Name + ".yaml"
-	outPutPath := filepath.Join(yamlDir, outFileName)
-	f, ferr := os.Create(outPutPath)
-	if ferr != nil {
-		logs.Error("ferr: ", ferr)
-		return []byte{}
-	}
-	exErr := s1.Execute(f, rtp)
-	if exErr != nil {
-		f.Close()
-		logs.Error("exErr: ", exErr)
-		return []byte{}
-	}
-	f.Close()
-	content, fErr := common.ReadAll(outPutPath)
-	if fErr != nil {
-		logs.Error("common.ReadAll, fErr: ", fErr)
+	content, err := RenderTmpl(yamlDir, localPath, rtp, &cr)
+	if err != nil {
+		logs.Error("PoolParseTmpl, err: ", err)
 		return []byte{}
 	}
-	content = AddAnnotations(content, &cr)
-	if common.FileExists(outPutPath) {
-		DeleteFile(outPutPath)
-	}
-	if common.FileExists(tmpLocalPath) {
-		DeleteFile(tmpLocalPath)
-	}
-	//UnstructuredYaml(content)
 	return content
 }
 
@@ -207,13 +428,18 @@ func CreateSingleRes(yamlData []byte, rd *ResourceData) error {
 		logs.Error("yaml1.Unmarshal, err: ", err)
 		return err
 	}
-	coursePool, _ := CoursePoolVar.Get(rd.CourseId)
-	if len(coursePool) >= rd.ResPoolSize {
+	err = EnforceTemplatePolicy(yamlData, CourseData{ResourceId: rd.ResourceId,
+		CourseId: rd.CourseId, ResName: obj.GetName()})
+	if err != nil {
+		return err
+	}
+	freeNum := CoursePoolVar.Free(rd.PoolKey)
+	if freeNum >= CoursePoolVar.Size(rd.PoolKey) {
 		logs.Info("The current resources are sufficient and there is "+
-			"no need to create new resources, len(coursePool): ", len(coursePool), ",CourseId: ", rd.CourseId)
-		return errors.New("too many resources")
+			"no need to create new resources, free: ", freeNum, ",PoolKey: ", rd.PoolKey)
+		return ErrPoolFull
 	}
-	logs.Info("To start creating a resource, the resource name:", obj.GetName(), ",len(coursePool) = ", len(coursePool))
+	logs.Info("To start creating a resource, the resource name:", obj.GetName(), ",free = ", freeNum)
 	objCreate, err = dr.Create(context.TODO(), obj, metav1.CreateOptions{})
 	if err != nil {
 		logs.Error("Create err: ", err)
@@ -238,9 +464,15 @@ func QueryResourceList(rt models.ResourceTempathRel) error {
 		logs.Error("File download failed, path: ", rt.ResourcePath)
 		return downErr
 	}
-	crs := CourseRes{CourseId: rt.CourseId, ResPoolSize: rt.ResPoolSize}
+	templateHash := TemplateFileHash(localPath)
+	poolKey := BindCoursePoolKey(&rt, templateHash)
+	// Pool sizes are only set by PlanCoursePool, a pool it has not sized yet
+	// loads every idle member found
+	poolSize := CoursePoolVar.Size(poolKey)
+	crs := CourseRes{CourseId: rt.CourseId, ResPoolSize: poolSize, PoolKey: poolKey}
 	rd := ResourceData{EnvResource: rt.ResourcePath, ResourceId: rt.ResourceId,
-		CourseId: rt.CourseId, ResPoolSize: rt.ResPoolSize}
+		CourseId: rt.CourseId, ResPoolSize: poolSize,
+		PoolKey: poolKey, TemplateHash: templateHash}
 	content := PoolParseTmpl(yamlDir, &rd, localPath)
 	// 2. Query unused instances
 	var (
@@ -248,18 +480,9 @@ func QueryResourceList(rt models.ResourceTempathRel) error {
 		gvk     *schema.GroupVersionKind
 		dr      dynamic.ResourceInterface
 	)
-	//initRes, ok := CoursePoolVar.CourseMap[rt.CourseId]
-	initRes, ok := CoursePoolVar.Get(rt.CourseId)
-	if !ok {
-		resCh := make(chan InitTmplResource, rt.ResPoolSize)
-		//CoursePoolVar.CourseMap[rt.CourseId] = resCh
-		logs.Error("QueryResourceList 0000000000000000000000000, rt: ", rt)
-		CoursePoolVar.Set(rt.CourseId, resCh)
-	} else {
-		if len(initRes) >= rt.ResPoolSize {
-			logs.Info("CourseId: ", rt.CourseId, ", loading finished: ", initRes)
-			return nil
-		}
+	if poolSize > 0 && CoursePoolVar.Free(poolKey) >= poolSize {
+		logs.Info("PoolKey: ", poolKey, ", loading finished, CourseId: ", rt.CourseId)
+		return nil
 	}
 	err := errors.New("")
 	obj := &unstructured.Unstructured{}
@@ -304,76 +527,101 @@ func CreatePoolResource(rd *ResourceData) error {
 		time.Sleep(time.Second * 1)
 		return downErr
 	}
+	// Members are always labelled with the template they were rendered from
+	rd.TemplateHash = TemplateFileHash(localPath)
+	rd.PoolKey = MakePoolKey(rd.ResourceId, rd.EnvResource, rd.TemplateHash)
+	rd.ResPoolSize = CoursePoolVar.Size(rd.PoolKey)
+	if wait := PoolBackoff(rd.PoolKey); wait > 0 {
+		return fmt.Errorf("the refill of the pool is held off for %v after failed creates", wait.Round(time.Second))
+	}
 	content := PoolParseTmpl(yamlDir, rd, localPath)
-	fmt.Println("--------------------------------CreatePoolResource:content:", string(content))
 	createErr := CreateSingleRes(content, rd)
+	if createErr == ErrPoolFull {
+		return createErr
+	}
 	if createErr != nil {
-		logs.Error("createErr: -----------------", createErr)
-		time.Sleep(time.Minute * 20)
+		wait := poolCreateFailed(rd.PoolKey)
+		logs.Error("createErr: ", createErr, ",PoolKey: ", rd.PoolKey, ", retry after: ", wait)
 		return createErr
 	}
+	poolCreateSucceeded(rd.PoolKey)
 	return nil
 }
 
 func AddResPool(courseId, resourceId, envResource string) error {
+	if !IsLeader() {
+		logs.Info("AddResPool, not the leader, skip refill, courseId: ", courseId)
+		return nil
+	}
+	if !ClusterHealthy(resourceId) {
+		logs.Info("AddResPool, the cluster is unhealthy, skip refill, resourceId: ", resourceId)
+		return nil
+	}
 	rtr := models.ResourceTempathRel{CourseId: courseId, ResourceId: resourceId, ResourcePath: envResource}
 	queryErr := models.QueryResourceTempathRel(&rtr, "CourseId", "ResourceId", "ResourcePath")
 	if queryErr != nil {
 		logs.Error("queryErr: ", queryErr)
 		return queryErr
 	}
-	rd := ResourceData{ResourceId: resourceId, EnvResource: envResource,
-		CourseId: courseId, ResPoolSize: rtr.ResPoolSize}
+	// The size is the one PlanCoursePool set for the pool
+	rd := ResourceData{ResourceId: resourceId, EnvResource: envResource, CourseId: courseId}
 	return CreatePoolResource(&rd)
 }
 
+// refillPool replaces a member taken from the pool without holding up the
+// request that took it, failed creates are held off by PoolBackoff
+func refillPool(courseId, resourceId, envResource string) {
+	go func() {
+		if err := AddResPool(courseId, resourceId, envResource); err != nil {
+			logs.Error("refillPool, err: ", err, ",courseId: ", courseId, ",resourceId: ", resourceId)
+		}
+	}()
+}
+
+// tryPoolApply takes poolApply unless a refill is running
+func tryPoolApply() bool {
+	select {
+	case poolApply <- struct{}{}:
+		return true
+	default:
+		return false
+	}
+}
+
+func donePoolApply() {
+	<-poolApply
+}
+
 func InitalResPool(rtr []models.ResourceTempathRel) {
+	poolApply <- struct{}{}
+	defer donePoolApply()
+	loadResPool(rtr)
+}
+
+// loadResPool loads the idle members that exist on the clusters and creates
+// the missing ones, the caller holds poolApply
+func loadResPool(rtr []models.ResourceTempathRel) {
 	if CoursePoolVar.InitialFlag == true {
 		logs.Info("Course resource initialization completed, data: ", CoursePoolVar.InitialFlag)
 		return
 	}
+	// 1. Load the idle instances that already exist on the clusters
 	for _, rt := range rtr {
+		if !IsLeader() {
+			logs.Info("InitalResPool, leadership lost, stop loading")
+			return
+		}
 		queryErr := QueryResourceList(rt)
 		if queryErr != nil {
 			logs.Error("QueryResourceList, queryErr: ", queryErr)
 			time.Sleep(time.Minute)
 		}
-		rd := ResourceData{ResourceId: rt.ResourceId,
-			EnvResource: rt.ResourcePath, CourseId: rt.CourseId, ResPoolSize: rt.ResPoolSize}
-		//courseId, ok := CoursePoolVar.CourseMap[rt.CourseId]
-		coursePool, ok := CoursePoolVar.Get(rt.CourseId)
-		fmt.Println(cap(coursePool), ok, "===========1===== CoursePoolVar.Get=====================")
-		if !ok || cap(coursePool) == 0 {
-			// 1. Resource does not exist, create resource
-			logs.Error("InitalResPool ,---------------------- rt: ", rt)
-			resCh := make(chan InitTmplResource, rt.ResPoolSize)
-			CoursePoolVar.Set(rt.CourseId, resCh)
-			for i := 0; i < rt.ResPoolSize; i++ {
-				err := CreatePoolResource(&rd)
-				if err != nil {
-					logs.Error("CreatePoolResource ,-------------- rt: ", err)
-					time.Sleep(time.Second)
-				}
-			}
-		} else {
-			for {
-				coursePool, _ = CoursePoolVar.Get(rt.CourseId)
-				fmt.Println(len(coursePool), "=========2======= CoursePoolVar.Get=====================", rt.ResPoolSize)
-				if len(coursePool) < rt.ResPoolSize {
-					err := CreatePoolResource(&rd)
-					if err != nil {
-						logs.Error("CreatePoolResource ,-------------------- rt: ", err)
-						time.Sleep(time.Second)
-					}
-				} else {
-					fmt.Println(len(coursePool), "=========3======:c===", rt.ResPoolSize)
-					time.Sleep(time.Second)
-					break
-				}
-			}
-		}
 	}
-	CoursePoolVar.InitialFlag = true
+	// 2. Create the missing instances
+	appErr := ApplyCoursePool(rtr)
+	if appErr != nil {
+		logs.Error("InitalResPool, appErr: ", appErr)
+	}
 }
 
 func PrintResPool() {
@@ -394,46 +642,187 @@ func InitialResourcePool() {
 		return
 	}
 	// 3. Query for available resources
-	fmt.Println("----------------InitalResPool------")
 	InitalResPool(rtr)
 	// 4. Print resource pool data
-	fmt.Println("---1-------------PrintResPool------")
 	PrintResPool()
 }
 
+// PoolPlan is the refill plan of one shared pool
+type PoolPlan struct {
+	PoolKey   string
+	Size      int
+	Reserve   int
+	AlarmSize int
+	PrevKeys  []string
+	Rd        ResourceData
+}
+
+// PlanCoursePool groups the courses by pool. A shared pool is sized for its most
+// demanding course, see CoursePoolTarget, and never below the sum of the
+// per-course reservations on clusters that take new members. The target of a course served by several clusters
+// is split across them, see ClusterPoolShare.
+func PlanCoursePool(rtr []models.ResourceTempathRel) []*PoolPlan {
+	now := time.Now()
+	planList := make([]*PoolPlan, 0)
+	planMap := make(map[string]*PoolPlan)
+	for i := range rtr {
+		rt := rtr[i]
+		poolKey, keyErr := LoadPoolKey(&rt)
+		if keyErr != nil {
+			logs.Error("PlanCoursePool, keyErr: ", keyErr, ",CourseId: ", rt.CourseId)
+			continue
+		}
+		plan, ok := planMap[poolKey]
+		if !ok {
+			plan = &PoolPlan{PoolKey: poolKey, Rd: ResourceData{ResourceId: rt.ResourceId,
+				EnvResource: rt.ResourcePath, CourseId: rt.CourseId,
+				PoolKey: poolKey, TemplateHash: rt.TemplateHash}}
+			planMap[poolKey] = plan
+			planList = append(planList, plan)
+		}
+		if target := ClusterPoolShare(rt.ResourceId, CoursePoolTarget(rt, now)); target > plan.Size {
+			plan.Size = target
+		}
+		// Retired, offline or full clusters keep no reserve either
+		if rt.ResReserveSize > 0 && ClusterPoolShare(rt.ResourceId, rt.ResReserveSize) > 0 {
+			plan.Reserve += rt.ResReserveSize
+		}
+		if rt.ResAlarmSize > plan.AlarmSize {
+			plan.AlarmSize = rt.ResAlarmSize
+		}
+		if len(rt.PrevPoolKey) > 0 && rt.PrevPoolKey != poolKey && !containsKey(plan.PrevKeys, rt.PrevPoolKey) {
+			plan.PrevKeys = append(plan.PrevKeys, rt.PrevPoolKey)
+		}
+	}
+	for _, plan := range planList {
+		if plan.Reserve > plan.Size {
+			plan.Size = plan.Reserve
+		}
+		plan.Rd.ResPoolSize = plan.Size
+	}
+	return planList
+}
+
+// PoolResClient returns the dynamic client of the cluster a pool lives on
+func PoolResClient(rd *ResourceData) (dynamic.ResourceInterface, error) {
+	yamlDir := beego.AppConfig.DefaultString("template::local_dir", "template")
+	downLock.Lock()
+	downErr, localPath := DownLoadTemplate(yamlDir, rd.EnvResource)
+	downLock.Unlock()
+	if downErr != nil {
+		logs.Error("File download failed, path: ", rd.EnvResource)
+		return nil, downErr
+	}
+	content := PoolParseTmpl(yamlDir, rd, localPath)
+	obj := &unstructured.Unstructured{}
+	_, gvk, err := yaml.NewDecodingSerializer(unstructured.UnstructuredJSONScheme).Decode(content, nil, obj)
+	if err != nil {
+		logs.Error("failed to get GVK, err: ", err)
+		return nil, err
+	}
+	return GetGVRdyClient(gvk, obj.GetNamespace(), rd.ResourceId)
+}
+
+// DeletePoolMembers deletes idle instances that were removed from a pool
+func DeletePoolMembers(rd *ResourceData, itrList []InitTmplResource) {
+	if len(itrList) == 0 {
+		return
+	}
+	dr, err := PoolResClient(rd)
+	if err != nil {
+		logs.Error("DeletePoolMembers, err: ", err)
+		return
+	}
+	for _, itr := range itrList {
+		delErr := dr.Delete(context.TODO(), itr.Name, metav1.DeleteOptions{})
+		if delErr != nil {
+			logs.Error("DeletePoolMembers, delErr: ", delErr, ",resName: ", itr.Name)
+		} else {
+			logs.Info("Idle instance deleted, resName: ", itr.Name)
+		}
+		// The member was claimed by Drain, the claim goes away with it
+		if dbErr := models.DeletePoolInstance(itr.Name); dbErr != nil {
+			logs.Error("DeletePoolMembers, dbErr: ", dbErr, ",resName: ", itr.Name)
+		}
+	}
+}
+
+// ShrinkPool deletes the idle instances above the target size of a pool
+func ShrinkPool(plan *PoolPlan) {
+	extra := CoursePoolVar.Free(plan.PoolKey) - plan.Size
+	if extra <= 0 {
+		return
+	}
+	logs.Info("ShrinkPool, PoolKey: ", plan.PoolKey, ", size: ", plan.Size, ", extra: ", extra)
+	rd := plan.Rd
+	DeletePoolMembers(&rd, CoursePoolVar.Drain(plan.PoolKey, extra))
+}
+
+func containsKey(keys []string, key string) bool {
+	for _, k := range keys {
+		if k == key {
+			return true
+		}
+	}
+	return false
+}
+
+// ReplaceStaleMembers drains the idle members of the pools a plan replaced
+// after a template change, a few per round. The idle members of the new and
+// the old pool together are kept at or above the alarm size, and bound
+// instances are never touched.
+func ReplaceStaleMembers(plan *PoolPlan) {
+	batch := beego.AppConfig.DefaultInt("courses::replace_batch", 2)
+	for _, prevKey := range plan.PrevKeys {
+		oldFree := CoursePoolVar.Free(prevKey)
+		if oldFree == 0 {
+			logs.Info("ReplaceStaleMembers, previous pool drained: ", prevKey, ", pool: ", plan.PoolKey)
+			if clErr := models.ClearPrevPoolKey(prevKey); clErr != nil {
+				logs.Error("ReplaceStaleMembers, clErr: ", clErr)
+			}
+			continue
+		}
+		n := CoursePoolVar.Free(plan.PoolKey) + oldFree - plan.AlarmSize
+		if n > oldFree {
+			n = oldFree
+		}
+		if n > batch {
+			n = batch
+		}
+		if n <= 0 {
+			continue
+		}
+		logs.Info("ReplaceStaleMembers, previous pool: ", prevKey, ", free: ", oldFree, ", replace: ", n)
+		rd := plan.Rd
+		DeletePoolMembers(&rd, CoursePoolVar.Drain(prevKey, n))
+	}
+}
+
+// ApplyCoursePool refills the pools to their plan, the caller holds poolApply
 func ApplyCoursePool(rtr []models.ResourceTempathRel) error {
-	for _, rt := range rtr {
-		rd := ResourceData{ResourceId: rt.ResourceId,
-			EnvResource: rt.ResourcePath, CourseId: rt.CourseId, ResPoolSize: rt.ResPoolSize}
-		coursePool, ok := CoursePoolVar.Get(rt.CourseId)
-		if !ok || cap(coursePool) == 0 {
-			// 1. Resource does not exist, create resource
-			logs.Error("ApplyCoursePool 1,22222222222222222222 rt: ", rt)
-			resCh := make(chan InitTmplResource, rt.ResPoolSize)
-			CoursePoolVar.Set(rt.CourseId, resCh)
-			for i := 0; i < rt.ResPoolSize; i++ {
-				CreatePoolResource(&rd)
+	for _, plan := range PlanCoursePool(rtr) {
+		if !IsLeader() {
+			logs.Info("ApplyCoursePool, leadership lost, stop refilling")
+			return nil
+		}
+		CoursePoolVar.SetSize(plan.PoolKey, plan.Size)
+		if !ClusterHealthy(plan.Rd.ResourceId) {
+			logs.Info("ApplyCoursePool, the cluster is unhealthy, skip, resourceId: ", plan.Rd.ResourceId)
+			continue
+		}
+		ShrinkPool(plan)
+		for i := 0; i < plan.Size; i++ {
+			if CoursePoolVar.Free(plan.PoolKey) >= plan.Size {
+				break
 			}
-		} else {
-			for {
-				coursePool, ok = CoursePoolVar.Get(rt.CourseId)
-				if ok {
-					if len(coursePool) < rt.ResPoolSize {
-						CreatePoolResource(&rd)
-					} else {
-						break
-					}
-				} else {
-					resCh := make(chan InitTmplResource, rt.ResPoolSize)
-					logs.Error("ApplyCoursePool 2,3333333333333333333333333333 rt: ", rt)
-					CoursePoolVar.Set(rt.CourseId, resCh)
-					for i := 0; i < rt.ResPoolSize; i++ {
-						CreatePoolResource(&rd)
-					}
-					break
-				}
+			rd := plan.Rd
+			createErr := CreatePoolResource(&rd)
+			if createErr != nil {
+				logs.Error("ApplyCoursePool, createErr: ", createErr, ",PoolKey: ", plan.PoolKey)
+				break
 			}
 		}
+		ReplaceStaleMembers(plan)
 	}
 	CoursePoolVar.InitialFlag = true
 	return nil
@@ -447,9 +836,24 @@ func ApplyCoursePoolTask() error {
 			"build initial resources, num: ", num, ",queryErr: ", queryErr)
 		return queryErr
 	}
-	// 3. Query for available resources
-	appErr := ApplyCoursePool(rtr)
-	if appErr != nil {
+	// 2. Forget the claims of instances that have been bound long ago
+	claimHours := beego.AppConfig.DefaultInt("courses::pool_claim_hours", 24)
+	before := time.Now().Add(-time.Duration(claimHours) * time.Hour).Format(common.DATE_T_Z_FORMAT)
+	delNum, delErr := models.DeleteClaimedPoolInstance(before)
+	if delErr != nil {
+		logs.Error("DeleteClaimedPoolInstance, delErr: ", delErr)
+	} else if delNum > 0 {
+		logs.Info("Stale pool claims removed, num: ", delNum)
+	}
+	// 3. Query for available resources, pools never loaded from the clusters are loaded first
+	if !tryPoolApply() {
+		logs.Info("ApplyCoursePoolTask, a refill is running, skip")
+		return nil
+	}
+	defer donePoolApply()
+	if !CoursePoolVar.InitialFlag {
+		loadResPool(rtr)
+	} else if appErr := ApplyCoursePool(rtr); appErr != nil {
 		logs.Error("appErr: ", appErr)
 		return appErr
 	}
@@ -0,0 +1,243 @@
+package handler
+
+import (
+	"encoding/json"
+	"math"
+	"playground_backend/common"
+	"playground_backend/models"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/astaxie/beego"
+	"github.com/astaxie/beego/logs"
+)
+
+type PoolSizeConfig struct {
+	Enable        bool
+	MinSize       int
+	MaxSize       int
+	HistoryDays   int
+	WindowMinutes int
+	LeadMinutes   int
+	CoolOff       int64
+	CacheMinutes  int
+	CalendarFile  string
+}
+
+// PoolCalendarEvent is a workshop or class in the pool calendar. One-off events
+// use Start and End, weekly events use Weekdays with StartTime and EndTime.
+type PoolCalendarEvent struct {
+	Name      string `json:"name"`
+	CourseId  string `json:"courseId"`
+	PoolSize  int    `json:"poolSize"`
+	Start     string `json:"start"`
+	End       string `json:"end"`
+	Weekdays  []int  `json:"weekdays"`
+	StartTime string `json:"startTime"`
+	EndTime   string `json:"endTime"`
+}
+
+type demandStatistics struct {
+	lock      sync.Mutex
+	loadTime  time.Time
+	weeks     int
+	courseMap map[string][]int
+}
+
+type poolSizeState struct {
+	Size      int
+	RaiseTime time.Time
+}
+
+var demandStat = demandStatistics{}
+var poolSizeLock sync.Mutex
+var poolSizeMap = make(map[string]poolSizeState)
+
+func GetPoolSizeConfig() PoolSizeConfig {
+	psc := PoolSizeConfig{}
+	enable, err := beego.AppConfig.Int("poolsize::enable")
+	psc.Enable = err == nil && enable == 1
+	psc.MinSize = beego.AppConfig.DefaultInt("poolsize::min_size", 1)
+	psc.MaxSize = beego.AppConfig.DefaultInt("poolsize::max_size", 20)
+	psc.HistoryDays = beego.AppConfig.DefaultInt("poolsize::history_days", 14)
+	psc.WindowMinutes = beego.AppConfig.DefaultInt("poolsize::window_minutes", 60)
+	psc.LeadMinutes = beego.AppConfig.DefaultInt("poolsize::lead_minutes", 30)
+	psc.CoolOff = beego.AppConfig.DefaultInt64("poolsize::scale_down_cooloff", 1800)
+	psc.CacheMinutes = beego.AppConfig.DefaultInt("poolsize::cache_minutes", 30)
+	psc.CalendarFile = beego.AppConfig.DefaultString("poolsize::calendar_file", "conf/pool_calendar.json")
+	if psc.HistoryDays < 1 {
+		psc.HistoryDays = 1
+	}
+	if psc.WindowMinutes < 1 {
+		psc.WindowMinutes = 60
+	}
+	return psc
+}
+
+// weekSlot maps a time to its slot of the week, one slot per window
+func weekSlot(t time.Time, windowMinutes int) int {
+	minutes := int(t.Weekday())*24*60 + t.Hour()*60 + t.Minute()
+	return minutes / windowMinutes
+}
+
+// LoadDemandHistory counts the instance applications of every course per
+// week slot over the configured history days. The applications are read from
+// the environments of the learners, which every replica shares, an
+// environment counts once at the time it was last applied for.
+func LoadDemandHistory(psc PoolSizeConfig, now time.Time) (map[string][]int, int) {
+	since := now.AddDate(0, 0, -psc.HistoryDays)
+	ureList, queryErr := models.QueryUserResourceEnvSince(since.Format(common.DATE_T_Z_FORMAT))
+	if queryErr != nil {
+		logs.Error("LoadDemandHistory, queryErr: ", queryErr)
+	}
+	weeks := int(math.Ceil(float64(psc.HistoryDays) / 7))
+	if weeks < 1 {
+		weeks = 1
+	}
+	return countDemand(ureList, since, now, psc.WindowMinutes), weeks
+}
+
+// countDemand adds each environment to the week slot it was last applied in
+func countDemand(ureList []models.UserResourceEnv, since, now time.Time, windowMinutes int) map[string][]int {
+	slotNum := 7*24*60/windowMinutes + 1
+	courseMap := make(map[string][]int)
+	for _, ure := range ureList {
+		applyTime := ure.UpdateTime
+		if len(applyTime) == 0 {
+			applyTime = ure.CreateTime
+		}
+		opTime, tErr := time.ParseInLocation(common.DATE_T_Z_FORMAT, applyTime, time.Local)
+		if tErr != nil || len(ure.CourseId) < 1 || opTime.Before(since) || opTime.After(now) {
+			continue
+		}
+		slots, ok := courseMap[ure.CourseId]
+		if !ok {
+			slots = make([]int, slotNum)
+			courseMap[ure.CourseId] = slots
+		}
+		slots[weekSlot(opTime, windowMinutes)]++
+	}
+	return courseMap
+}
+
+// HistoricalDemand returns the average number of applications a course saw in
+// the same week slot as t, the history is reloaded every cache_minutes
+func HistoricalDemand(psc PoolSizeConfig, courseId string, t time.Time) int {
+	demandStat.lock.Lock()
+	defer demandStat.lock.Unlock()
+	now := time.Now()
+	if demandStat.courseMap == nil || now.Sub(demandStat.loadTime) > time.Duration(psc.CacheMinutes)*time.Minute {
+		demandStat.courseMap, demandStat.weeks = LoadDemandHistory(psc, now)
+		demandStat.loadTime = now
+	}
+	slots, ok := demandStat.courseMap[courseId]
+	if !ok {
+		return 0
+	}
+	count := slots[weekSlot(t, psc.WindowMinutes)]
+	return int(math.Ceil(float64(count) / float64(demandStat.weeks)))
+}
+
+func LoadPoolCalendar(calendarFile string) []PoolCalendarEvent {
+	events := make([]PoolCalendarEvent, 0)
+	if !common.FileExists(calendarFile) {
+		return events
+	}
+	content, fErr := common.ReadAll(calendarFile)
+	if fErr != nil {
+		logs.Error("LoadPoolCalendar, fErr: ", fErr)
+		return events
+	}
+	jsErr := json.Unmarshal(content, &events)
+	if jsErr != nil {
+		logs.Error("LoadPoolCalendar, jsErr: ", jsErr, ",calendarFile: ", calendarFile)
+	}
+	return events
+}
+
+func clockOn(t time.Time, clock string) (time.Time, bool) {
+	ct, err := time.ParseInLocation("15:04", clock, time.Local)
+	if err != nil {
+		return t, false
+	}
+	return time.Date(t.Year(), t.Month(), t.Day(), ct.Hour(), ct.Minute(), 0, 0, time.Local), true
+}
+
+// Active reports whether an event overlaps [from, to]
+func (e PoolCalendarEvent) Active(from, to time.Time) bool {
+	if len(e.Weekdays) == 0 {
+		start := common.LocalTimeToUTC(strings.TrimSuffix(e.Start, "Z"))
+		end := common.LocalTimeToUTC(strings.TrimSuffix(e.End, "Z"))
+		return !start.IsZero() && !end.IsZero() && start.Before(to) && end.After(from)
+	}
+	// Check the days the window touches, a window never spans more than two days
+	for _, day := range []time.Time{from, to} {
+		for _, wd := range e.Weekdays {
+			if int(day.Weekday()) != wd {
+				continue
+			}
+			start, ok1 := clockOn(day, e.StartTime)
+			end, ok2 := clockOn(day, e.EndTime)
+			if ok1 && ok2 && start.Before(to) && end.After(from) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// ScheduledSize returns the largest pool size requested by calendar events of
+// a course that are running now or start within the lead time
+func ScheduledSize(psc PoolSizeConfig, courseId string, now time.Time) int {
+	size := 0
+	to := now.Add(time.Duration(psc.LeadMinutes) * time.Minute)
+	for _, event := range LoadPoolCalendar(psc.CalendarFile) {
+		if event.CourseId != courseId {
+			continue
+		}
+		if event.Active(now, to) && event.PoolSize > size {
+			size = event.PoolSize
+		}
+	}
+	return size
+}
+
+// CoursePoolTarget computes the pool size of a course for the current time
+// window. Without poolsize::enable the static ResPoolSize is used. Growing is
+// applied at once, shrinking waits for the scale-down cool-off.
+func CoursePoolTarget(rt models.ResourceTempathRel, now time.Time) int {
+	psc := GetPoolSizeConfig()
+	if !psc.Enable {
+		return rt.ResPoolSize
+	}
+	lead := now.Add(time.Duration(psc.LeadMinutes) * time.Minute)
+	target := HistoricalDemand(psc, rt.CourseId, now)
+	if demand := HistoricalDemand(psc, rt.CourseId, lead); demand > target {
+		target = demand
+	}
+	if scheduled := ScheduledSize(psc, rt.CourseId, now); scheduled > target {
+		target = scheduled
+	}
+	if target < psc.MinSize {
+		target = psc.MinSize
+	}
+	if psc.MaxSize > 0 && target > psc.MaxSize {
+		target = psc.MaxSize
+	}
+	poolSizeLock.Lock()
+	defer poolSizeLock.Unlock()
+	state, ok := poolSizeMap[rt.CourseId]
+	if !ok || target > state.Size {
+		poolSizeMap[rt.CourseId] = poolSizeState{Size: target, RaiseTime: now}
+		return target
+	}
+	if target < state.Size && now.Sub(state.RaiseTime) < time.Duration(psc.CoolOff)*time.Second {
+		return state.Size
+	}
+	if target != state.Size {
+		logs.Info("CoursePoolTarget, courseId: ", rt.CourseId, ", pool size: ", state.Size, "=>", target)
+		poolSizeMap[rt.CourseId] = poolSizeState{Size: target, RaiseTime: state.RaiseTime}
+	}
+	return target
+}
@@ -0,0 +1,184 @@
+package handler
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"path/filepath"
+	"playground_backend/models"
+	"testing"
+	"time"
+
+	"github.com/astaxie/beego"
+)
+
+// 2024-01-01 is a Monday
+func monday(hour, minute int) time.Time {
+	return time.Date(2024, 1, 1, hour, minute, 0, 0, time.Local)
+}
+
+func TestPoolCalendarEventActive(t *testing.T) {
+	cases := []struct {
+		name     string
+		event    PoolCalendarEvent
+		from, to time.Time
+		want     bool
+	}{
+		{"one-off overlapping", PoolCalendarEvent{Start: "2024-01-01 09:00:00", End: "2024-01-01 11:00:00"},
+			monday(10, 0), monday(10, 30), true},
+		{"one-off starting within the window", PoolCalendarEvent{Start: "2024-01-01T10:20:00Z", End: "2024-01-01T12:00:00Z"},
+			monday(10, 0), monday(10, 30), true},
+		{"one-off over", PoolCalendarEvent{Start: "2024-01-01 08:00:00", End: "2024-01-01 09:00:00"},
+			monday(10, 0), monday(10, 30), false},
+		{"one-off without an end", PoolCalendarEvent{Start: "2024-01-01 09:00:00"},
+			monday(10, 0), monday(10, 30), false},
+		{"weekly on the day", PoolCalendarEvent{Weekdays: []int{1}, StartTime: "09:00", EndTime: "11:00"},
+			monday(10, 0), monday(10, 30), true},
+		{"weekly on another day", PoolCalendarEvent{Weekdays: []int{2, 3}, StartTime: "09:00", EndTime: "11:00"},
+			monday(10, 0), monday(10, 30), false},
+		{"weekly later that day", PoolCalendarEvent{Weekdays: []int{1}, StartTime: "14:00", EndTime: "16:00"},
+			monday(10, 0), monday(10, 30), false},
+		{"weekly after midnight", PoolCalendarEvent{Weekdays: []int{2}, StartTime: "00:00", EndTime: "01:00"},
+			monday(23, 30), monday(23, 30).Add(time.Hour), true},
+		{"weekly with a bad clock", PoolCalendarEvent{Weekdays: []int{1}, StartTime: "9am", EndTime: "11:00"},
+			monday(10, 0), monday(10, 30), false},
+	}
+	for _, c := range cases {
+		if got := c.event.Active(c.from, c.to); got != c.want {
+			t.Errorf("%s: Active() = %v, want %v", c.name, got, c.want)
+		}
+	}
+}
+
+func TestCountDemand(t *testing.T) {
+	now := monday(12, 0)
+	since := now.AddDate(0, 0, -7)
+	ureList := []models.UserResourceEnv{
+		{CourseId: "c1", CreateTime: "2024-01-01T10:05:00Z"},
+		{CourseId: "c1", CreateTime: "2023-12-20T10:00:00Z", UpdateTime: "2024-01-01T10:40:00Z"},
+		{CourseId: "c1", CreateTime: "2024-01-01T11:10:00Z"},
+		{CourseId: "c2", CreateTime: "2024-01-01T10:00:00Z", UpdateTime: "2024-01-01T13:00:00Z"},
+		{CourseId: "c2", CreateTime: "2023-12-01T10:00:00Z"},
+		{CourseId: "", CreateTime: "2024-01-01T10:00:00Z"},
+		{CourseId: "c3", CreateTime: "yesterday"},
+	}
+	courseMap := countDemand(ureList, since, now, 60)
+	cases := []struct {
+		courseId string
+		at       time.Time
+		want     int
+	}{
+		{"c1", monday(10, 0), 2},
+		{"c1", monday(11, 0), 1},
+		{"c1", monday(9, 0), 0},
+		{"c2", monday(10, 0), 0},
+		{"c2", monday(13, 0), 0},
+	}
+	for _, c := range cases {
+		got := 0
+		if slots, ok := courseMap[c.courseId]; ok {
+			got = slots[weekSlot(c.at, 60)]
+		}
+		if got != c.want {
+			t.Errorf("courseId %s at %s: demand = %d, want %d", c.courseId, c.at.Format("15:04"), got, c.want)
+		}
+	}
+	for _, courseId := range []string{"c2", "c3", ""} {
+		if _, ok := courseMap[courseId]; ok {
+			t.Errorf("courseId %q: counted, want no demand", courseId)
+		}
+	}
+}
+
+func setPoolSizeConfig(t *testing.T, calendar []PoolCalendarEvent, demand map[string][]int) {
+	content, _ := json.Marshal(calendar)
+	calendarFile := filepath.Join(t.TempDir(), "pool_calendar.json")
+	if err := ioutil.WriteFile(calendarFile, content, 0644); err != nil {
+		t.Fatal(err)
+	}
+	for key, value := range map[string]string{
+		"poolsize::enable": "1", "poolsize::min_size": "1", "poolsize::max_size": "20",
+		"poolsize::history_days": "14", "poolsize::window_minutes": "60",
+		"poolsize::lead_minutes": "30", "poolsize::scale_down_cooloff": "1800",
+		"poolsize::calendar_file": calendarFile,
+	} {
+		beego.AppConfig.Set(key, value)
+	}
+	demandStat.lock.Lock()
+	demandStat.courseMap, demandStat.weeks, demandStat.loadTime = demand, 2, time.Now()
+	demandStat.lock.Unlock()
+	poolSizeLock.Lock()
+	poolSizeMap = make(map[string]poolSizeState)
+	poolSizeLock.Unlock()
+}
+
+func demandSlots(counts map[time.Time]int) []int {
+	slots := make([]int, 7*24+1)
+	for at, count := range counts {
+		slots[weekSlot(at, 60)] = count
+	}
+	return slots
+}
+
+func TestCoursePoolTarget(t *testing.T) {
+	now := monday(10, 40)
+	calendar := []PoolCalendarEvent{
+		{CourseId: "workshop", PoolSize: 12, Weekdays: []int{1}, StartTime: "11:00", EndTime: "12:00"},
+		{CourseId: "later", PoolSize: 12, Weekdays: []int{1}, StartTime: "15:00", EndTime: "16:00"},
+		{CourseId: "huge", PoolSize: 50, Start: "2024-01-01 09:00:00", End: "2024-01-01 11:00:00"},
+	}
+	demand := map[string][]int{
+		"busy":     demandSlots(map[time.Time]int{monday(10, 0): 9}),
+		"rising":   demandSlots(map[time.Time]int{monday(10, 0): 2, monday(11, 0): 8}),
+		"workshop": demandSlots(map[time.Time]int{monday(10, 0): 4}),
+	}
+	cases := []struct {
+		name   string
+		enable string
+		rt     models.ResourceTempathRel
+		want   int
+	}{
+		{"static size when disabled", "0", models.ResourceTempathRel{CourseId: "busy", ResPoolSize: 3}, 3},
+		{"averaged demand of the slot", "1", models.ResourceTempathRel{CourseId: "busy", ResPoolSize: 3}, 5},
+		{"demand of the slot within the lead time", "1", models.ResourceTempathRel{CourseId: "rising"}, 4},
+		{"calendar event starting within the lead time", "1", models.ResourceTempathRel{CourseId: "workshop"}, 12},
+		{"calendar event after the lead time", "1", models.ResourceTempathRel{CourseId: "later"}, 1},
+		{"capped at the max size", "1", models.ResourceTempathRel{CourseId: "huge"}, 20},
+		{"min size without demand", "1", models.ResourceTempathRel{CourseId: "quiet"}, 1},
+	}
+	for _, c := range cases {
+		setPoolSizeConfig(t, calendar, demand)
+		beego.AppConfig.Set("poolsize::enable", c.enable)
+		if got := CoursePoolTarget(c.rt, now); got != c.want {
+			t.Errorf("%s: CoursePoolTarget() = %d, want %d", c.name, got, c.want)
+		}
+	}
+	beego.AppConfig.Set("poolsize::enable", "0")
+}
+
+func TestCoursePoolTargetCoolOff(t *testing.T) {
+	now := monday(10, 0)
+	setPoolSizeConfig(t, nil, map[string][]int{
+		"course": demandSlots(map[time.Time]int{monday(10, 0): 16}),
+	})
+	defer beego.AppConfig.Set("poolsize::enable", "0")
+	rt := models.ResourceTempathRel{CourseId: "course"}
+	if got := CoursePoolTarget(rt, now); got != 8 {
+		t.Fatalf("CoursePoolTarget() = %d, want 8", got)
+	}
+	demandStat.lock.Lock()
+	demandStat.courseMap = map[string][]int{}
+	demandStat.lock.Unlock()
+	steps := []struct {
+		after time.Duration
+		want  int
+	}{
+		{10 * time.Minute, 8},
+		{29 * time.Minute, 8},
+		{31 * time.Minute, 1},
+	}
+	for _, s := range steps {
+		if got := CoursePoolTarget(rt, now.Add(s.after)); got != s.want {
+			t.Errorf("after %s: CoursePoolTarget() = %d, want %d", s.after, got, s.want)
+		}
+	}
+}
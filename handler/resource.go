@@ -32,7 +32,6 @@ import (
 	"k8s.io/client-go/dynamic"
 	"k8s.io/client-go/rest"
 	"k8s.io/client-go/restmapper"
-	"k8s.io/client-go/tools/clientcmd"
 )
 
 var downLock sync.Mutex
@@ -74,6 +73,9 @@ type ResResourceInfo struct {
 	UserResId  int64     `json:"userResId"`
 	CourseId   string    `json:"courseId"`
 	ChapterId  string    `json:"chapterId"`
+	// Set while the instance of an offline course waits to be deleted
+	TeardownSecond int64  `json:"teardownSecond,omitempty"`
+	Warning        string `json:"warning,omitempty"`
 }
 
 type ExcelFileInfo struct {
@@ -92,6 +94,7 @@ type ReqResource struct {
 	ResourceId   string
 	CourseId     string
 	ChapterId    string
+	Region       string
 }
 
 type ResListStatus struct {
@@ -113,6 +116,7 @@ type ResListStatus struct {
 type CourseRes struct {
 	CourseId    string
 	ResPoolSize int
+	PoolKey     string
 }
 
 func DeleteFile(filePath string) {
@@ -126,6 +130,8 @@ type CourseResources struct {
 	ResourceName string `yaml:"resourcename"`
 	UserId       string `yaml:"userid"`
 	LoginName    string `yaml:"loginname"`
+	PoolKey      string `yaml:"poolkey"`
+	TemplateHash string `yaml:"templatehash"`
 }
 
 func PrintJsonStr(obj *unstructured.Unstructured) {
@@ -147,50 +153,44 @@ func PrintJsonList(obj *unstructured.UnstructuredList) {
 }
 
 func GetResConfig(resourceId string) (resConfig *rest.Config, err error) {
-	configPath := beego.AppConfig.String("template::local_dir")
-	common.CreateDir(configPath)
 	rcp := models.ResourceConfigPath{ResourceId: resourceId}
 	rcpErr := models.QueryResourceConfigPath(&rcp, "ResourceId")
 	if rcpErr != nil {
 		logs.Error("rcpErr: ", rcpErr)
-		return resConfig, err
+		return resConfig, rcpErr
 	}
-	fileName := common.EncryptMd5(rcp.ResourceContent) + ".json"
-	filePath := filepath.Join(configPath, fileName)
-	if common.FileExists(filePath) {
-		DeleteFile(filePath)
-	}
-	f, ferr := os.Create(filePath)
-	if ferr != nil {
-		logs.Error(ferr)
-		return resConfig, ferr
-	}
-	defer DeleteFile(filePath)
-	defer f.Close()
-	data, baseErr := base64.StdEncoding.DecodeString(rcp.ResourceContent)
-	if baseErr == nil {
-		strContent := common.DesString(string(data))
-		// fmt.Println("----------------GetResConfig 解密后:", string(strContent))
-		f.Write(strContent)
-	} else {
-		logs.Error("+++++++++++++++++", baseErr)
-		return resConfig, baseErr
+	var plaintext []byte
+	if CredentialTypeOf(rcp.CredentialType) != CredentialInCluster {
+		plaintext, err = DecryptResourceContent(rcp.ResourceContent)
+		if err != nil {
+			logs.Error("DecryptResourceContent, err: ", err, ",resourceId: ", resourceId)
+			return
+		}
 	}
-	resConfig, err = clientcmd.BuildConfigFromFlags("", filePath)
+	resConfig, err = BuildResConfig(rcp.CredentialType, plaintext)
 	if err != nil {
-		logs.Error("BuildConfigFromFlags, err: ", err)
+		logs.Error("BuildResConfig, err: ", err, ",resourceId: ", resourceId)
 		return
 	}
 	return
 }
 
 func ResName(tplPath string) string {
+	// Instance names do not change with the template version
+	tplPath = TemplateName(tplPath)
 	filesuffix := path.Ext(tplPath)
 	tplPath = tplPath[0:(len(tplPath) - len(filesuffix))]
 	pathSub := strings.ReplaceAll(tplPath, "/", "-")
 	return pathSub
 }
 
+// UserResName returns the name of the instance record of a user for a course
+// on a cluster, see models.ResourceInfo
+func UserResName(courseId, resourceId, envResource string, userId int64) string {
+	return "resources-" + courseId + "-" + resourceId + "-" +
+		ResName(envResource) + "-" + strconv.FormatInt(userId, 10)
+}
+
 func RetUserName(userInfo models.AuthUserInfo) (userName string) {
 	if len(userInfo.Name) > 0 {
 		userName = userInfo.Name
@@ -215,8 +215,7 @@ func QueryTmpData(rtp *ReqTmplParase, rr ReqResource, cr *CourseResources, itr *
 	cr.CourseId = rr.CourseId
 	cr.LoginName = RetUserName(userInfo)
 	resourceName := ResName(rr.EnvResource)
-	resName := "resources-" + rr.CourseId + "-" + rr.ResourceId + "-" +
-		resourceName + "-" + strconv.FormatInt(rr.UserId, 10)
+	resName := UserResName(rr.CourseId, rr.ResourceId, rr.EnvResource, rr.UserId)
 	resAlias := ""
 	eoi := models.ResourceInfo{ResourceName: resName}
 	queryErr := models.QueryResourceInfo(&eoi, "ResourceName")
@@ -270,9 +269,7 @@ func InitReqTmplPrarse(rtp *ReqTmplParase, rr ReqResource, cr *CourseResources,
 		return
 	}
 	cr.LoginName = RetUserName(userInfo)
-	resourceName := ResName(rr.EnvResource)
-	resName := "resources-" + rr.CourseId + "-" + rr.ResourceId + "-" +
-		resourceName + "-" + strconv.FormatInt(rr.UserId, 10)
+	resName := UserResName(rr.CourseId, rr.ResourceId, rr.EnvResource, rr.UserId)
 	resAlias := itr.Name
 	cr.UserId = strconv.FormatInt(rr.UserId, 10)
 	cr.CourseId = rr.CourseId
@@ -294,12 +291,14 @@ func InitReqTmplPrarse(rtp *ReqTmplParase, rr ReqResource, cr *CourseResources,
 		eoi.ResourceAlias = resAlias
 		eoi.UserName = nameList[0]
 		eoi.PassWord = nameList[1]
-		models.UpdateResourceInfo(&eoi, "UserId", "UpdateTime", "subDomain", "ResourceAlias", "UserName", "passWord")
+		eoi.ResourceId = rr.ResourceId
+		models.UpdateResourceInfo(&eoi, "UserId", "UpdateTime", "subDomain", "ResourceAlias", "UserName", "passWord", "ResourceId")
 	} else {
 		logs.Info("queryErr: ", queryErr)
 		eoi.ResourceName = resName
 		eoi.ResourceAlias = resAlias
 		eoi.UserId = rr.UserId
+		eoi.ResourceId = rr.ResourceId
 		eoi.CreateTime = common.GetCurTime()
 		eoi.CompleteTime = 0
 		rtp.Subdomain = subDomain
@@ -325,13 +324,23 @@ func ParseTmpl(yamlDir string, rr ReqResource, localPath string, itr *InitTmplRe
 		InitReqTmplPrarse(&rtp, rr, cr, itr)
 	}
 	logs.Error(queryFlag, "----------------: ", cr)
+	content, err := RenderTmpl(yamlDir, localPath, rtp, cr)
+	if err != nil {
+		logs.Error("ParseTmpl, err: ", err)
+		return []byte{}
+	}
+	UnstructuredYaml(content)
+	return content
+}
 
+// RenderTmpl executes the template downloaded to localPath with data and adds
+// the course annotations. The template and the rendered file are removed.
+func RenderTmpl(yamlDir, localPath string, data interface{}, cr *CourseResources) ([]byte, error) {
 	var templates *template.Template
 	var allFiles []string
 	files, dirErr := ioutil.ReadDir(yamlDir)
 	if dirErr != nil {
-		logs.Error("dirErr: ", dirErr)
-		return []byte{}
+		return nil, dirErr
 	}
 	tmpLocalPath := localPath
 	localPath = strings.ReplaceAll(localPath, "\\", "/")
@@ -345,56 +354,44 @@ func ParseTmpl(yamlDir string, rr ReqResource, localPath string, itr *InitTmplRe
 	}
 	logs.Info("allFiles: ", allFiles)
 	if len(allFiles) == 0 {
-		return []byte{}
+		return nil, errors.New("template file not found: " + fileName)
 	}
-	tempErr := error(nil)
-	templates, tempErr = template.ParseFiles(allFiles...)
+	defer common.DelFile(allFiles)
+	templates, tempErr := template.ParseFiles(allFiles...)
 	if tempErr != nil {
-		logs.Error("tempErr: ", tempErr)
-		return []byte{}
+		return nil, tempErr
 	}
-	defer common.DelFile(allFiles)
 	s1 := templates.Lookup(fileName)
 	if s1 == nil {
-		logs.Error("fileName is nil")
-		return []byte{}
+		return nil, errors.New("template not found: " + fileName)
 	}
-	preFileName := common.GetRandomString(8)
-	outFileName := preFileName + "-" + rtp.Name + ".yaml"
-	outPutPath := filepath.Join(yamlDir, outFileName)
+	outPutPath := filepath.Join(yamlDir, common.GetRandomString(8)+"-"+fileName+".yaml")
 	f, ferr := os.Create(outPutPath)
 	if ferr != nil {
-		logs.Error("ferr: ", ferr)
-		return []byte{}
+		return nil, ferr
 	}
-	exErr := s1.Execute(f, rtp)
+	defer DeleteFile(outPutPath)
+	exErr := s1.Execute(f, data)
+	f.Close()
 	if exErr != nil {
-		f.Close()
-		logs.Error("exErr: ", exErr)
-		return []byte{}
+		return nil, exErr
 	}
-	f.Close()
 	content, fErr := common.ReadAll(outPutPath)
 	if fErr != nil {
-		logs.Error("common.ReadAll, fErr: ", fErr)
-		return []byte{}
+		return nil, fErr
 	}
 	content = AddAnnotations(content, cr)
-	if common.FileExists(outPutPath) {
-		DeleteFile(outPutPath)
-	}
 	if common.FileExists(tmpLocalPath) {
 		DeleteFile(tmpLocalPath)
 	}
-	UnstructuredYaml(content)
-	return content
+	return content, nil
 }
 
-func AddAnnotations(yamlData []byte, cr *CourseResources) []byte {
-	// Check the course duration
+// CourseRecycleSeconds returns the instance lifetime configured for a course
+func CourseRecycleSeconds(courseId string) int64 {
 	courseDur := int64(0)
-	if len(cr.CourseId) > 0 {
-		cs := models.Courses{CourseId: cr.CourseId}
+	if len(courseId) > 0 {
+		cs := models.Courses{CourseId: courseId}
 		csErr := models.QueryCourse(&cs, "CourseId")
 		if csErr == nil {
 			estInt, err := strconv.ParseInt(cs.Estimated, 10, 64)
@@ -403,6 +400,15 @@ func AddAnnotations(yamlData []byte, cr *CourseResources) []byte {
 			}
 		}
 	}
+	return courseDur
+}
+
+func AddAnnotations(yamlData []byte, cr *CourseResources) []byte {
+	// Check the course duration, shared pool members get it when they are bound
+	courseDur := int64(0)
+	if len(cr.PoolKey) < 1 {
+		courseDur = CourseRecycleSeconds(cr.CourseId)
+	}
 	yamlValue := make(map[interface{}]interface{})
 	met := make(map[interface{}]interface{}, 0)
 	spec := make(map[interface{}]interface{}, 0)
@@ -418,6 +424,10 @@ func AddAnnotations(yamlData []byte, cr *CourseResources) []byte {
 		resMap["userId"] = cr.UserId
 		resMap["resourceName"] = cr.ResourceName
 		resMap["courseId"] = cr.CourseId
+		if len(cr.PoolKey) > 0 {
+			resMap["poolKey"] = cr.PoolKey
+			resMap["templateHash"] = cr.TemplateHash
+		}
 		metadata, ok := yamlValue["metadata"]
 		if ok {
 			logs.Info("metadata: ", metadata)
@@ -446,8 +456,19 @@ func AddAnnotations(yamlData []byte, cr *CourseResources) []byte {
 
 func DownLoadTemplate(yamlDir, fPath string) (error, string) {
 	common.CreateDir(yamlDir)
-	fileName := path.Base(fPath)
 	preFileName := common.GetRandomString(8)
+	// Template versions are served from the registry
+	if name, version, ok := SplitTemplatePath(fPath); ok {
+		localPath := filepath.Join(yamlDir, preFileName+"-"+path.Base(name))
+		tr := models.TemplateRegistry{Name: name, Version: version}
+		queryErr := models.QueryTemplateRegistry(&tr, "Name", "Version")
+		if queryErr != nil {
+			logs.Error("DownLoadTemplate, queryErr: ", queryErr, ",path: ", fPath)
+			return queryErr, localPath
+		}
+		return ioutil.WriteFile(localPath, []byte(tr.Content), 0600), localPath
+	}
+	fileName := path.Base(fPath)
 	downloadUrl := beego.AppConfig.String("template::template_path")
 	localPath := filepath.Join(yamlDir, preFileName+"-"+fileName)
 	gitUrl := fmt.Sprintf(downloadUrl+"?file=%s", fPath)
@@ -707,6 +728,11 @@ func UpdateObjData(dr dynamic.ResourceInterface, cr *CourseResources, objGetData
 	if len(itr.Subdomain) > 1 {
 		spec["subdomain"] = itr.Subdomain
 	}
+	// Shared pool members only become course specific once they are bound
+	courseDur := CourseRecycleSeconds(cr.CourseId)
+	if courseDur > 0 {
+		spec["recycleAfterSeconds"] = courseDur
+	}
 	envs, ok := ParsingMapSlice(spec, "envs")
 	if !ok {
 		logs.Error("envs, does not exist")
@@ -887,6 +913,9 @@ func RecIterList(listData []unstructured.Unstructured, obj *unstructured.Unstruc
 				logs.Error("delete, err: ", delErr)
 			} else {
 				logs.Info("Data deleted successfully, resName: ", name)
+				if dbErr := models.DeletePoolInstance(name); dbErr != nil {
+					logs.Error("DeletePoolInstance, dbErr: ", dbErr)
+				}
 			}
 		}
 	}
@@ -909,35 +938,17 @@ func AddTmplResourceList(items unstructured.Unstructured, crs CourseRes) bool {
 		logs.Error("annotations, does not exist")
 		return false
 	}
-	courseId, ok := ParsingMapStr(annotations, "courseId")
-	if !ok || len(courseId) < 1 {
-		logs.Error("courseId, does not exist")
-		return false
-	}
-	if len(crs.CourseId) < 1 {
-		crs.CourseId = courseId
-	}
-	resourceName, ok := ParsingMapStr(annotations, "resourceName")
-	if !ok || len(resourceName) < 1 {
-		logs.Error("resourceName, does not exist")
-	}
-	resType := ""
-	rtr := models.ResourceTempathRel{CourseId: crs.CourseId}
-	quryErr := models.QueryResourceTempathRel(&rtr, "CourseId")
-	if quryErr == nil {
-		resType = ResName(rtr.ResourcePath)
-		if crs.ResPoolSize < 1 {
-			crs.ResPoolSize = rtr.ResPoolSize
+	poolKey, ok := ParsingMapStr(annotations, "poolKey")
+	if !ok || len(poolKey) < 1 {
+		// Members created before pools were shared only carry the course id
+		poolKey, ok = LegacyPoolKey(annotations, crs)
+		if !ok {
+			return false
 		}
 	}
-	if courseId != crs.CourseId {
+	if len(crs.PoolKey) > 0 && poolKey != crs.PoolKey {
 		return false
 	}
-	if len(resType) > 0 && len(resourceName) > 0 {
-		if resType != resourceName {
-			return false
-		}
-	}
 	spec, ok := ParsingMap(items.Object, "spec")
 	if !ok {
 		logs.Error("spec, does not exist")
@@ -974,24 +985,45 @@ func AddTmplResourceList(items unstructured.Unstructured, crs CourseRes) bool {
 			}
 		}
 	}
-	courseChan, ok := CoursePoolVar.Get(courseId)
-	if !ok {
-		courseData := make(chan InitTmplResource, crs.ResPoolSize)
-		courseData <- itr
-		CoursePoolVar.Set(courseId, courseData)
-		logs.Info("courseId: ", courseId, "----------1--------len(courseData)=", len(courseData))
-	} else {
-		if len(courseChan) >= crs.ResPoolSize {
-			logs.Error("delete data, itr:", itr)
-			return false
-		}
-		courseChan <- itr
-		CoursePoolVar.Set(courseId, courseChan)
-		logs.Info("courseId: ", courseId, "----------2--------len(courseChan)=", len(courseChan))
+	templateHash, _ := ParsingMapStr(annotations, "templateHash")
+	if !CoursePoolVar.Put(poolKey, templateHash, itr) {
+		logs.Error("delete data, itr:", itr)
+		return false
 	}
+	logs.Info("poolKey: ", poolKey, ",free: ", CoursePoolVar.Free(poolKey))
 	return true
 }
 
+// LegacyPoolKey maps a member annotated with a course id to the pool of that course
+func LegacyPoolKey(annotations map[string]interface{}, crs CourseRes) (string, bool) {
+	courseId, ok := ParsingMapStr(annotations, "courseId")
+	if !ok || len(courseId) < 1 {
+		logs.Error("courseId, does not exist")
+		return "", false
+	}
+	if len(crs.CourseId) > 0 && courseId != crs.CourseId {
+		return "", false
+	}
+	resourceName, ok := ParsingMapStr(annotations, "resourceName")
+	if !ok || len(resourceName) < 1 {
+		logs.Error("resourceName, does not exist")
+	}
+	rtr := models.ResourceTempathRel{CourseId: courseId}
+	quryErr := models.QueryResourceTempathRel(&rtr, "CourseId")
+	if quryErr != nil {
+		logs.Error("LegacyPoolKey, quryErr: ", quryErr)
+		return "", false
+	}
+	if len(resourceName) > 0 && ResName(rtr.ResourcePath) != resourceName {
+		return "", false
+	}
+	poolKey, ok := CoursePoolVar.GetCourseKey(courseId, rtr.ResourceId)
+	if !ok {
+		return "", false
+	}
+	return poolKey, true
+}
+
 func UpdateRes(rri *ResResourceInfo, objGetData *unstructured.Unstructured, dr dynamic.ResourceInterface,
 	config *YamlConfig, obj *unstructured.Unstructured,
 	objCreate *unstructured.Unstructured, cr *CourseResources, itr InitTmplResource) error {
@@ -1105,91 +1137,83 @@ func ParaseResData(resData *unstructured.Unstructured, rri *ResResourceInfo, eoi
 }
 
 func ApplyPoolInstance(yamlData []byte, rri *ResResourceInfo, rr ReqResource, yamlDir, localPath string) error {
-	if CoursePoolVar.InitialFlag {
-		courseData, ok := CoursePoolVar.Get(rr.CourseId)
-		if ok {
-			for {
-				downLock.Lock()
-				downErr, localPath := DownLoadTemplate(yamlDir, rr.EnvResource)
-				downLock.Unlock()
-				if downErr != nil {
-					logs.Error("File download failed, path: ", rr.EnvResource)
-					break
-				}
-				itr := <-courseData
-				logs.Info("Information obtained by the resource pool: ", itr)
-				itr.UserId = strconv.FormatInt(rr.UserId, 10)
-				cr := CourseResources{}
-				yamlData = ParseTmpl(yamlDir, rr, localPath, &itr, &cr, false)
-				var (
-					err       error
-					objGet    *unstructured.Unstructured
-					objCreate *unstructured.Unstructured
-					gvk       *schema.GroupVersionKind
-					dr        dynamic.ResourceInterface
-				)
-				rri.Status = 0
-				obj := &unstructured.Unstructured{}
-				_, gvk, err = yaml.NewDecodingSerializer(unstructured.UnstructuredJSONScheme).Decode(yamlData, nil, obj)
-				if err != nil {
-					logs.Error("failed to get GVK, err: ", err)
-					err = AddResPool(rr.CourseId, rr.ResourceId, rr.EnvResource)
-					if err != nil {
-						time.Sleep(time.Minute * 10)
-					}
-					break
-				}
-				dr, err = GetGVRdyClient(gvk, obj.GetNamespace(), rr.ResourceId)
-				if err != nil {
-					logs.Error("failed to get dr: ", err)
-					err = AddResPool(rr.CourseId, rr.ResourceId, rr.EnvResource)
-					if err != nil {
-						time.Sleep(time.Minute * 10)
-					}
-					break
-				}
-				// store db
-				config := new(YamlConfig)
-				err = ymV2.Unmarshal(yamlData, config)
-				if err != nil {
-					logs.Error("yaml1.Unmarshal, err: ", err)
-					err = AddResPool(rr.CourseId, rr.ResourceId, rr.EnvResource)
-					if err != nil {
-						time.Sleep(time.Minute * 10)
-					}
-					break
-				}
-				objGet, err = dr.Get(context.TODO(), obj.GetName(), metav1.GetOptions{})
-				if err != nil {
-					logs.Error("ApplyPoolInstance, dr.Get, err: ", err)
-					err = AddResPool(rr.CourseId, rr.ResourceId, rr.EnvResource)
-					if err != nil {
-						time.Sleep(time.Minute * 10)
-					}
-					continue
-				} else {
-
-					err = UpdateRes(rri, objGet, dr, config, obj, objCreate, &cr, itr)
-					if err != nil {
-						logs.Error("UpdateRes err: ", err)
-						err = AddResPool(rr.CourseId, rr.ResourceId, rr.EnvResource)
-						if err != nil {
-							time.Sleep(time.Minute * 10)
-						}
-						continue
-					}
-					err = AddResPool(rr.CourseId, rr.ResourceId, rr.EnvResource)
-					if err != nil {
-						time.Sleep(time.Minute * 10)
-					}
-					break
-				}
+	if !ClusterHealthy(rr.ResourceId) {
+		return errors.New("The cluster is unhealthy, resourceId: " + rr.ResourceId)
+	}
+	if _, ok := CoursePoolVar.GetCourseKey(rr.CourseId, rr.ResourceId); !ok {
+		return errors.New("Instance creation failed 1.courseID :" + rr.CourseId)
+	}
+	poolWait, ok := beego.AppConfig.Int64("courses::pool_wait_seconds")
+	if ok != nil {
+		poolWait = 600
+	}
+	for {
+		downLock.Lock()
+		downErr, localPath := DownLoadTemplate(yamlDir, rr.EnvResource)
+		downLock.Unlock()
+		if downErr != nil {
+			logs.Error("File download failed, path: ", rr.EnvResource)
+			break
+		}
+		itr, takeErr := CoursePoolVar.Take(rr.CourseId, rr.ResourceId, poolWait)
+		if takeErr != nil {
+			logs.Error("ApplyPoolInstance, takeErr: ", takeErr)
+			DeleteFile(localPath)
+			return takeErr
+		}
+		logs.Info("Information obtained by the resource pool: ", itr)
+		itr.UserId = strconv.FormatInt(rr.UserId, 10)
+		cr := CourseResources{}
+		yamlData = ParseTmpl(yamlDir, rr, localPath, &itr, &cr, false)
+		var (
+			err       error
+			objGet    *unstructured.Unstructured
+			objCreate *unstructured.Unstructured
+			gvk       *schema.GroupVersionKind
+			dr        dynamic.ResourceInterface
+		)
+		rri.Status = 0
+		obj := &unstructured.Unstructured{}
+		_, gvk, err = yaml.NewDecodingSerializer(unstructured.UnstructuredJSONScheme).Decode(yamlData, nil, obj)
+		if err != nil {
+			logs.Error("failed to get GVK, err: ", err)
+			refillPool(rr.CourseId, rr.ResourceId, rr.EnvResource)
+			break
+		}
+		dr, err = GetGVRdyClient(gvk, obj.GetNamespace(), rr.ResourceId)
+		if err != nil {
+			logs.Error("failed to get dr: ", err)
+			refillPool(rr.CourseId, rr.ResourceId, rr.EnvResource)
+			break
+		}
+		// store db
+		config := new(YamlConfig)
+		err = ymV2.Unmarshal(yamlData, config)
+		if err != nil {
+			logs.Error("yaml1.Unmarshal, err: ", err)
+			refillPool(rr.CourseId, rr.ResourceId, rr.EnvResource)
+			break
+		}
+		objGet, err = dr.Get(context.TODO(), obj.GetName(), metav1.GetOptions{})
+		if err != nil {
+			logs.Error("ApplyPoolInstance, dr.Get, err: ", err)
+			// The claimed member no longer exists on the cluster
+			if dbErr := models.DeletePoolInstance(itr.Name); dbErr != nil {
+				logs.Error("DeletePoolInstance, dbErr: ", dbErr)
 			}
+			refillPool(rr.CourseId, rr.ResourceId, rr.EnvResource)
+			continue
 		} else {
-			return errors.New("Instance creation failed 1.courseID :" + rr.CourseId)
+
+			err = UpdateRes(rri, objGet, dr, config, obj, objCreate, &cr, itr)
+			if err != nil {
+				logs.Error("UpdateRes err: ", err)
+				refillPool(rr.CourseId, rr.ResourceId, rr.EnvResource)
+				continue
+			}
+			refillPool(rr.CourseId, rr.ResourceId, rr.EnvResource)
+			break
 		}
-	} else {
-		return errors.New("Instance creation failed 2.courseID :" + rr.CourseId)
 	}
 	return nil
 }
@@ -1210,6 +1234,11 @@ func CreateInstance(rri *ResResourceInfo, rr ReqResource, yamlDir, localPath str
 		logs.Error("failed to get GVK, err: ", err)
 		return err
 	}
+	err = EnforceTemplatePolicy(yamlData, CourseData{ResourceId: rr.ResourceId,
+		CourseId: rr.CourseId, chapterId: rr.ChapterId, ResName: obj.GetName()})
+	if err != nil {
+		return err
+	}
 	dr, err = GetGVRdyClient(gvk, obj.GetNamespace(), rr.ResourceId)
 	if err != nil {
 		logs.Error("failed to get dr: ", err)
@@ -1373,9 +1402,7 @@ func GetEnvResource(rr ReqResource, rri *ResResourceInfo) {
 		return
 	}
 	itr := InitTmplResource{}
-	resourceName := ResName(rr.EnvResource)
-	resName := "resources-" + rr.CourseId + "-" + rr.ResourceId + "-" +
-		resourceName + "-" + strconv.FormatInt(rr.UserId, 10)
+	resName := UserResName(rr.CourseId, rr.ResourceId, rr.EnvResource, rr.UserId)
 	ri := models.ResourceInfo{ResourceName: resName}
 	queryErr := models.QueryResourceInfo(&ri, "ResourceName")
 	if queryErr != nil {
@@ -1390,6 +1417,10 @@ func GetEnvResource(rr ReqResource, rri *ResResourceInfo) {
 	cr := CourseResources{CourseId: rr.CourseId}
 	content := ParseTmpl(yamlDir, rr, localPath, &itr, &cr, true)
 	GetCreateRes(content, rri, rr.ResourceId, &cr, itr)
+	if remain, ok := TeardownWarning(itr.Name); ok {
+		rri.TeardownSecond = remain
+		rri.Warning = fmt.Sprintf("The course is offline, the environment is deleted in %d minutes", (remain+59)/60)
+	}
 }
 
 func CreateUserResourceEnv(rr ReqResource) int64 {
@@ -1482,14 +1513,15 @@ func ClearInvaildResource() error {
 		logs.Info("err: ", err, ",num: ", num)
 		return err
 	}
+	// A cluster that cannot be reached must not hold up the cleanup of the others
 	for _, rt := range rtr {
 		yamlDir := beego.AppConfig.DefaultString("template::local_dir", "template")
 		downLock.Lock()
 		downErr, localPath := DownLoadTemplate(yamlDir, rt.ResourcePath)
 		downLock.Unlock()
 		if downErr != nil {
-			logs.Error("File download failed, path: ", rt.ResourcePath)
-			return downErr
+			logs.Error("File download failed, path: ", rt.ResourcePath, ",resourceId: ", rt.ResourceId)
+			continue
 		}
 		rd := ResourceData{EnvResource: rt.ResourcePath,
 			ResourceId: rt.ResourceId, CourseId: rt.CourseId, ResPoolSize: rt.ResPoolSize}
@@ -1503,20 +1535,20 @@ func ClearInvaildResource() error {
 		obj := &unstructured.Unstructured{}
 		_, gvk, err = yaml.NewDecodingSerializer(unstructured.UnstructuredJSONScheme).Decode(content, nil, obj)
 		if err != nil {
-			logs.Error("failed to get GVK, err: ", err)
-			return err
+			logs.Error("failed to get GVK, err: ", err, ",resourceId: ", rt.ResourceId)
+			continue
 		}
 		dr, err = GetGVRdyClient(gvk, obj.GetNamespace(), rt.ResourceId)
 		if err != nil {
-			logs.Error("failed to get dr: ", err)
-			return err
+			logs.Error("failed to get dr: ", err, ",resourceId: ", rt.ResourceId)
+			continue
 		}
 		// store db
 		config := new(YamlConfig)
 		err = ymV2.Unmarshal(content, config)
 		if err != nil {
-			logs.Error("yaml1.Unmarshal, err: ", err)
-			return err
+			logs.Error("yaml1.Unmarshal, err: ", err, ",resourceId: ", rt.ResourceId)
+			continue
 		}
 		DelInvaildResource(objList, dr, config, obj)
 	}
@@ -0,0 +1,153 @@
+package handler
+
+import (
+	"errors"
+	"math"
+	"playground_backend/models"
+	"sort"
+	"time"
+
+	"github.com/astaxie/beego/logs"
+)
+
+// ClusterCandidate is a cluster considered by the scheduler
+type ClusterCandidate struct {
+	Rcp      models.ResourceConfigPath
+	Load     int
+	FreePool int
+	Score    float64
+}
+
+func clusterWeight(rcp models.ResourceConfigPath) int {
+	if rcp.Weight < 1 {
+		return 1
+	}
+	return rcp.Weight
+}
+
+// ClusterSchedulable reports whether new instances may be placed on a cluster
+func ClusterSchedulable(rcp models.ResourceConfigPath) bool {
+	return rcp.Status != models.ClusterStatusOffline && ClusterHealthy(rcp.ResourceId)
+}
+
+// clusterFull reports whether the bound instances reached the cluster capacity
+func clusterFull(rcp models.ResourceConfigPath, load int) bool {
+	return rcp.Capacity > 0 && load >= rcp.Capacity
+}
+
+// clusterScore weighs a cluster by its share of free capacity, clusters
+// without a capacity limit are weighed by their current load
+func clusterScore(rcp models.ResourceConfigPath, load int) float64 {
+	weight := float64(clusterWeight(rcp))
+	if rcp.Capacity > 0 {
+		return weight * float64(rcp.Capacity-load) / float64(rcp.Capacity)
+	}
+	return weight / float64(1+load)
+}
+
+// userClusterInstance reports whether the user still has a live instance of
+// the course on the cluster, such a user keeps being served by it
+func userClusterInstance(rr ReqResource, rcp models.ResourceConfigPath, now int64) bool {
+	if rr.UserId < 1 {
+		return false
+	}
+	eoi := models.ResourceInfo{ResourceName: UserResName(rr.CourseId, rcp.ResourceId, rcp.ResourcePath, rr.UserId)}
+	queryErr := models.QueryResourceInfo(&eoi, "ResourceName")
+	if queryErr != nil {
+		return false
+	}
+	return eoi.CompleteTime > now
+}
+
+// ScheduleCluster chooses the cluster that serves a request. A user with a live
+// instance stays on its cluster. Otherwise full clusters are skipped, clusters
+// in the requested region come first, then clusters with an idle pool member,
+// then the highest score by weight and free capacity.
+func ScheduleCluster(rr ReqResource, rcpList []models.ResourceConfigPath) (models.ResourceConfigPath, error) {
+	now := time.Now().Unix()
+	candidates := make([]ClusterCandidate, 0, len(rcpList))
+	for _, rcp := range rcpList {
+		if !ClusterSchedulable(rcp) {
+			continue
+		}
+		if userClusterInstance(rr, rcp, now) {
+			logs.Info("ScheduleCluster, sticky, userId: ", rr.UserId, ",resourceId: ", rcp.ResourceId)
+			return rcp, nil
+		}
+		load := models.CountActiveResourceInfo(rcp.ResourceId, now)
+		if clusterFull(rcp, load) {
+			logs.Info("ScheduleCluster, cluster is full, resourceId: ", rcp.ResourceId, ",load: ", load)
+			continue
+		}
+		cc := ClusterCandidate{Rcp: rcp, Load: load, Score: clusterScore(rcp, load)}
+		if len(rr.CourseId) > 0 {
+			if key, ok := CoursePoolVar.GetCourseKey(rr.CourseId, rcp.ResourceId); ok {
+				cc.FreePool = CoursePoolVar.Free(key)
+			}
+		}
+		candidates = append(candidates, cc)
+	}
+	if len(candidates) == 0 {
+		return models.ResourceConfigPath{}, errors.New("no cluster is available")
+	}
+	chosen := chooseCandidate(rr.Region, candidates)
+	logs.Info("ScheduleCluster, resourceId: ", chosen.Rcp.ResourceId, ",cluster: ", chosen.Rcp.ClusterName,
+		",load: ", chosen.Load, ",freePool: ", chosen.FreePool, ",score: ", chosen.Score)
+	return chosen.Rcp, nil
+}
+
+// chooseCandidate orders the candidates as ScheduleCluster describes and
+// returns the first one
+func chooseCandidate(region string, candidates []ClusterCandidate) ClusterCandidate {
+	sort.SliceStable(candidates, func(i, j int) bool {
+		ci, cj := candidates[i], candidates[j]
+		if len(region) > 0 && (ci.Rcp.Region == region) != (cj.Rcp.Region == region) {
+			return ci.Rcp.Region == region
+		}
+		if (ci.FreePool > 0) != (cj.FreePool > 0) {
+			return ci.FreePool > 0
+		}
+		return ci.Score > cj.Score
+	})
+	return candidates[0]
+}
+
+// ClusterPoolShare splits the pool target of a course across the clusters
+// serving its template by weight. Clusters that stopped scheduling or are
+// full keep no idle members.
+func ClusterPoolShare(resourceId string, target int) int {
+	rcp := models.ResourceConfigPath{ResourceId: resourceId}
+	queryErr := models.QueryResourceConfigPath(&rcp, "ResourceId")
+	if queryErr != nil {
+		logs.Error("ClusterPoolShare, queryErr: ", queryErr)
+		return target
+	}
+	now := time.Now().Unix()
+	rcpList, _, _ := models.QueryResourceConfigPathList(rcp.EulerBranch, rcp.ResourcePath)
+	return poolShare(rcp, rcpList, target, func(resourceId string) int {
+		return models.CountActiveResourceInfo(resourceId, now)
+	})
+}
+
+// poolShare is the part of target that falls on rcp among the clusters of
+// rcpList, load returns the bound instances of a cluster
+func poolShare(rcp models.ResourceConfigPath, rcpList []models.ResourceConfigPath, target int,
+	load func(string) int) int {
+	if !ClusterSchedulable(rcp) || clusterFull(rcp, load(rcp.ResourceId)) {
+		return 0
+	}
+	if len(rcpList) <= 1 {
+		return target
+	}
+	sumWeight := 0
+	for _, sibling := range rcpList {
+		if !ClusterSchedulable(sibling) || clusterFull(sibling, load(sibling.ResourceId)) {
+			continue
+		}
+		sumWeight += clusterWeight(sibling)
+	}
+	if sumWeight == 0 {
+		return target
+	}
+	return int(math.Ceil(float64(target*clusterWeight(rcp)) / float64(sumWeight)))
+}
@@ -0,0 +1,140 @@
+package handler
+
+import (
+	"playground_backend/models"
+	"testing"
+)
+
+func cluster(resourceId, region string, weight, capacity int) models.ResourceConfigPath {
+	return models.ResourceConfigPath{ResourceId: resourceId, Region: region, Weight: weight,
+		Capacity: capacity, Status: models.ClusterStatusOnline}
+}
+
+// markUnhealthy records failed probes for the clusters until the test ends
+func markUnhealthy(t *testing.T, resourceIds ...string) {
+	healthLock.Lock()
+	for _, resourceId := range resourceIds {
+		clusterHealthMap[resourceId] = &ClusterHealth{ResourceId: resourceId, Healthy: false}
+	}
+	healthLock.Unlock()
+	t.Cleanup(func() {
+		healthLock.Lock()
+		for _, resourceId := range resourceIds {
+			delete(clusterHealthMap, resourceId)
+		}
+		healthLock.Unlock()
+	})
+}
+
+func TestChooseCandidate(t *testing.T) {
+	cases := []struct {
+		name       string
+		region     string
+		candidates []ClusterCandidate
+		want       string
+	}{
+		{"highest score", "", []ClusterCandidate{
+			{Rcp: cluster("a", "north", 1, 10), Score: 0.2},
+			{Rcp: cluster("b", "south", 1, 10), Score: 0.8},
+		}, "b"},
+		{"requested region first", "north", []ClusterCandidate{
+			{Rcp: cluster("a", "south", 1, 10), Score: 0.9, FreePool: 3},
+			{Rcp: cluster("b", "north", 1, 10), Score: 0.1},
+		}, "b"},
+		{"idle pool member before score", "", []ClusterCandidate{
+			{Rcp: cluster("a", "north", 1, 10), Score: 0.9},
+			{Rcp: cluster("b", "north", 1, 10), Score: 0.1, FreePool: 1},
+		}, "b"},
+		{"unknown region falls back to the pool", "west", []ClusterCandidate{
+			{Rcp: cluster("a", "north", 1, 10), Score: 0.9},
+			{Rcp: cluster("b", "south", 1, 10), Score: 0.1, FreePool: 1},
+		}, "b"},
+		{"ties keep the configured order", "", []ClusterCandidate{
+			{Rcp: cluster("a", "north", 1, 10), Score: 0.5},
+			{Rcp: cluster("b", "north", 1, 10), Score: 0.5},
+		}, "a"},
+	}
+	for _, c := range cases {
+		if got := chooseCandidate(c.region, c.candidates); got.Rcp.ResourceId != c.want {
+			t.Errorf("%s: chooseCandidate() = %s, want %s", c.name, got.Rcp.ResourceId, c.want)
+		}
+	}
+}
+
+func TestClusterScore(t *testing.T) {
+	cases := []struct {
+		name string
+		rcp  models.ResourceConfigPath
+		load int
+		want float64
+		full bool
+	}{
+		{"free capacity share", cluster("a", "", 1, 10), 4, 0.6, false},
+		{"weighted", cluster("a", "", 2, 10), 5, 1, false},
+		{"no weight counts as one", cluster("a", "", 0, 10), 5, 0.5, false},
+		{"full", cluster("a", "", 1, 10), 10, 0, true},
+		{"unlimited by load", cluster("a", "", 3, 0), 2, 1, false},
+	}
+	for _, c := range cases {
+		if got := clusterScore(c.rcp, c.load); got != c.want {
+			t.Errorf("%s: clusterScore() = %v, want %v", c.name, got, c.want)
+		}
+		if got := clusterFull(c.rcp, c.load); got != c.full {
+			t.Errorf("%s: clusterFull() = %v, want %v", c.name, got, c.full)
+		}
+	}
+}
+
+func TestScheduleClusterUnavailable(t *testing.T) {
+	markUnhealthy(t, "down")
+	offline := cluster("offline", "", 1, 0)
+	offline.Status = models.ClusterStatusOffline
+	cases := []struct {
+		name    string
+		rcpList []models.ResourceConfigPath
+	}{
+		{"no clusters", nil},
+		{"offline", []models.ResourceConfigPath{offline}},
+		{"unhealthy", []models.ResourceConfigPath{cluster("down", "", 1, 0)}},
+		{"offline and unhealthy", []models.ResourceConfigPath{offline, cluster("down", "", 1, 0)}},
+	}
+	for _, c := range cases {
+		if rcp, err := ScheduleCluster(ReqResource{CourseId: "course", UserId: 1}, c.rcpList); err == nil {
+			t.Errorf("%s: ScheduleCluster() = %s, want an error", c.name, rcp.ResourceId)
+		}
+	}
+}
+
+func TestPoolShare(t *testing.T) {
+	markUnhealthy(t, "down")
+	offline := cluster("offline", "", 1, 0)
+	offline.Status = models.ClusterStatusOffline
+	loads := map[string]int{"a": 2, "b": 3, "full": 5}
+	load := func(resourceId string) int {
+		return loads[resourceId]
+	}
+	siblings := []models.ResourceConfigPath{cluster("a", "", 1, 0), cluster("b", "", 3, 0),
+		cluster("full", "", 4, 5), cluster("down", "", 4, 0), offline}
+	cases := []struct {
+		name    string
+		rcp     models.ResourceConfigPath
+		rcpList []models.ResourceConfigPath
+		target  int
+		want    int
+	}{
+		{"single cluster", cluster("a", "", 1, 0), []models.ResourceConfigPath{cluster("a", "", 1, 0)}, 7, 7},
+		{"light share rounds up", cluster("a", "", 1, 0), siblings, 10, 3},
+		{"heavy share", cluster("b", "", 3, 0), siblings, 10, 8},
+		{"zero target", cluster("b", "", 3, 0), siblings, 0, 0},
+		{"full cluster", cluster("full", "", 4, 5), siblings, 10, 0},
+		{"unhealthy cluster", cluster("down", "", 4, 0), siblings, 10, 0},
+		{"offline cluster", offline, siblings, 10, 0},
+		{"no schedulable sibling", cluster("a", "", 1, 0),
+			[]models.ResourceConfigPath{cluster("full", "", 4, 5), offline}, 6, 6},
+	}
+	for _, c := range cases {
+		if got := poolShare(c.rcp, c.rcpList, c.target, load); got != c.want {
+			t.Errorf("%s: poolShare() = %d, want %d", c.name, got, c.want)
+		}
+	}
+}
@@ -0,0 +1,207 @@
+package handler
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"playground_backend/common"
+	"playground_backend/http"
+	"strings"
+	"sync"
+
+	"github.com/astaxie/beego"
+	"github.com/astaxie/beego/logs"
+)
+
+// Kinds of course catalog sources, see courses::source
+const (
+	CourseSourceHttp = "http"
+	CourseSourceDir  = "dir"
+	CourseSourceGit  = "git"
+)
+
+// CourseSource loads the course list, the chapters of a course and the detail
+// of a chapter in the layout of the metadata API, so ParsingCourse and
+// AddCourseToDb work the same on every source
+type CourseSource interface {
+	CourseList() (map[string]interface{}, error)
+	Chapters(coursePathName string) (map[string]interface{}, error)
+	ChapterDetail(coursePathName, chapterId string) (map[string]interface{}, error)
+}
+
+// HttpCourseSource reads the catalog from the metadata API
+type HttpCourseSource struct {
+	CourseUrl        string
+	ChapterUrl       string
+	ChapterDetailUrl string
+}
+
+func (s HttpCourseSource) CourseList() (map[string]interface{}, error) {
+	return http.HTTPGitGet(s.CourseUrl)
+}
+
+func (s HttpCourseSource) Chapters(coursePathName string) (map[string]interface{}, error) {
+	return http.HTTPGitGet(fmt.Sprintf(s.ChapterUrl, coursePathName))
+}
+
+func (s HttpCourseSource) ChapterDetail(coursePathName, chapterId string) (map[string]interface{}, error) {
+	return http.HTTPGitGet(fmt.Sprintf(s.ChapterDetailUrl, coursePathName, chapterId))
+}
+
+// DirCourseSource reads the catalog from a local directory tree, the file
+// patterns are relative to Dir and use the same verbs as the urls
+type DirCourseSource struct {
+	Dir               string
+	CourseFile        string
+	ChapterFile       string
+	ChapterDetailFile string
+}
+
+// readJson reads a catalog file below the source directory, names coming
+// from the catalog cannot escape it
+func (s DirCourseSource) readJson(name string) (map[string]interface{}, error) {
+	root, absErr := filepath.Abs(s.Dir)
+	if absErr != nil {
+		return nil, absErr
+	}
+	path := filepath.Join(root, filepath.FromSlash(name))
+	if path != root && !strings.HasPrefix(path, root+string(os.PathSeparator)) {
+		return nil, errors.New("The catalog file is outside the source directory: " + name)
+	}
+	content, readErr := ioutil.ReadFile(path)
+	if readErr != nil {
+		logs.Error("DirCourseSource, readErr: ", readErr)
+		return nil, readErr
+	}
+	var col map[string]interface{}
+	jsErr := json.Unmarshal(content, &col)
+	if jsErr != nil {
+		logs.Error("DirCourseSource, jsErr: ", jsErr, ",path: ", path)
+		return col, jsErr
+	}
+	return col, nil
+}
+
+func (s DirCourseSource) CourseList() (map[string]interface{}, error) {
+	return s.readJson(s.CourseFile)
+}
+
+func (s DirCourseSource) Chapters(coursePathName string) (map[string]interface{}, error) {
+	return s.readJson(fmt.Sprintf(s.ChapterFile, coursePathName))
+}
+
+func (s DirCourseSource) ChapterDetail(coursePathName, chapterId string) (map[string]interface{}, error) {
+	return s.readJson(fmt.Sprintf(s.ChapterDetailFile, coursePathName, chapterId))
+}
+
+// GitCourseSource checks a git repository out to a local path at a branch,
+// tag or commit and reads the catalog from the checkout
+type GitCourseSource struct {
+	DirCourseSource
+	Url string
+	Ref string
+}
+
+// Checkouts of the same path are not run concurrently
+var gitLock sync.Mutex
+
+func gitOutput(dir string, args ...string) (string, error) {
+	cmd := exec.Command("git", args...)
+	cmd.Dir = dir
+	out, err := cmd.CombinedOutput()
+	if err != nil {
+		logs.Error("gitOutput, git ", strings.Join(args, " "), ", err: ", err, ", output: ", string(out))
+		return "", errors.New("git " + args[0] + " failed: " + strings.TrimSpace(string(out)))
+	}
+	return strings.TrimSpace(string(out)), nil
+}
+
+func runGit(dir string, args ...string) error {
+	_, err := gitOutput(dir, args...)
+	return err
+}
+
+// Checkout fetches Ref from Url into Dir and checks it out, local changes of
+// the checkout are discarded
+func (s GitCourseSource) Checkout() error {
+	gitLock.Lock()
+	defer gitLock.Unlock()
+	if len(s.Url) == 0 {
+		return errors.New("courses::git_url is required by the git course source")
+	}
+	common.CreateDir(s.Dir)
+	if !common.FileExists(filepath.Join(s.Dir, ".git")) {
+		if initErr := runGit(s.Dir, "init", "-q"); initErr != nil {
+			return initErr
+		}
+		if remoteErr := runGit(s.Dir, "remote", "add", "origin", s.Url); remoteErr != nil {
+			return remoteErr
+		}
+	} else if remoteErr := runGit(s.Dir, "remote", "set-url", "origin", s.Url); remoteErr != nil {
+		return remoteErr
+	}
+	if fetchErr := runGit(s.Dir, "fetch", "-q", "--depth", "1", "origin", s.Ref); fetchErr != nil {
+		return fetchErr
+	}
+	if coErr := runGit(s.Dir, "checkout", "-q", "--force", "FETCH_HEAD"); coErr != nil {
+		return coErr
+	}
+	logs.Info("GitCourseSource, checked out ", s.Url, "@", s.Ref, " to ", s.Dir)
+	return nil
+}
+
+// CourseList refreshes the checkout first, the chapters of the same sync are
+// then read from it
+func (s GitCourseSource) CourseList() (map[string]interface{}, error) {
+	if coErr := s.Checkout(); coErr != nil {
+		return nil, coErr
+	}
+	return s.DirCourseSource.CourseList()
+}
+
+// Revision returns the commit of the checkout
+func (s GitCourseSource) Revision() (string, error) {
+	return gitOutput(s.Dir, "rev-parse", "HEAD")
+}
+
+func configOrEnv(key, env string) string {
+	if os.Getenv(env) != "" {
+		return os.Getenv(env)
+	}
+	return beego.AppConfig.String(key)
+}
+
+// CourseSourceKind returns the kind of catalog source in courses::source
+func CourseSourceKind() string {
+	return strings.ToLower(beego.AppConfig.DefaultString("courses::source", CourseSourceHttp))
+}
+
+// GetCourseSource returns the catalog source selected by courses::source,
+// the urls can still be overridden through their environment variables
+func GetCourseSource() (CourseSource, error) {
+	dirSource := DirCourseSource{
+		CourseFile:        beego.AppConfig.DefaultString("courses::course_file", "courses/course-list.json"),
+		ChapterFile:       beego.AppConfig.DefaultString("courses::chapter_file", "courses/%v/course-content.json"),
+		ChapterDetailFile: beego.AppConfig.DefaultString("courses::chapter_detail_file", "courses/%v/%v/index.json"),
+	}
+	kind := CourseSourceKind()
+	switch kind {
+	case CourseSourceHttp, "":
+		return HttpCourseSource{CourseUrl: configOrEnv("courses::course_url", "COURSE_URL"),
+			ChapterUrl:       configOrEnv("courses::chapter_url", "CHAPTER_URL"),
+			ChapterDetailUrl: configOrEnv("courses::chapter_detail_url", "CHAPTER_DETAIL_URL")}, nil
+	case CourseSourceDir:
+		dirSource.Dir = beego.AppConfig.DefaultString("courses::source_dir", "courses-meta")
+		return dirSource, nil
+	case CourseSourceGit:
+		dirSource.Dir = beego.AppConfig.DefaultString("courses::git_dir", "courses-git")
+		return GitCourseSource{DirCourseSource: dirSource,
+			Url: beego.AppConfig.String("courses::git_url"),
+			Ref: beego.AppConfig.DefaultString("courses::git_ref", "master")}, nil
+	}
+	return nil, errors.New("Unknown course source: " + kind)
+}
@@ -0,0 +1,146 @@
+package handler
+
+import (
+	"errors"
+	"playground_backend/common"
+	"playground_backend/models"
+	"time"
+
+	"github.com/astaxie/beego"
+	"github.com/astaxie/beego/logs"
+)
+
+var ErrStudyChapterNotBound = errors.New("The user has not bound the chapter")
+
+// StudyHeartbeat is sent by the learning page while a chapter is open
+type StudyHeartbeat struct {
+	UserId    int64  `json:"userId"`
+	Token     string `json:"token"`
+	CourseId  string `json:"courseId"`
+	ChapterId string `json:"chapterId"`
+}
+
+type RspStudyTime struct {
+	CourseId         string `json:"courseId"`
+	ChapterId        string `json:"chapterId"`
+	CourseStudyTime  int64  `json:"courseStudyTime"`
+	ChapterStudyTime int64  `json:"chapterStudyTime"`
+}
+
+// StudySession is the time a learner was bound to an instance of a course
+type StudySession struct {
+	Start int64
+	End   int64
+}
+
+// StudyIdleSeconds is the longest gap between two heartbeats that still counts
+// as study time, see courses::study_idle_seconds
+func StudyIdleSeconds() int64 {
+	return beego.AppConfig.DefaultInt64("courses::study_idle_seconds", 300)
+}
+
+// UserCourseInstances returns the instances a user was bound to for a course,
+// one for every cluster of the user's course environments
+func UserCourseInstances(userId int64, courseId string) []models.ResourceInfo {
+	ureList, _ := models.QueryUserResourceEnvList(userId, courseId)
+	riList := make([]models.ResourceInfo, 0, len(ureList))
+	for _, ure := range ureList {
+		ri := models.ResourceInfo{ResourceName: UserResName(courseId, ure.ResourceId, ure.TemplatePath, userId)}
+		if models.QueryResourceInfo(&ri, "ResourceName") == nil {
+			riList = append(riList, ri)
+		}
+	}
+	return riList
+}
+
+// UserStudySessions returns the instance sessions of a user for a course, from
+// the bound time to the time the instance is to be recycled
+func UserStudySessions(userId int64, courseId string) []StudySession {
+	riList := UserCourseInstances(userId, courseId)
+	sessions := make([]StudySession, 0, len(riList))
+	for _, ri := range riList {
+		if len(ri.CreateTime) < 1 || ri.CompleteTime < 1 {
+			continue
+		}
+		start := common.PraseTimeInt(ri.CreateTime)
+		if start > 0 && ri.CompleteTime > start {
+			sessions = append(sessions, StudySession{Start: start, End: ri.CompleteTime})
+		}
+	}
+	return sessions
+}
+
+// StudyCredit returns the seconds between the last heartbeat and now that count
+// as study time. A gap up to the idle cutoff counts in full. A longer gap means
+// the page was left alone, then only the part of the idle cutoff after the last
+// heartbeat that a bound instance covered counts, so no gap counts for more
+// than the cutoff.
+func StudyCredit(activeTime, curTime, idleSeconds int64, sessions []StudySession) int64 {
+	if activeTime <= 0 || curTime <= activeTime {
+		return 0
+	}
+	if curTime-activeTime <= idleSeconds {
+		return curTime - activeTime
+	}
+	credit := int64(0)
+	for _, s := range sessions {
+		start, end := s.Start, s.End
+		if start < activeTime {
+			start = activeTime
+		}
+		if end > activeTime+idleSeconds {
+			end = activeTime + idleSeconds
+		}
+		if end-start > credit {
+			credit = end - start
+		}
+	}
+	return credit
+}
+
+// AddStudyHeartbeat counts the time since the previous heartbeat of a chapter
+// and of its course and returns the study time of both. The course counts the
+// interval since its own last heartbeat, so chapters open side by side do not
+// add up the same time.
+func AddStudyHeartbeat(hb StudyHeartbeat) (RspStudyTime, error) {
+	rst := RspStudyTime{CourseId: hb.CourseId, ChapterId: hb.ChapterId}
+	ucp := models.UserCourseChapter{UserId: hb.UserId, CourseId: hb.CourseId, ChapterId: hb.ChapterId}
+	if queryErr := models.QueryUserCourseChapter(&ucp, "UserId", "CourseId", "ChapterId"); queryErr != nil {
+		logs.Error("AddStudyHeartbeat, queryErr: ", queryErr)
+		return rst, ErrStudyChapterNotBound
+	}
+	uc := models.UserCourse{UserId: hb.UserId, CourseId: hb.CourseId}
+	ucErr := models.QueryUserCourse(&uc, "UserId", "CourseId")
+	// Offline chapters keep their study time but no longer collect any
+	if ucp.Status == 1 {
+		curTime := time.Now().Unix()
+		idleSeconds := StudyIdleSeconds()
+		sessions := UserStudySessions(hb.UserId, hb.CourseId)
+		credit := StudyCredit(ucp.ActiveTime, curTime, idleSeconds, sessions)
+		counted, upErr := models.AddUserChapterStudyTime(ucp.Id, ucp.ActiveTime, curTime, credit)
+		if upErr != nil {
+			return rst, upErr
+		}
+		if counted {
+			ucp.StudyTime += credit
+		} else {
+			// A concurrent heartbeat counted the interval
+			models.QueryUserCourseChapter(&ucp, "Id")
+		}
+		if ucErr == nil {
+			credit = StudyCredit(uc.ActiveTime, curTime, idleSeconds, sessions)
+			counted, upErr = models.AddUserCourseStudyTime(uc.Id, uc.ActiveTime, curTime, credit)
+			if upErr != nil {
+				return rst, upErr
+			}
+			if counted {
+				uc.StudyTime += credit
+			} else {
+				models.QueryUserCourse(&uc, "Id")
+			}
+		}
+	}
+	rst.ChapterStudyTime = ucp.StudyTime
+	rst.CourseStudyTime = uc.StudyTime
+	return rst, nil
+}
@@ -0,0 +1,42 @@
+package handler
+
+import "testing"
+
+func TestStudyCredit(t *testing.T) {
+	const idle = 300
+	cases := []struct {
+		name       string
+		activeTime int64
+		curTime    int64
+		sessions   []StudySession
+		want       int64
+	}{
+		{"first heartbeat", 0, 1000, nil, 0},
+		{"clock went back", 1000, 900, nil, 0},
+		{"same second", 1000, 1000, nil, 0},
+		{"gap within the idle cutoff", 1000, 1120, nil, 120},
+		{"gap of exactly the idle cutoff", 1000, 1300, nil, 300},
+		{"long gap without an instance", 1000, 5000, nil, 0},
+		{"long gap with an instance all along", 1000, 5000,
+			[]StudySession{{Start: 500, End: 9000}}, idle},
+		{"long gap with an instance ending early", 1000, 5000,
+			[]StudySession{{Start: 500, End: 1100}}, 100},
+		{"long gap with an instance bound late", 1000, 5000,
+			[]StudySession{{Start: 1200, End: 9000}}, 100},
+		{"long gap with an instance bound after the cutoff", 1000, 5000,
+			[]StudySession{{Start: 2000, End: 9000}}, 0},
+		{"long gap with an instance recycled before", 1000, 5000,
+			[]StudySession{{Start: 100, End: 900}}, 0},
+		{"overlapping instances count once", 1000, 5000,
+			[]StudySession{{Start: 500, End: 1200}, {Start: 1100, End: 9000}}, 200},
+		{"longest instance counts", 1000, 5000,
+			[]StudySession{{Start: 500, End: 1050}, {Start: 1150, End: 9000}}, 150},
+		{"short gap ignores the instances", 1000, 1100,
+			[]StudySession{{Start: 500, End: 9000}}, 100},
+	}
+	for _, c := range cases {
+		if got := StudyCredit(c.activeTime, c.curTime, idle, c.sessions); got != c.want {
+			t.Errorf("%s: StudyCredit() = %d, want %d", c.name, got, c.want)
+		}
+	}
+}
@@ -0,0 +1,175 @@
+package handler
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/astaxie/beego"
+	"github.com/astaxie/beego/logs"
+)
+
+// What started a course sync run
+const (
+	SyncTriggerCron    = "cron"
+	SyncTriggerWebhook = "webhook"
+	SyncTriggerStartup = "startup"
+)
+
+// Headers of a webhook: the unix time it was sent at, and the hex HMAC-SHA256
+// of "<timestamp>.<body>" as "sha256=<hex>"
+const (
+	SyncTimestampHeader = "X-Playground-Timestamp"
+	SyncSignatureHeader = "X-Playground-Signature"
+)
+
+var ErrSyncBusy = errors.New("A course sync is running on another replica")
+
+// CourseSyncHook is the body of a sync webhook, without course ids every
+// course is synced
+type CourseSyncHook struct {
+	CourseIds []string `json:"courseIds"`
+}
+
+type CourseSyncTrigger struct {
+	Started   bool     `json:"started"`
+	CourseIds []string `json:"courseIds"`
+}
+
+// syncQueue runs one sync at a time per replica. Triggers that arrive while
+// a sync runs are merged into a single pending one.
+type syncQueue struct {
+	lock      sync.Mutex
+	running   bool
+	all       bool
+	courseIds map[string]bool
+	triggers  map[string]bool
+}
+
+var courseSyncQueue = syncQueue{courseIds: map[string]bool{}, triggers: map[string]bool{}}
+
+func (q *syncQueue) add(trigger string, courseIds []string) {
+	if len(courseIds) == 0 {
+		q.all = true
+	}
+	for _, courseId := range courseIds {
+		q.courseIds[courseId] = true
+	}
+	q.triggers[trigger] = true
+}
+
+// take returns the pending sync and clears it, ok is false when none is pending
+func (q *syncQueue) take() (trigger string, courseIds []string, ok bool) {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+	if !q.all && len(q.courseIds) == 0 {
+		q.running = false
+		return "", nil, false
+	}
+	triggers := make([]string, 0, len(q.triggers))
+	for t := range q.triggers {
+		triggers = append(triggers, t)
+	}
+	sort.Strings(triggers)
+	if !q.all {
+		for courseId := range q.courseIds {
+			courseIds = append(courseIds, courseId)
+		}
+		sort.Strings(courseIds)
+	}
+	q.all = false
+	q.courseIds = map[string]bool{}
+	q.triggers = map[string]bool{}
+	return strings.Join(triggers, ","), courseIds, true
+}
+
+func (q *syncQueue) drain() {
+	retry := time.Duration(beego.AppConfig.DefaultInt64("courses::sync_retry_seconds", 10)) * time.Second
+	for {
+		trigger, courseIds, ok := q.take()
+		if !ok {
+			return
+		}
+		syncErr := runLockedSync(trigger, courseIds)
+		if syncErr == ErrSyncBusy {
+			// The run on the other replica may have started before the change
+			logs.Info("syncQueue, ", syncErr, ", retry in ", retry)
+			q.lock.Lock()
+			for _, t := range strings.Split(trigger, ",") {
+				q.add(t, courseIds)
+			}
+			q.lock.Unlock()
+			time.Sleep(retry)
+			continue
+		}
+		if syncErr != nil {
+			logs.Error("syncQueue, syncErr: ", syncErr, ",trigger: ", trigger)
+		}
+	}
+}
+
+// TriggerCourseSync queues a sync of courseIds, or of every course, and starts
+// it unless a sync is already running, it then runs right after that one
+func TriggerCourseSync(trigger string, courseIds []string) bool {
+	q := &courseSyncQueue
+	q.lock.Lock()
+	defer q.lock.Unlock()
+	q.add(trigger, courseIds)
+	if q.running {
+		logs.Info("TriggerCourseSync, a sync is running, queued, trigger: ", trigger)
+		return false
+	}
+	q.running = true
+	go q.drain()
+	return true
+}
+
+// runLockedSync runs SyncCourse under a lock row, so replicas never sync at
+// the same time
+func runLockedSync(trigger string, courseIds []string) error {
+	lockName := GetLeaderConfig().LockName + "-course-sync"
+	lease := beego.AppConfig.DefaultInt64("courses::sync_lock_seconds", 600)
+	ok, syncErr := runLocked(lockName, lease, func() error {
+		_, err := SyncCourse(trigger, courseIds)
+		return err
+	})
+	if !ok && syncErr == nil {
+		return ErrSyncBusy
+	}
+	return syncErr
+}
+
+// VerifySyncSignature checks the signature of a webhook body and its timestamp
+// against courses::webhook_secret, without a secret every request is rejected.
+// Requests sent more than courses::webhook_max_age_seconds ago are rejected
+// too, so a captured request cannot be replayed later.
+func VerifySyncSignature(body []byte, timestamp, signature string) bool {
+	secret := beego.AppConfig.String("courses::webhook_secret")
+	if len(secret) == 0 {
+		logs.Error("VerifySyncSignature, courses::webhook_secret is not configured")
+		return false
+	}
+	sentAt, tsErr := strconv.ParseInt(timestamp, 10, 64)
+	if tsErr != nil {
+		return false
+	}
+	maxAge := beego.AppConfig.DefaultInt64("courses::webhook_max_age_seconds", 300)
+	if age := time.Now().Unix() - sentAt; age > maxAge || age < -maxAge {
+		logs.Error("VerifySyncSignature, the request is too old, timestamp: ", timestamp)
+		return false
+	}
+	expected, decErr := hex.DecodeString(strings.TrimPrefix(signature, "sha256="))
+	if decErr != nil || len(expected) == 0 {
+		return false
+	}
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(timestamp + "."))
+	mac.Write(body)
+	return hmac.Equal(mac.Sum(nil), expected)
+}
@@ -0,0 +1,240 @@
+package handler
+
+import (
+	"context"
+	"fmt"
+	"playground_backend/common"
+	"playground_backend/models"
+	"time"
+
+	"github.com/astaxie/beego"
+	"github.com/astaxie/beego/logs"
+	k8serrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// Statistics events of the instances of an offline course
+const (
+	TeardownScheduledEvent = "Offline teardown scheduled"
+	TeardownDeletedEvent   = "Offline teardown deleted"
+	TeardownCanceledEvent  = "Offline teardown canceled"
+)
+
+// OfflineGraceSeconds is how long a learner keeps a bound instance after its
+// course went offline, see courses::offline_grace_minutes
+func OfflineGraceSeconds() int64 {
+	return beego.AppConfig.DefaultInt64("courses::offline_grace_minutes", 30) * 60
+}
+
+// TeardownOfflineCourse releases the clusters of a course that went offline,
+// rtr are the environments the course had, each recorded by PendingTeardown
+// beforehand. Pools no other course shares are drained and forgotten, and
+// bound instances are deleted by OfflineTeardownTask once the grace period
+// ends. A cluster whose instances could not be listed stays pending and is
+// retried by OfflineTeardownTask.
+func TeardownOfflineCourse(courseId string, rtr []models.ResourceTempathRel) {
+	others, _, queryErr := models.QueryResourceTempathRelAll()
+	if queryErr != nil {
+		logs.Error("TeardownOfflineCourse, queryErr: ", queryErr)
+	}
+	shared := make(map[string]bool, len(others))
+	for _, ot := range others {
+		if ot.CourseId == courseId || len(ot.TemplateHash) < 1 {
+			continue
+		}
+		shared[MakePoolKey(ot.ResourceId, ot.ResourcePath, ot.TemplateHash)] = true
+		if len(ot.PrevPoolKey) > 0 {
+			shared[ot.PrevPoolKey] = true
+		}
+	}
+	for _, rt := range rtr {
+		rd := ResourceData{EnvResource: rt.ResourcePath, ResourceId: rt.ResourceId,
+			CourseId: rt.CourseId, TemplateHash: rt.TemplateHash}
+		CoursePoolVar.RemoveCourse(rt.CourseId, rt.ResourceId)
+		keys := make([]string, 0, 2)
+		if len(rt.TemplateHash) > 0 {
+			keys = append(keys, MakePoolKey(rt.ResourceId, rt.ResourcePath, rt.TemplateHash))
+		}
+		if len(rt.PrevPoolKey) > 0 {
+			keys = append(keys, rt.PrevPoolKey)
+		}
+		for _, key := range keys {
+			if shared[key] {
+				logs.Info("TeardownOfflineCourse, the pool is shared, keep it, PoolKey: ", key)
+				continue
+			}
+			rd.PoolKey = key
+			DeletePoolMembers(&rd, CoursePoolVar.Drain(key, CoursePoolVar.Free(key)))
+			CoursePoolVar.Delete(key)
+			logs.Info("TeardownOfflineCourse, pool removed, PoolKey: ", key, ", courseId: ", courseId)
+		}
+		scheduleTeardown(&rd)
+	}
+}
+
+// scheduleTeardown records the bound instances of rd and drops its pending row,
+// which is kept when that fails
+func scheduleTeardown(rd *ResourceData) {
+	if err := ScheduleBoundTeardown(rd); err != nil {
+		logs.Error("scheduleTeardown, err: ", err, ",courseId: ", rd.CourseId, ",resourceId: ", rd.ResourceId)
+		return
+	}
+	pt := models.PendingTeardown{CourseId: rd.CourseId, ResourceId: rd.ResourceId, EnvResource: rd.EnvResource}
+	if delErr := models.DeletePendingTeardown(&pt); delErr != nil {
+		logs.Error("scheduleTeardown, delErr: ", delErr)
+	}
+}
+
+// PendingCourseTeardown records the clusters of a course going offline before
+// its environments are deleted, so none of them is lost when scheduling fails
+func PendingCourseTeardown(rtr []models.ResourceTempathRel) error {
+	for _, rt := range rtr {
+		pt := models.PendingTeardown{CourseId: rt.CourseId, ResourceId: rt.ResourceId,
+			EnvResource: rt.ResourcePath, CreateTime: common.GetCurTime()}
+		if err := models.InsertPendingTeardown(&pt); err != nil {
+			logs.Error("PendingCourseTeardown, err: ", err, ",courseId: ", rt.CourseId)
+			return err
+		}
+	}
+	return nil
+}
+
+// retryPendingTeardown schedules the clusters an earlier teardown could not list
+func retryPendingTeardown() {
+	pts, _, queryErr := models.QueryPendingTeardown()
+	if queryErr != nil {
+		return
+	}
+	for _, pt := range pts {
+		cr := models.Courses{CourseId: pt.CourseId}
+		if models.QueryCourse(&cr, "CourseId") == nil && cr.Status == 1 {
+			logs.Info("retryPendingTeardown, the course is online again, courseId: ", pt.CourseId)
+			if delErr := models.DeletePendingTeardown(&pt); delErr != nil {
+				logs.Error("retryPendingTeardown, delErr: ", delErr)
+			}
+			continue
+		}
+		scheduleTeardown(&ResourceData{EnvResource: pt.EnvResource, ResourceId: pt.ResourceId, CourseId: pt.CourseId})
+	}
+}
+
+// ScheduleBoundTeardown records the instances learners hold on a cluster for
+// an offline course, the learners are warned until they are deleted
+func ScheduleBoundTeardown(rd *ResourceData) error {
+	dr, err := PoolResClient(rd)
+	if err != nil {
+		logs.Error("ScheduleBoundTeardown, err: ", err)
+		return err
+	}
+	objList, listErr := dr.List(context.TODO(), metav1.ListOptions{})
+	if listErr != nil {
+		logs.Error("ScheduleBoundTeardown, listErr: ", listErr)
+		return listErr
+	}
+	var inErr error
+	deleteAt := time.Now().Unix() + OfflineGraceSeconds()
+	for _, items := range objList.Items {
+		metadata, ok := ParsingMap(items.Object, "metadata")
+		if !ok {
+			continue
+		}
+		name, ok := ParsingMapStr(metadata, "name")
+		if !ok || len(name) < 1 {
+			continue
+		}
+		annotations, ok := ParsingMap(metadata, "annotations")
+		if !ok {
+			continue
+		}
+		courseId, _ := ParsingMapStr(annotations, "courseId")
+		resourceName, _ := ParsingMapStr(annotations, "resourceName")
+		if courseId != rd.CourseId || len(resourceName) < 1 {
+			continue
+		}
+		userName, _ := ParsingMapStr(annotations, "userId")
+		ot := models.OfflineTeardown{CourseId: rd.CourseId, ResourceId: rd.ResourceId,
+			EnvResource: rd.EnvResource, ResName: name, UserName: userName,
+			DeleteAt: deleteAt, CreateTime: common.GetCurTime()}
+		created, err := models.InsertOfflineTeardown(&ot)
+		if err != nil {
+			inErr = err
+			logs.Error("ScheduleBoundTeardown, inErr: ", inErr, ",resName: ", name)
+			continue
+		}
+		if !created {
+			continue
+		}
+		logs.Info("ScheduleBoundTeardown, resName: ", name, ", user: ", userName,
+			", deleteAt: ", time.Unix(ot.DeleteAt, 0).Format(common.DATE_FORMAT))
+		writeTeardownLog(ot, TeardownScheduledEvent, "success",
+			fmt.Sprintf("The course is offline, the instance of %s is deleted at %s",
+				userName, time.Unix(ot.DeleteAt, 0).Format(common.DATE_FORMAT)))
+	}
+	return inErr
+}
+
+func writeTeardownLog(ot models.OfflineTeardown, eventType, state, msg string) {
+	crd := models.Courses{CourseId: ot.CourseId}
+	ccp := models.CoursesChapter{CourseId: ot.CourseId}
+	WriteCourseData(0, "0", ot.CourseId, "", eventType, ot.ResName, state, msg,
+		2, 2, &crd, &ccp)
+}
+
+// TeardownWarning returns the seconds left before a bound instance of an
+// offline course is deleted, and false when it is not scheduled
+func TeardownWarning(resName string) (int64, bool) {
+	ot := models.OfflineTeardown{ResName: resName}
+	if models.QueryOfflineTeardown(&ot, "ResName") != nil {
+		return 0, false
+	}
+	remain := ot.DeleteAt - time.Now().Unix()
+	if remain < 0 {
+		remain = 0
+	}
+	return remain, true
+}
+
+// OfflineTeardownTask deletes the bound instances whose grace period ended,
+// instances of a course that came back online are kept
+func OfflineTeardownTask() error {
+	retryPendingTeardown()
+	ots, num, queryErr := models.QueryDueOfflineTeardown(time.Now().Unix())
+	if queryErr != nil {
+		return queryErr
+	}
+	if num > 0 {
+		logs.Info("OfflineTeardownTask, due instances: ", num)
+	}
+	for _, ot := range ots {
+		cr := models.Courses{CourseId: ot.CourseId}
+		if models.QueryCourse(&cr, "CourseId") == nil && cr.Status == 1 {
+			logs.Info("OfflineTeardownTask, the course is online again, keep resName: ", ot.ResName)
+			if delErr := models.DeleteOfflineTeardown(&ot); delErr != nil {
+				logs.Error("OfflineTeardownTask, delErr: ", delErr)
+			}
+			writeTeardownLog(ot, TeardownCanceledEvent, "success", "The course is online again")
+			continue
+		}
+		rd := ResourceData{EnvResource: ot.EnvResource, ResourceId: ot.ResourceId, CourseId: ot.CourseId}
+		dr, err := PoolResClient(&rd)
+		if err != nil {
+			logs.Error("OfflineTeardownTask, err: ", err, ",resName: ", ot.ResName)
+			continue
+		}
+		delErr := dr.Delete(context.TODO(), ot.ResName, metav1.DeleteOptions{})
+		if delErr != nil && !k8serrors.IsNotFound(delErr) {
+			logs.Error("OfflineTeardownTask, delErr: ", delErr, ",resName: ", ot.ResName)
+			writeTeardownLog(ot, TeardownDeletedEvent, "failed", delErr.Error())
+			continue
+		}
+		logs.Info("OfflineTeardownTask, instance deleted, resName: ", ot.ResName)
+		if dbErr := models.DeletePoolInstance(ot.ResName); dbErr != nil {
+			logs.Error("OfflineTeardownTask, dbErr: ", dbErr)
+		}
+		if dbErr := models.DeleteOfflineTeardown(&ot); dbErr != nil {
+			logs.Error("OfflineTeardownTask, dbErr: ", dbErr)
+		}
+		writeTeardownLog(ot, TeardownDeletedEvent, "success", "The grace period of the offline course ended")
+	}
+	return nil
+}
@@ -0,0 +1,448 @@
+package handler
+
+import (
+	"errors"
+	"fmt"
+	"playground_backend/common"
+	"playground_backend/models"
+	"strconv"
+	"strings"
+
+	"github.com/astaxie/beego"
+	"github.com/astaxie/beego/logs"
+)
+
+// A template version is referred to as <name>@v<version> in the resource paths
+// of ResourceTempathRel, DownLoadTemplate serves it from the registry
+const TemplateVersionSep = "@v"
+
+const (
+	BackendContainer = "container"
+	BackendVm        = "vm"
+	BackendLxd       = "lxd"
+)
+
+// The resolution policy used while a course has no template mapping, in order
+const DefaultResolutionPolicy = "tryme,origin,default,default_container,customization,lxd"
+
+var ErrTemplateNotFound = errors.New("no template is configured for the course")
+
+type TemplateReq struct {
+	Name        string `json:"name"`
+	EulerBranch string `json:"eulerBranch"`
+	Content     string `json:"content"`
+}
+
+type CourseTemplateReq struct {
+	ChapterId   string `json:"chapterId"`
+	EulerBranch string `json:"eulerBranch"`
+	TemplateId  int64  `json:"templateId"`
+}
+
+// CourseTemplateView is a course mapping with the versions it points to
+type CourseTemplateView struct {
+	CourseId     string                   `json:"courseId"`
+	ChapterId    string                   `json:"chapterId"`
+	EulerBranch  string                   `json:"eulerBranch"`
+	Pinned       bool                     `json:"pinned"`
+	Template     *models.TemplateRegistry `json:"template"`
+	PrevTemplate *models.TemplateRegistry `json:"prevTemplate"`
+	UpdateTime   string                   `json:"updateTime"`
+}
+
+// VersionedPath returns the resource path of a template version
+func VersionedPath(name string, version int) string {
+	return name + TemplateVersionSep + strconv.Itoa(version)
+}
+
+// SplitTemplatePath splits a versioned resource path, ok is false for plain paths
+func SplitTemplatePath(resourcePath string) (name string, version int, ok bool) {
+	idx := strings.LastIndex(resourcePath, TemplateVersionSep)
+	if idx < 0 {
+		return resourcePath, 0, false
+	}
+	version, err := strconv.Atoi(resourcePath[idx+len(TemplateVersionSep):])
+	if err != nil {
+		return resourcePath, 0, false
+	}
+	return resourcePath[:idx], version, true
+}
+
+// TemplateName strips the version from a resource path
+func TemplateName(resourcePath string) string {
+	name, _, _ := SplitTemplatePath(resourcePath)
+	return name
+}
+
+func TemplateBackend(name string) string {
+	if strings.HasPrefix(name, BackendLxd+"/") || strings.Contains(name, "/"+BackendLxd+"/") {
+		return BackendLxd
+	}
+	if strings.HasSuffix(name, VM) {
+		return BackendVm
+	}
+	return BackendContainer
+}
+
+// resolutionPaths returns the candidate template paths of the resolution
+// policy in template::resolution_policy
+func resolutionPaths(eulerBranch, courseDir string) []string {
+	paths := make([]string, 0)
+	policy := beego.AppConfig.DefaultString("template::resolution_policy", DefaultResolutionPolicy)
+	for _, rule := range strings.Split(policy, ",") {
+		switch strings.TrimSpace(rule) {
+		case "":
+		case TRYME:
+			paths = append(paths, fmt.Sprintf("%v/%v.tmpl", TRYME, eulerBranch))
+		case "origin":
+			paths = append(paths, eulerBranch)
+		case DEFAULT:
+			paths = append(paths, fmt.Sprintf("%v/%v", DEFAULT, eulerBranch))
+		case "default_container":
+			paths = append(paths, fmt.Sprintf("%v/%v_%v", DEFAULT, eulerBranch, CONTAINER))
+		case CUSTOMIZATION:
+			paths = append(paths, fmt.Sprintf("%v/%v_%v_%v", CUSTOMIZATION, eulerBranch, courseDir, CONTAINER))
+		case BackendLxd:
+			paths = append(paths, fmt.Sprintf("%v/%v", eulerBranch, LXD))
+		default:
+			logs.Error("resolutionPaths, unknown rule: ", rule)
+		}
+	}
+	return paths
+}
+
+// FetchTemplate downloads the current content of a template from the course repository
+func FetchTemplate(name string) ([]byte, error) {
+	yamlDir := beego.AppConfig.DefaultString("template::local_dir", "template")
+	downLock.Lock()
+	downErr, localPath := DownLoadTemplate(yamlDir, name)
+	downLock.Unlock()
+	if common.FileExists(localPath) {
+		defer DeleteFile(localPath)
+	}
+	if downErr != nil {
+		return nil, downErr
+	}
+	return common.ReadAll(localPath)
+}
+
+// RegisterTemplateVersion records the content of a template, a new version is
+// only added when the content or the cluster binding changed
+func RegisterTemplateVersion(name, eulerBranch string, content []byte) (models.TemplateRegistry, error) {
+	name = TemplateName(name)
+	hash := common.EncryptMd5(string(content))
+	tr := models.TemplateRegistry{Name: name, ContentHash: hash, Content: string(content),
+		Backend: TemplateBackend(name), EulerBranch: eulerBranch, CreateTime: common.GetCurTime()}
+	created, inErr := models.AddTemplateVersion(&tr)
+	if inErr != nil {
+		logs.Error("RegisterTemplateVersion, inErr: ", inErr, ",name: ", name)
+		return tr, inErr
+	}
+	if created {
+		logs.Info("RegisterTemplateVersion, name: ", name, ", version: ", tr.Version, ", hash: ", hash)
+	}
+	return tr, nil
+}
+
+// exactTemplateMap returns the mapping stored for the course, chapter and
+// branch, without falling back to the course. Mappings are written through it.
+func exactTemplateMap(courseId, chapterId, eulerBranch string) (models.CourseTemplateMap, bool) {
+	ctm := models.CourseTemplateMap{CourseId: courseId, ChapterId: chapterId, EulerBranch: eulerBranch}
+	if models.QueryCourseTemplateMap(&ctm, "CourseId", "ChapterId", "EulerBranch") == nil {
+		return ctm, true
+	}
+	return ctm, false
+}
+
+// courseTemplateMap returns the mapping of a chapter, or else of the course on
+// the branch. It is only used to read, see exactTemplateMap.
+func courseTemplateMap(courseId, chapterId, eulerBranch string) (models.CourseTemplateMap, bool) {
+	if len(chapterId) > 0 {
+		if ctm, ok := exactTemplateMap(courseId, chapterId, eulerBranch); ok {
+			return ctm, true
+		}
+	}
+	return exactTemplateMap(courseId, "", eulerBranch)
+}
+
+// mapCourseTemplate points a mapping at a template version and keeps the
+// version it replaces for rollback
+func mapCourseTemplate(ctm *models.CourseTemplateMap, templateId int64, pinned int8) error {
+	if ctm.Id == 0 {
+		ctm.TemplateId = templateId
+		ctm.Pinned = pinned
+		ctm.CreateTime = common.GetCurTime()
+		created, inErr := models.InsertCourseTemplateMap(ctm)
+		if inErr != nil || created {
+			return inErr
+		}
+		// Mapped by a concurrent request in the meantime, ctm is that mapping now
+	}
+	if ctm.TemplateId != templateId {
+		ctm.PrevTemplateId = ctm.TemplateId
+		ctm.TemplateId = templateId
+	}
+	ctm.Pinned = pinned
+	ctm.UpdateTime = common.GetCurTime()
+	return models.UpdateCourseTemplateMap(ctm, "TemplateId", "PrevTemplateId", "Pinned", "UpdateTime")
+}
+
+// ResolveCourseTemplate returns the template version of a course. Courses
+// without a mapping are resolved with the resolution policy and mapped to the
+// version found, so that the policy runs once per course.
+func ResolveCourseTemplate(courseId, chapterId, eulerBranch, courseDir string) (models.TemplateRegistry, error) {
+	ctm, ok := courseTemplateMap(courseId, chapterId, eulerBranch)
+	if ok {
+		tr := models.TemplateRegistry{Id: ctm.TemplateId}
+		queryErr := models.QueryTemplateRegistry(&tr, "Id")
+		return tr, queryErr
+	}
+	for _, name := range resolutionPaths(eulerBranch, courseDir) {
+		if rcpList, _, _ := models.QueryResourceConfigPathList(eulerBranch, name); len(rcpList) == 0 {
+			continue
+		}
+		content, fetchErr := FetchTemplate(name)
+		if fetchErr != nil {
+			logs.Error("ResolveCourseTemplate, fetchErr: ", fetchErr, ",name: ", name)
+			return models.TemplateRegistry{}, fetchErr
+		}
+		tr, regErr := RegisterTemplateVersion(name, eulerBranch, content)
+		if regErr != nil {
+			return tr, regErr
+		}
+		ctm.TemplateId = tr.Id
+		ctm.Pinned = models.TemplateFollowed
+		ctm.CreateTime = common.GetCurTime()
+		created, inErr := models.InsertCourseTemplateMap(&ctm)
+		if inErr != nil {
+			logs.Error("ResolveCourseTemplate, inErr: ", inErr, ",courseId: ", courseId)
+			return tr, inErr
+		}
+		if !created {
+			// A concurrent request resolved the course first, its mapping wins
+			tr = models.TemplateRegistry{Id: ctm.TemplateId}
+			queryErr := models.QueryTemplateRegistry(&tr, "Id")
+			return tr, queryErr
+		}
+		logs.Info("ResolveCourseTemplate, courseId: ", courseId, ", mapped to: ", VersionedPath(tr.Name, tr.Version))
+		return tr, nil
+	}
+	return models.TemplateRegistry{}, ErrTemplateNotFound
+}
+
+// RefreshCourseTemplates registers the current content of the templates the
+// course follows and moves those mappings to it. Pinned mappings are kept.
+// It downloads every followed template, so the sync only runs it for courses
+// that changed or when the catalog revision changed. The branches whose
+// mappings moved are returned once each.
+func RefreshCourseTemplates(courseId string) []string {
+	moved := []string{}
+	seen := map[string]bool{}
+	ctmList, _, _ := models.QueryCourseTemplateMapList(courseId)
+	for i := range ctmList {
+		ctm := ctmList[i]
+		if ctm.Pinned == models.TemplatePinned {
+			continue
+		}
+		cur := models.TemplateRegistry{Id: ctm.TemplateId}
+		if models.QueryTemplateRegistry(&cur, "Id") != nil {
+			continue
+		}
+		content, fetchErr := FetchTemplate(cur.Name)
+		if fetchErr != nil {
+			logs.Error("RefreshCourseTemplates, fetchErr: ", fetchErr, ",name: ", cur.Name)
+			continue
+		}
+		tr, regErr := RegisterTemplateVersion(cur.Name, cur.EulerBranch, content)
+		if regErr != nil || tr.Id == ctm.TemplateId {
+			continue
+		}
+		mapErr := mapCourseTemplate(&ctm, tr.Id, models.TemplateFollowed)
+		if mapErr != nil {
+			logs.Error("RefreshCourseTemplates, mapErr: ", mapErr)
+			continue
+		}
+		if !seen[ctm.EulerBranch] {
+			seen[ctm.EulerBranch] = true
+			moved = append(moved, ctm.EulerBranch)
+		}
+	}
+	return moved
+}
+
+// RefreshCourseTemplate moves the followed mappings of a course to the current
+// content of their templates and saves the course against the new versions
+func RefreshCourseTemplate(courseId string) ([]CourseTemplateView, error) {
+	cs := models.Courses{CourseId: courseId}
+	if queryErr := models.QueryCourse(&cs, "CourseId"); queryErr != nil {
+		return nil, ErrTemplateNotFound
+	}
+	for _, eulerBranch := range RefreshCourseTemplates(courseId) {
+		if bindErr := rebindCourse(courseId, eulerBranch); bindErr != nil {
+			logs.Error("RefreshCourseTemplate, bindErr: ", bindErr, ",courseId: ", courseId)
+			return nil, bindErr
+		}
+	}
+	return CourseTemplateList(courseId)
+}
+
+// moveTemplateRel points the resources of a course on a cluster that refer to
+// another version of the same template at resourcePath, so their pool settings
+// are kept. Duplicates left behind are removed.
+func moveTemplateRel(courseId, resourceId, resourcePath string) {
+	rtrList, _, _ := models.QueryCourseTemplateRelList(courseId)
+	moved := false
+	for _, rt := range rtrList {
+		if rt.ResourceId == resourceId && rt.ResourcePath == resourcePath {
+			moved = true
+		}
+	}
+	for i := range rtrList {
+		rt := rtrList[i]
+		if rt.ResourceId != resourceId || rt.ResourcePath == resourcePath ||
+			TemplateName(rt.ResourcePath) != TemplateName(resourcePath) {
+			continue
+		}
+		if moved {
+			delErr := models.DeleteResourceTempathRel(&rt, "Id")
+			if delErr != nil {
+				logs.Error("moveTemplateRel, delErr: ", delErr)
+			}
+			continue
+		}
+		logs.Info("moveTemplateRel, courseId: ", courseId, ", ", rt.ResourcePath, "=>", resourcePath)
+		// The pool of the old version is replaced gradually, see ReplaceStaleMembers
+		if len(rt.TemplateHash) > 0 {
+			rt.PrevPoolKey = MakePoolKey(rt.ResourceId, rt.ResourcePath, rt.TemplateHash)
+			rt.TemplateHash = ""
+		}
+		rt.ResourcePath = resourcePath
+		rt.UpdateTime = common.GetCurTime()
+		upErr := models.UpdateResourceTempathRel(&rt, "ResourcePath", "TemplateHash", "PrevPoolKey", "UpdateTime")
+		if upErr != nil {
+			logs.Error("moveTemplateRel, upErr: ", upErr)
+			continue
+		}
+		moved = true
+	}
+}
+
+// rebindCourse saves the course against the template versions it is now mapped to
+func rebindCourse(courseId, eulerBranch string) error {
+	cs := models.Courses{CourseId: courseId}
+	if queryErr := models.QueryCourse(&cs, "CourseId"); queryErr != nil {
+		return queryErr
+	}
+	rcp := models.ResourceConfigPath{EulerBranch: eulerBranch}
+	rr := ReqResource{CourseId: courseId}
+	return rr.SaveCourseAndResRel(&rcp, cs.Name)
+}
+
+// SetCourseTemplate pins a course, or one chapter, to a template version
+func SetCourseTemplate(courseId string, req CourseTemplateReq) (CourseTemplateView, error) {
+	tr := models.TemplateRegistry{Id: req.TemplateId}
+	if queryErr := models.QueryTemplateRegistry(&tr, "Id"); queryErr != nil {
+		return CourseTemplateView{}, errors.New("the template version does not exist")
+	}
+	ctm, _ := exactTemplateMap(courseId, req.ChapterId, tr.EulerBranch)
+	if mapErr := mapCourseTemplate(&ctm, tr.Id, models.TemplatePinned); mapErr != nil {
+		return CourseTemplateView{}, mapErr
+	}
+	if bindErr := rebindCourse(courseId, tr.EulerBranch); bindErr != nil {
+		logs.Error("SetCourseTemplate, bindErr: ", bindErr)
+		return NewCourseTemplateView(ctm), bindErr
+	}
+	return NewCourseTemplateView(ctm), nil
+}
+
+// RollbackCourseTemplate moves a course, or one chapter, back to the template
+// version it used before and pins it there. Without eulerBranch the only
+// mapping of the course or chapter is rolled back.
+func RollbackCourseTemplate(courseId string, req CourseTemplateReq) (CourseTemplateView, error) {
+	ctm, ok := exactTemplateMap(courseId, req.ChapterId, req.EulerBranch)
+	if !ok && len(req.EulerBranch) == 0 {
+		ctmList, _, _ := models.QueryCourseTemplateMapList(courseId)
+		matched := []models.CourseTemplateMap{}
+		for _, m := range ctmList {
+			if m.ChapterId == req.ChapterId {
+				matched = append(matched, m)
+			}
+		}
+		if len(matched) > 1 {
+			return CourseTemplateView{}, errors.New("the mapping is on several branches, eulerBranch is required")
+		}
+		if len(matched) == 1 {
+			ctm, ok = matched[0], true
+		}
+	}
+	if !ok {
+		return CourseTemplateView{}, ErrTemplateNotFound
+	}
+	if ctm.PrevTemplateId == 0 {
+		return NewCourseTemplateView(ctm), errors.New("there is no previous template version")
+	}
+	if mapErr := mapCourseTemplate(&ctm, ctm.PrevTemplateId, models.TemplatePinned); mapErr != nil {
+		return CourseTemplateView{}, mapErr
+	}
+	logs.Info("RollbackCourseTemplate, courseId: ", courseId, ", chapterId: ", ctm.ChapterId,
+		", template: ", ctm.PrevTemplateId, "=>", ctm.TemplateId)
+	if bindErr := rebindCourse(courseId, ctm.EulerBranch); bindErr != nil {
+		logs.Error("RollbackCourseTemplate, bindErr: ", bindErr)
+		return NewCourseTemplateView(ctm), bindErr
+	}
+	return NewCourseTemplateView(ctm), nil
+}
+
+func NewCourseTemplateView(ctm models.CourseTemplateMap) CourseTemplateView {
+	ctv := CourseTemplateView{CourseId: ctm.CourseId, ChapterId: ctm.ChapterId, EulerBranch: ctm.EulerBranch,
+		Pinned: ctm.Pinned == models.TemplatePinned, UpdateTime: ctm.UpdateTime}
+	for _, id := range []int64{ctm.TemplateId, ctm.PrevTemplateId} {
+		if id == 0 {
+			continue
+		}
+		tr := models.TemplateRegistry{Id: id}
+		if models.QueryTemplateRegistry(&tr, "Id") != nil {
+			continue
+		}
+		tr.Content = ""
+		if id == ctm.TemplateId {
+			ctv.Template = &tr
+		} else {
+			ctv.PrevTemplate = &tr
+		}
+	}
+	return ctv
+}
+
+func CourseTemplateList(courseId string) ([]CourseTemplateView, error) {
+	ctmList, _, err := models.QueryCourseTemplateMapList(courseId)
+	ctvList := make([]CourseTemplateView, 0, len(ctmList))
+	for _, ctm := range ctmList {
+		ctvList = append(ctvList, NewCourseTemplateView(ctm))
+	}
+	return ctvList, err
+}
+
+// RegisterTemplate adds a template version from the request content, or from
+// the course repository when no content is given
+func RegisterTemplate(req TemplateReq) (models.TemplateRegistry, error) {
+	name := TemplateName(req.Name)
+	if len(name) == 0 || len(req.EulerBranch) == 0 {
+		return models.TemplateRegistry{}, errors.New("name and eulerBranch are required")
+	}
+	content := []byte(req.Content)
+	if len(content) == 0 {
+		fetched, fetchErr := FetchTemplate(name)
+		if fetchErr != nil {
+			return models.TemplateRegistry{}, fetchErr
+		}
+		content = fetched
+	}
+	tr, err := RegisterTemplateVersion(name, req.EulerBranch, content)
+	tr.Content = ""
+	return tr, err
+}
+
+func QueryTemplateVersions(name string) ([]models.TemplateRegistry, int64, error) {
+	return models.QueryTemplateVersions(TemplateName(name))
+}
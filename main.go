@@ -1,14 +1,18 @@
 package main
 
 import (
+	"os"
+	"os/signal"
 	"playground_backend/common"
 	"playground_backend/controllers"
 	"playground_backend/handler"
 	"playground_backend/models"
 	_ "playground_backend/routers"
 	"playground_backend/task"
+	"syscall"
 
 	"github.com/astaxie/beego"
+	"github.com/astaxie/beego/logs"
 )
 
 func init() {
@@ -16,11 +20,24 @@ func init() {
 	common.LogInit()
 }
 
+// releaseOnSignal stops the tasks and releases the leader lease when the
+// process is told to stop, beego.Run never returns so deferred calls do not run
+func releaseOnSignal() {
+	sig := make(chan os.Signal, 1)
+	signal.Notify(sig, syscall.SIGINT, syscall.SIGTERM)
+	go func() {
+		s := <-sig
+		logs.Info("Received signal: ", s, ", shutting down")
+		task.StopTask()
+		handler.StopLeaderElection()
+		os.Exit(0)
+	}()
+}
+
 func main() {
 
 	// token, _ := common.GenToken("22", "abc")
 	// fmt.Println("-------------:", token)
-	//   models.MakeResourceContent()
 	// return
 	// init db
 	dbOk := models.Initdb()
@@ -28,9 +45,15 @@ func main() {
 		println("error: Database initialization failed")
 		return
 	}
+	// Seal personal fields still stored in plaintext or under an older key
+	if beego.AppConfig.DefaultInt("crypto::migrate_pii", 1) == 1 {
+		handler.MigrateAuthPII()
+	}
 	// 1. Initialize memory resources
 	handler.NewCoursePool(0)
-	handler.InitialResourcePool()
+	// Only the elected replica loads and refills the pools
+	handler.StartLeaderElection()
+	releaseOnSignal()
 	// Initialize a scheduled task
 
 	taskOk := task.InitTask()
@@ -0,0 +1,74 @@
+package models
+
+import (
+	"strings"
+
+	"github.com/astaxie/beego/logs"
+	"github.com/astaxie/beego/orm"
+)
+
+// escapeLike quotes the wildcards of a value matched with like
+func escapeLike(value string) string {
+	return strings.NewReplacer(`\`, `\\`, "%", `\%`, "_", `\_`).Replace(value)
+}
+
+// catalogFilter builds the where clause of the catalog queries, status 0
+// matches every course and the keyword matches name, title and description
+func catalogFilter(status int, keyword string) (string, []interface{}) {
+	where := []string{}
+	args := []interface{}{}
+	if status > 0 {
+		where = append(where, "status = ?")
+		args = append(args, status)
+	}
+	if len(keyword) > 0 {
+		like := "%" + escapeLike(keyword) + "%"
+		where = append(where, "(course_name like ? or course_title like ? or course_desc like ?)")
+		args = append(args, like, like, like)
+	}
+	if len(where) == 0 {
+		return "", args
+	}
+	return " where " + strings.Join(where, " and "), args
+}
+
+// QueryCatalogCourses returns a page of the courses matching the filter and
+// the number of all matching courses
+func QueryCatalogCourses(status int, keyword string, currentPage, pageSize int) (cs []Courses, total int64, err error) {
+	o := orm.NewOrm()
+	where, args := catalogFilter(status, keyword)
+	res := struct {
+		Total int64
+	}{}
+	err = o.Raw("select count(id) total from pg_courses"+where, args...).QueryRow(&res)
+	if err != nil {
+		logs.Error("QueryCatalogCourses, err: ", err)
+		return
+	}
+	total = res.Total
+	args = append(args, pageSize, (currentPage-1)*pageSize)
+	_, err = o.Raw("select * from pg_courses"+where+" order by id asc limit ? offset ?", args...).QueryRows(&cs)
+	if err != nil {
+		logs.Error("QueryCatalogCourses, err: ", err)
+	}
+	return
+}
+
+// QueryCatalogChapters returns the chapters of the courses, in catalog order
+func QueryCatalogChapters(courseIds []string) (cs []CoursesChapter, err error) {
+	if len(courseIds) == 0 {
+		return
+	}
+	args := make([]interface{}, 0, len(courseIds))
+	for _, courseId := range courseIds {
+		args = append(args, courseId)
+	}
+	placeholders := strings.TrimSuffix(strings.Repeat("?,", len(courseIds)), ",")
+	o := orm.NewOrm()
+	_, err = o.Raw("select * from pg_courses_chapter where course_id in ("+placeholders+") order by position asc, id asc",
+		args...).QueryRows(&cs)
+	if err != nil {
+		logs.Error("QueryCatalogChapters, err: ", err)
+	}
+	return
+}
@@ -0,0 +1,27 @@
+package models
+
+import (
+	"github.com/astaxie/beego/orm"
+)
+
+func QueryCertificate(eoi *Certificate, field ...string) error {
+	o := orm.NewOrm()
+	err := o.Read(eoi, field...)
+	return err
+}
+
+// InsertCertificate stores a certificate unless the user already has one for
+// the course, the stored one is returned then
+func InsertCertificate(eoi *Certificate) (bool, error) {
+	o := orm.NewOrm()
+	_, err := o.Insert(eoi)
+	if err == nil {
+		return true, nil
+	}
+	existing := Certificate{UserId: eoi.UserId, CourseId: eoi.CourseId}
+	if readErr := o.Read(&existing, "UserId", "CourseId"); readErr != nil {
+		return false, err
+	}
+	*eoi = existing
+	return false, nil
+}
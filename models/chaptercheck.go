@@ -0,0 +1,30 @@
+package models
+
+import (
+	"github.com/astaxie/beego/logs"
+	"github.com/astaxie/beego/orm"
+)
+
+// Results of a chapter check
+const (
+	CheckPassed = 1
+	CheckFailed = 2
+	CheckError  = 3
+)
+
+func InsertChapterCheckResult(eoi *ChapterCheckResult) (int64, error) {
+	o := orm.NewOrm()
+	id, err := o.Insert(eoi)
+	return id, err
+}
+
+// QueryChapterCheckResultList returns the latest check runs of a user chapter
+func QueryChapterCheckResultList(userId int64, courseId, chapterId string, limit int) (ccr []ChapterCheckResult, err error) {
+	o := orm.NewOrm()
+	_, err = o.Raw("select * from pg_chapter_check_result where user_id = ? and course_id = ? and chapter_id = ? "+
+		"order by id desc limit ?", userId, courseId, chapterId, limit).QueryRows(&ccr)
+	if err != nil {
+		logs.Error("QueryChapterCheckResultList, err: ", err)
+	}
+	return
+}
@@ -171,32 +171,61 @@ func UpdateUserCourseCompleted(CompletedFlag int, courseId string, userId int64)
 	return err
 }
 
-func UpdateUserCourseByCourseId(status int, courseId string) error {
+// Why the rows of a learner were taken offline
+const (
+	OfflineByCourse  = "course-offline"
+	OfflineByChapter = "chapter-offline"
+)
+
+func execAffected(sql string, args ...interface{}) (int64, error) {
 	o := orm.NewOrm()
-	deletTime := common.GetCurTime()
-	err := o.Raw("update pg_user_course set status = ?,delete_time = ? where course_id = ? and status=?",
-		status, deletTime, courseId, 1).QueryRow()
-	logs.Info("UpdateUserCourseByCourseId", err)
-	return err
+	res, err := o.Raw(sql, args...).Exec()
+	if err != nil {
+		return 0, err
+	}
+	return res.RowsAffected()
 }
 
-func UpdateUserCourseChapterByCourseId(status int, courseId string) error {
-	o := orm.NewOrm()
-	deletTime := common.GetCurTime()
-	err := o.Raw("update pg_user_course_chapter set status = ?,delete_time = ? where course_id = ? and status = ?",
-		status, deletTime, courseId, 1).QueryRow()
-	logs.Info("UpdateUserCourseChapterByCourseId", err)
-	return err
+// OfflineUserCourseByCourseId takes the online user rows of a course offline for reason
+func OfflineUserCourseByCourseId(courseId, reason string) (int64, error) {
+	num, err := execAffected("update pg_user_course set status = ?,delete_time = ?,offline_reason = ? "+
+		"where course_id = ? and status = ?", 2, common.GetCurTime(), reason, courseId, 1)
+	logs.Info("OfflineUserCourseByCourseId", err)
+	return num, err
 }
 
-func UpdateUserCourseChapterByChapterId(status int, courseId, chapterId string) error {
-	o := orm.NewOrm()
-	deletTime := common.GetCurTime()
-	err := o.Raw("update pg_user_course_chapter set status = ?,"+
-		"delete_time = ? where course_id = ? and chapter_id = ? and status = ?",
-		status, deletTime, courseId, chapterId, 1).QueryRow()
-	//logs.Info("UpdateUserCourseChapterByChapterId", err)
-	return err
+// RestoreUserCourseByCourseId brings back the user rows of a course taken
+// offline for reason. Rows without a reason were taken offline with their
+// course before reasons were recorded.
+func RestoreUserCourseByCourseId(courseId, reason string) (int64, error) {
+	num, err := execAffected("update pg_user_course set status = ?,delete_time = ?,offline_reason = ?,update_time = ? "+
+		"where course_id = ? and status = ? and (offline_reason = ? or offline_reason = '' or offline_reason is null)",
+		1, "", "", common.GetCurTime(), courseId, 2, reason)
+	logs.Info("RestoreUserCourseByCourseId", err)
+	return num, err
+}
+
+func OfflineUserCourseChapterByCourseId(courseId, reason string) (int64, error) {
+	num, err := execAffected("update pg_user_course_chapter set status = ?,delete_time = ?,offline_reason = ? "+
+		"where course_id = ? and status = ?", 2, common.GetCurTime(), reason, courseId, 1)
+	logs.Info("OfflineUserCourseChapterByCourseId", err)
+	return num, err
+}
+
+func OfflineUserCourseChapterByChapterId(courseId, chapterId, reason string) (int64, error) {
+	return execAffected("update pg_user_course_chapter set status = ?,delete_time = ?,offline_reason = ? "+
+		"where course_id = ? and chapter_id = ? and status = ?", 2, common.GetCurTime(), reason, courseId, chapterId, 1)
+}
+
+// RestoreUserCourseChapterByChapterId brings back the user rows of a chapter
+// taken offline with the chapter or with its course
+func RestoreUserCourseChapterByChapterId(courseId, chapterId string) (int64, error) {
+	num, err := execAffected("update pg_user_course_chapter set status = ?,delete_time = ?,offline_reason = ?,update_time = ? "+
+		"where course_id = ? and chapter_id = ? and status = ? "+
+		"and (offline_reason in (?, ?) or offline_reason = '' or offline_reason is null)",
+		1, "", "", common.GetCurTime(), courseId, chapterId, 2, OfflineByCourse, OfflineByChapter)
+	logs.Info("RestoreUserCourseChapterByChapterId", err)
+	return num, err
 }
 
 func QueryUserCourseCount(userId int64) (count int64) {
@@ -0,0 +1,80 @@
+package models
+
+import (
+	"github.com/astaxie/beego/logs"
+	"github.com/astaxie/beego/orm"
+)
+
+const (
+	SyncRunRunning = "running"
+	SyncRunSuccess = "success"
+	SyncRunFailed  = "failed"
+)
+
+func QueryCourseSyncRun(eoi *CourseSyncRun, field ...string) error {
+	o := orm.NewOrm()
+	err := o.Read(eoi, field...)
+	return err
+}
+
+// insert data
+func InsertCourseSyncRun(eoi *CourseSyncRun) (int64, error) {
+	o := orm.NewOrm()
+	id, err := o.Insert(eoi)
+	return id, err
+}
+
+func UpdateCourseSyncRun(eoi *CourseSyncRun, fields ...string) error {
+	o := orm.NewOrm()
+	_, err := o.Update(eoi, fields...)
+	return err
+}
+
+// QueryCourseSyncRunList returns the latest sync runs, newest first
+func QueryCourseSyncRunList(limit int) (runs []CourseSyncRun, num int64, err error) {
+	o := orm.NewOrm()
+	num, err = o.Raw("select * from pg_course_sync_run order by id desc limit ?", limit).QueryRows(&runs)
+	if err != nil {
+		logs.Error("QueryCourseSyncRunList, err: ", err)
+	}
+	return
+}
+
+// QueryLastFullCourseSyncRun returns the latest run of the whole catalog with
+// a status, runs scoped to some courses are left out
+func QueryLastFullCourseSyncRun(status string) (run CourseSyncRun, err error) {
+	o := orm.NewOrm()
+	err = o.Raw("select * from pg_course_sync_run where status = ? and scope = '' order by id desc limit 1",
+		status).QueryRow(&run)
+	return
+}
+
+func InsertCourseSyncDiffs(diffs []CourseSyncDiff) error {
+	if len(diffs) == 0 {
+		return nil
+	}
+	o := orm.NewOrm()
+	_, err := o.InsertMulti(100, diffs)
+	return err
+}
+
+func QueryCourseSyncDiffList(runId int64) (diffs []CourseSyncDiff, num int64, err error) {
+	o := orm.NewOrm()
+	num, err = o.Raw("select * from pg_course_sync_diff where run_id = ? order by id", runId).QueryRows(&diffs)
+	if err != nil {
+		logs.Error("QueryCourseSyncDiffList, err: ", err)
+	}
+	return
+}
+
+// DeleteCourseSyncRunBefore removes the runs started before startTime and their diffs
+func DeleteCourseSyncRunBefore(startTime string) error {
+	o := orm.NewOrm()
+	_, err := o.Raw("delete from pg_course_sync_diff where run_id in "+
+		"(select id from pg_course_sync_run where start_time < ?)", startTime).Exec()
+	if err != nil {
+		return err
+	}
+	_, err = o.Raw("delete from pg_course_sync_run where start_time < ?", startTime).Exec()
+	return err
+}
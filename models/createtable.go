@@ -12,7 +12,7 @@ type AuthUserInfo struct {
 	SubUid              string `orm:"size(256);column(uid);unique" description:"用户的uuid"`
 	Name                string `orm:"size(512);column(name)" description:"姓名"`
 	UserName            string `orm:"size(512);column(user_name)" description:"用户名"`
-	PhoneNumber         string `orm:"size(32);column(phone_number)" description:"手机号"`
+	PhoneNumber         string `orm:"size(512);column(phone_number)" description:"手机号"`
 	PhoneNumberVerified int8   `orm:"column(phone_number_verified)" description:"手机号是否认证, 0: 未认证;1:已认证"`
 	NickName            string `orm:"size(512);column(nick_name)" description:"昵称"`
 	Picture             string `orm:"type(text);column(picture)" description:"头像"`
@@ -24,6 +24,11 @@ type AuthUserInfo struct {
 	CreateTime          string `orm:"size(32);column(create_time);" description:"创建时间"`
 	UpdateTime          string `orm:"size(32);column(update_time);null" description:"更新时间"`
 	DeleteTime          string `orm:"size(32);column(delete_time);null" description:"删除时间"`
+	// Name, PhoneNumber, Email and AccessToken are stored sealed, see SealField,
+	// and looked up by keyed hash
+	EmailHash       string `orm:"size(64);column(email_hash);index;null" description:"邮箱的哈希值"`
+	PhoneHash       string `orm:"size(64);column(phone_hash);index;null" description:"手机号的哈希值"`
+	AccessTokenHash string `orm:"size(64);column(access_token_hash);index;null" description:"token的哈希值"`
 }
 
 type AuthUserDetail struct {
@@ -79,6 +84,8 @@ type AuthTokenInfo struct {
 	CreateTime   string `orm:"size(32);column(create_time);"`
 	UpdateTime   string `orm:"size(32);column(update_time);null"`
 	DeleteTime   string `orm:"size(32);column(delete_time);null"`
+	// The tokens are stored sealed, AccessToken is looked up by keyed hash
+	AccessTokenHash string `orm:"size(64);column(access_token_hash);index;null"`
 }
 
 type ResourceInfo struct {
@@ -91,6 +98,7 @@ type ResourceInfo struct {
 	PassWord      string `orm:"size(256);column(pass_word)"`
 	ResourId      string `orm:"size(256);column(res_id)"`
 	KindName      string `orm:"size(256);column(kind_name)"`
+	ResourceId    string `orm:"size(32);column(resource_id);null" description:"实例所在集群的资源id"`
 	RemainTime    int64  `orm:"colnum(remain_time)"`
 	CompleteTime  int64  `orm:"colnum(complete_time)"`
 	CreateTime    string `orm:"size(32);column(create_time);"`
@@ -105,6 +113,13 @@ type ResourceConfigPath struct {
 	ResourcePath    string `orm:"size(512);column(resource_path)"`
 	ResourceContent string `orm:"type(text);column(resource_content)"`
 	EncryptionType  string `orm:"size(32);column(encrypt_type)"`
+	CredentialType  string `orm:"size(32);column(credential_type);null" description:"kubeconfig, incluster, token, exec"`
+	// Rows with the same euler branch and path are clusters serving the same image
+	ClusterName string `orm:"size(128);column(cluster_name);null" description:"集群名称"`
+	Region      string `orm:"size(64);column(region);null" description:"集群所在区域"`
+	Weight      int    `orm:"column(weight);default(1)" description:"调度权重"`
+	Capacity    int    `orm:"column(capacity);default(0)" description:"集群可承载的实例数量, 0:不限制"`
+	Status      int8   `orm:"default(1);column(status)" description:"1:可调度; 2:停止调度"`
 }
 
 type UserResourceEnv struct {
@@ -127,8 +142,13 @@ type ResourceTempathRel struct {
 	ResourcePath string `orm:"size(512);column(resource_path)"`
 	ResPoolSize  int    `orm:"colnum(pool_size);default(10)" description:"每个课程当前已申请的资源空闲数量，默认：5"`
 	ResAlarmSize int    `orm:"colnum(alarm_size);default(1)" description:"每个课程当前已空闲的数量低于当前值，就开始告警，默认：1"`
-	CreateTime   string `orm:"size(32);column(create_time);"`
-	UpdateTime   string `orm:"size(32);column(update_time);null"`
+	// Courses with the same resource id, path and template hash share one resource pool
+	TemplateHash   string `orm:"size(64);column(template_hash);null" description:"模板内容哈希"`
+	ResReserveSize int    `orm:"column(reserve_size);default(0)" description:"共享资源池中为该课程保留的最少空闲数量，默认：0"`
+	// The pool of the template content the course used before, drained while the new pool fills
+	PrevPoolKey string `orm:"size(64);column(prev_pool_key);null" description:"模板变更前的资源池标识"`
+	CreateTime  string `orm:"size(32);column(create_time);"`
+	UpdateTime  string `orm:"size(32);column(update_time);null"`
 }
 
 type Courses struct {
@@ -142,6 +162,8 @@ type Courses struct {
 	Banner      string `orm:"size(256);column(course_banner)"`
 	EulerBranch string `orm:"size(512);column(euler_branch)"`
 	Estimated   string `orm:"size(32);column(estimated_time)" description:"课程容器可用时间，单位：min"`
+	Requires    string `orm:"size(1024);column(prerequisites);null" description:"先修课程id, 逗号分隔"`
+	Ordering    string `orm:"size(16);column(chapter_order);null" description:"free: 章节自由学习; sequential: 按顺序学习"`
 	Status      int8   `orm:"default(1);column(status)" description:"1: 正常；2:下线/删除"`
 	Flag        int8   `orm:"default(1);column(flag)" description:"1: 正常；2:正在处理中"`
 	CreateTime  string `orm:"size(32);column(create_time);"`
@@ -159,6 +181,8 @@ type CoursesChapter struct {
 	ResourcePath string `orm:"size(512);column(resource_path)"`
 	EulerBranch  string `orm:"size(512);column(euler_branch)"`
 	Estimated    string `orm:"size(32);column(estimated_time)" description:"章节学习预计完成时间，单位：min"`
+	CheckSpec    string `orm:"type(text);column(check_spec);null" description:"章节完成检查, json"`
+	Position     int    `orm:"column(position);default(0)" description:"章节在课程中的顺序, 从1开始"`
 	Status       int8   `orm:"default(1);column(status)" description:"1: 正常；2:下线/删除"`
 	CreateTime   string `orm:"size(32);column(create_time);"`
 	UpdateTime   string `orm:"size(32);column(update_time);null"`
@@ -173,7 +197,9 @@ type UserCourse struct {
 	CourseName    string `orm:"size(256);column(course_name)" description:"外部课程名称"`
 	CompletedFlag int    `orm:"colnum(completed_flag);default(1)" description:"1: 课程学习中; 2: 课程完成学习"`
 	StudyTime     int64  `orm:"column(study_time)" description:"课程学习时长, 单位：秒"`
+	ActiveTime    int64  `orm:"column(active_time);default(0)" description:"最近一次计入课程的学习心跳, unix时间戳"`
 	Status        int8   `orm:"default(1);column(status)" description:"1: 正常；2:下线/删除"`
+	OfflineReason string `orm:"size(32);column(offline_reason);null" description:"下线原因, 课程重新上线时据此恢复"`
 	CreateTime    string `orm:"size(32);column(create_time);"`
 	UpdateTime    string `orm:"size(32);column(update_time);null"`
 	DeleteTime    string `orm:"size(32);column(delete_time);null"`
@@ -192,12 +218,172 @@ type UserCourseChapter struct {
 	CompletedFlag int    `orm:"colnum(completed_flag);default(1)" description:"1: 课程章节学习中; 2: 课程章节完成学习"`
 	ResourcePath  string `orm:"size(512);column(resource_path)"`
 	StudyTime     int64  `orm:"column(study_time)" description:"章节学习时长, 单位：秒"`
+	ActiveTime    int64  `orm:"column(active_time);default(0)" description:"最近一次学习心跳, unix时间戳"`
 	Status        int8   `orm:"default(1);column(status)" description:"1: 正常；2:下线/删除"`
+	OfflineReason string `orm:"size(32);column(offline_reason);null" description:"下线原因, 章节重新上线时据此恢复"`
 	CreateTime    string `orm:"size(32);column(create_time);"`
 	UpdateTime    string `orm:"size(32);column(update_time);null"`
 	DeleteTime    string `orm:"size(32);column(delete_time);null"`
 }
 
+type LeaderLock struct {
+	Id         int64  `orm:"pk;auto;column(id)"`
+	LockName   string `orm:"size(128);column(lock_name);unique" description:"锁名称"`
+	Holder     string `orm:"size(256);column(holder)" description:"当前持有者"`
+	ExpireTime int64  `orm:"column(expire_time)" description:"租约到期时间, unix时间戳"`
+	CreateTime string `orm:"size(32);column(create_time);"`
+	UpdateTime string `orm:"size(32);column(update_time);null"`
+}
+
+// PoolInstance is an idle member of a shared resource pool, any replica
+// claims it by switching status from 1 to 2 with a version check
+type PoolInstance struct {
+	Id           int64  `orm:"pk;auto;column(id)"`
+	PoolKey      string `orm:"size(64);column(pool_key);index" description:"资源池标识"`
+	ResName      string `orm:"size(128);column(res_name);unique" description:"资源名称"`
+	Subdomain    string `orm:"size(128);column(subdomain)"`
+	NamePassword string `orm:"size(256);column(name_password)"`
+	ContactEmail string `orm:"size(256);column(contact_email)"`
+	Status       int8   `orm:"default(1);column(status)" description:"1:空闲; 2:已领取"`
+	TemplateHash string `orm:"size(64);column(template_hash);null" description:"创建该实例的模板内容哈希"`
+	ClaimBy      string `orm:"size(256);column(claim_by);null" description:"领取者"`
+	ClaimTime    string `orm:"size(32);column(claim_time);null"`
+	Version      int64  `orm:"column(version);default(0)"`
+	CreateTime   string `orm:"size(32);column(create_time);"`
+	UpdateTime   string `orm:"size(32);column(update_time);null"`
+}
+
+// TemplateRegistry is one version of a course template. Name is the template
+// path in the course repository, EulerBranch binds it to the clusters that
+// serve the image, see ResourceConfigPath.
+type TemplateRegistry struct {
+	Id          int64  `orm:"pk;auto;column(id)"`
+	Name        string `orm:"size(512);column(name);index" description:"模板路径"`
+	Version     int    `orm:"column(version)" description:"模板版本"`
+	ContentHash string `orm:"size(64);column(content_hash)" description:"模板内容哈希"`
+	Content     string `orm:"type(text);column(content)" description:"模板内容"`
+	Backend     string `orm:"size(32);column(backend)" description:"container, vm, lxd"`
+	EulerBranch string `orm:"size(512);column(euler_branch)" description:"绑定的镜像, 对应集群配置"`
+	CreateTime  string `orm:"size(32);column(create_time);"`
+}
+
+// CourseTemplateMap maps a course, or one of its chapters, to a template version
+type CourseTemplateMap struct {
+	Id             int64  `orm:"pk;auto;column(id)"`
+	CourseId       string `orm:"size(128);column(course_id);index" description:"课程id"`
+	ChapterId      string `orm:"size(256);column(chapter_id)" description:"章节id, 为空时对整个课程生效"`
+	EulerBranch    string `orm:"size(512);column(euler_branch)"`
+	TemplateId     int64  `orm:"column(template_id)" description:"当前模板版本"`
+	PrevTemplateId int64  `orm:"column(prev_template_id);default(0)" description:"上一个模板版本, 用于回滚"`
+	Pinned         int8   `orm:"column(pinned);default(2)" description:"1: 固定版本; 2: 跟随最新版本"`
+	CreateTime     string `orm:"size(32);column(create_time);"`
+	UpdateTime     string `orm:"size(32);column(update_time);null"`
+}
+
+func (t *TemplateRegistry) TableUnique() [][]string {
+	return [][]string{{"Name", "Version"}}
+}
+
+func (c *CourseTemplateMap) TableUnique() [][]string {
+	return [][]string{{"CourseId", "ChapterId", "EulerBranch"}}
+}
+
+// CourseSyncRun is one run of the course catalog sync
+type CourseSyncRun struct {
+	Id        int64  `orm:"pk;auto;column(id)"`
+	Source    string `orm:"size(32);column(source)" description:"http, dir, git"`
+	Trigger   string `orm:"size(64);column(trigger_by)" description:"cron, webhook, startup"`
+	Scope     string `orm:"type(text);column(scope);null" description:"同步的课程id, 为空时为全部课程"`
+	Revision  string `orm:"size(64);column(revision);null" description:"目录版本, git提交或内容哈希"`
+	Status    string `orm:"size(32);column(status);index" description:"running, success, failed"`
+	Message   string `orm:"type(text);column(message);null"`
+	Added     int    `orm:"column(added);default(0)"`
+	Updated   int    `orm:"column(updated);default(0)"`
+	Unchanged int    `orm:"column(unchanged);default(0)"`
+	Offline   int    `orm:"column(offline);default(0)"`
+	Rejected  int    `orm:"column(rejected);default(0)"`
+	StartTime string `orm:"size(32);column(start_time);index"`
+	EndTime   string `orm:"size(32);column(end_time);null"`
+}
+
+// CourseSyncDiff is a change a sync run made to a course or chapter, field
+// level for updates
+type CourseSyncDiff struct {
+	Id        int64  `orm:"pk;auto;column(id)"`
+	RunId     int64  `orm:"column(run_id);index"`
+	CourseId  string `orm:"size(128);column(course_id)" description:"课程id"`
+	ChapterId string `orm:"size(256);column(chapter_id);null" description:"章节id, 为空时为课程"`
+	Action    string `orm:"size(32);column(action)" description:"added, updated, offline, rejected"`
+	Field     string `orm:"size(128);column(field);null"`
+	OldValue  string `orm:"type(text);column(old_value);null"`
+	NewValue  string `orm:"type(text);column(new_value);null"`
+}
+
+// OfflineTeardown is a bound instance of an offline course waiting for its
+// grace period to end before it is deleted
+type OfflineTeardown struct {
+	Id          int64  `orm:"pk;auto;column(id)"`
+	CourseId    string `orm:"size(128);column(course_id);index" description:"课程id"`
+	ResourceId  string `orm:"size(32);column(resource_id)" description:"实例所在集群的资源id"`
+	EnvResource string `orm:"size(512);column(env_resource)" description:"实例的模板路径"`
+	ResName     string `orm:"size(256);column(res_name);unique" description:"实例名称"`
+	UserName    string `orm:"size(256);column(user_name);null"`
+	DeleteAt    int64  `orm:"column(delete_at);index" description:"删除时间, unix时间戳"`
+	CreateTime  string `orm:"size(32);column(create_time);"`
+}
+
+// PendingTeardown is a cluster of an offline course whose bound instances are
+// not recorded in OfflineTeardown yet, OfflineTeardownTask retries it
+type PendingTeardown struct {
+	Id          int64  `orm:"pk;auto;column(id)"`
+	CourseId    string `orm:"size(128);column(course_id)" description:"课程id"`
+	ResourceId  string `orm:"size(32);column(resource_id)" description:"集群的资源id"`
+	EnvResource string `orm:"size(512);column(env_resource)" description:"模板路径"`
+	CreateTime  string `orm:"size(32);column(create_time);"`
+}
+
+func (t *PendingTeardown) TableUnique() [][]string {
+	return [][]string{{"CourseId", "ResourceId", "EnvResource"}}
+}
+
+// ChapterCheckResult is a run of the completion check of a chapter in the
+// instance of a learner
+type ChapterCheckResult struct {
+	Id         int64  `orm:"pk;auto;column(id)"`
+	UserId     int64  `orm:"column(user_id);index" description:"用户id"`
+	CourseId   string `orm:"size(128);column(course_id);index" description:"课程id"`
+	ChapterId  string `orm:"size(256);column(chapter_id)" description:"课程章节id"`
+	ResName    string `orm:"size(256);column(res_name)" description:"执行检查的实例名称"`
+	Result     int8   `orm:"column(result)" description:"1: 通过; 2: 未通过; 3: 执行失败"`
+	ExitCode   int    `orm:"column(exit_code)"`
+	Output     string `orm:"type(text);column(output);null"`
+	Message    string `orm:"size(512);column(message);null"`
+	CreateTime string `orm:"size(32);column(create_time);"`
+}
+
+// Certificate is the signed record of a user completing a course, see
+// handler.CertificateBody for what the signature covers
+type Certificate struct {
+	Id            int64  `orm:"pk;auto;column(id)"`
+	CertId        string `orm:"size(64);column(cert_id);unique" description:"证书编号"`
+	UserId        int64  `orm:"column(user_id);index" description:"用户id"`
+	CourseId      string `orm:"size(128);column(course_id);index" description:"课程id"`
+	Issuer        string `orm:"size(256);column(issuer)"`
+	UserName      string `orm:"size(512);column(user_name)" description:"证书上的用户名称"`
+	CourseTitle   string `orm:"size(256);column(course_title)"`
+	CompletedDate string `orm:"size(32);column(completed_date)" description:"完成日期"`
+	StudyTime     int64  `orm:"column(study_time)" description:"课程学习时长, 单位：秒"`
+	IssuedAt      string `orm:"size(32);column(issued_at)"`
+	KeyId         string `orm:"size(64);column(key_id)" description:"签名密钥id"`
+	Signature     string `orm:"size(256);column(signature)"`
+	CreateTime    string `orm:"size(32);column(create_time);"`
+}
+
+// A user gets one certificate per course
+func (c *Certificate) TableUnique() [][]string {
+	return [][]string{{"UserId", "CourseId"}}
+}
+
 func CreateDb() bool {
 	BConfig, err := config.NewConfig("ini", "conf/app.conf")
 	if err != nil {
@@ -214,6 +400,10 @@ func CreateDb() bool {
 			new(UserResourceEnv), new(ResourceTempathRel),
 			new(Courses), new(CoursesChapter),
 			new(UserCourse), new(UserCourseChapter),
+			new(LeaderLock), new(PoolInstance),
+			new(TemplateRegistry), new(CourseTemplateMap),
+			new(CourseSyncRun), new(CourseSyncDiff),
+			new(OfflineTeardown), new(PendingTeardown), new(ChapterCheckResult), new(Certificate),
 		)
 		logs.Info("table create success!")
 		errosyn := orm.RunSyncdb("default", false, true)
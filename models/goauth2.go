@@ -1,60 +1,167 @@
 package models
 
-import "github.com/astaxie/beego/orm"
+import (
+	"github.com/astaxie/beego/logs"
+	"github.com/astaxie/beego/orm"
+)
+
+// The personal fields and tokens of the auth tables are sealed on write and
+// opened on read here, see pii.go. Lookups by Email, PhoneNumber or the access
+// token go through their keyed hash columns. A field that fails to open stays
+// sealed, and is written back as stored, until its key is configured again.
 
 func QueryAuthUserInfo(eoi *AuthUserInfo, field ...string) error {
 	o := orm.NewOrm()
-	err := o.Read(eoi, field...)
+	lookup := make([]string, 0, len(field))
+	byHash := false
+	for _, f := range field {
+		byHash = byHash || hasField([]string{f}, "Email", "email", "PhoneNumber", "phone_number",
+			"AccessToken", "access_token")
+		switch {
+		case hasField([]string{f}, "Email", "email"):
+			sealed, _ := sealAuthUserInfo(eoi)
+			eoi.EmailHash = sealed.EmailHash
+			lookup = append(lookup, "EmailHash")
+		case hasField([]string{f}, "PhoneNumber", "phone_number"):
+			sealed, _ := sealAuthUserInfo(eoi)
+			eoi.PhoneHash = sealed.PhoneHash
+			lookup = append(lookup, "PhoneHash")
+		case hasField([]string{f}, "AccessToken", "access_token"):
+			sealed, _ := sealAuthUserInfo(eoi)
+			eoi.AccessTokenHash = sealed.AccessTokenHash
+			lookup = append(lookup, "AccessTokenHash")
+		default:
+			lookup = append(lookup, f)
+		}
+	}
+	err := o.Read(eoi, lookup...)
+	if err == orm.ErrNoRows && byHash && !lookupsHashed() {
+		// The row may not be migrated yet, its columns still hold the plaintext
+		err = o.Read(eoi, field...)
+	}
+	if err == nil {
+		if openErr := openAuthUserInfo(eoi); openErr != nil {
+			logs.Error("QueryAuthUserInfo, openErr: ", openErr, ",id: ", eoi.UserId)
+		}
+	}
 	return err
 }
 
 // insert data
 func InsertAuthUserInfo(eoi *AuthUserInfo) (int64, error) {
+	sealed, sealErr := sealAuthUserInfo(eoi)
+	if sealErr != nil {
+		return 0, sealErr
+	}
 	o := orm.NewOrm()
-	id, err := o.Insert(eoi)
+	id, err := o.Insert(&sealed)
+	eoi.UserId = sealed.UserId
+	eoi.EmailHash, eoi.PhoneHash, eoi.AccessTokenHash = sealed.EmailHash, sealed.PhoneHash, sealed.AccessTokenHash
 	return id, err
 }
 
 func UpdateAuthUserInfo(eoi *AuthUserInfo, fields ...string) error {
+	sealed, sealErr := sealAuthUserInfo(eoi)
+	if sealErr != nil {
+		return sealErr
+	}
+	if hasField(fields, "Email", "email") {
+		fields = append(fields, "EmailHash")
+	}
+	if hasField(fields, "PhoneNumber", "phone_number") {
+		fields = append(fields, "PhoneHash")
+	}
+	if hasField(fields, "AccessToken", "access_token") {
+		fields = append(fields, "AccessTokenHash")
+	}
 	o := orm.NewOrm()
-	_, err := o.Update(eoi, fields...)
+	_, err := o.Update(&sealed, fields...)
+	eoi.EmailHash, eoi.PhoneHash, eoi.AccessTokenHash = sealed.EmailHash, sealed.PhoneHash, sealed.AccessTokenHash
 	return err
 }
 
 func QueryAuthUserDetail(eoi *AuthUserDetail, field ...string) error {
 	o := orm.NewOrm()
 	err := o.Read(eoi, field...)
+	if err == nil {
+		if openErr := openAuthUserDetail(eoi); openErr != nil {
+			logs.Error("QueryAuthUserDetail, openErr: ", openErr, ",id: ", eoi.UserDetailId)
+		}
+	}
 	return err
 }
 
 // insert data
 func InsertAuthUserDetail(eoi *AuthUserDetail) (int64, error) {
+	sealed, sealErr := sealAuthUserDetail(eoi)
+	if sealErr != nil {
+		return 0, sealErr
+	}
 	o := orm.NewOrm()
-	id, err := o.Insert(eoi)
+	id, err := o.Insert(&sealed)
+	eoi.UserDetailId = sealed.UserDetailId
 	return id, err
 }
 
 func UpdateAuthUserDetail(eoi *AuthUserDetail, fields ...string) error {
+	sealed, sealErr := sealAuthUserDetail(eoi)
+	if sealErr != nil {
+		return sealErr
+	}
 	o := orm.NewOrm()
-	_, err := o.Update(eoi, fields...)
+	_, err := o.Update(&sealed, fields...)
 	return err
 }
 
 func QueryAuthTokenInfo(eoi *AuthTokenInfo, field ...string) error {
 	o := orm.NewOrm()
-	err := o.Read(eoi, field...)
+	lookup := make([]string, 0, len(field))
+	byHash := false
+	for _, f := range field {
+		if hasField([]string{f}, "AccessToken", "access_token") {
+			byHash = true
+			sealed, _ := sealAuthTokenInfo(eoi)
+			eoi.AccessTokenHash = sealed.AccessTokenHash
+			lookup = append(lookup, "AccessTokenHash")
+			continue
+		}
+		lookup = append(lookup, f)
+	}
+	err := o.Read(eoi, lookup...)
+	if err == orm.ErrNoRows && byHash && !lookupsHashed() {
+		err = o.Read(eoi, field...)
+	}
+	if err == nil {
+		if openErr := openAuthTokenInfo(eoi); openErr != nil {
+			logs.Error("QueryAuthTokenInfo, openErr: ", openErr, ",id: ", eoi.Id)
+		}
+	}
 	return err
 }
 
 // insert data
 func InsertAuthTokenInfo(eoi *AuthTokenInfo) (int64, error) {
+	sealed, sealErr := sealAuthTokenInfo(eoi)
+	if sealErr != nil {
+		return 0, sealErr
+	}
 	o := orm.NewOrm()
-	id, err := o.Insert(eoi)
+	id, err := o.Insert(&sealed)
+	eoi.Id = sealed.Id
+	eoi.AccessTokenHash = sealed.AccessTokenHash
 	return id, err
 }
 
 func UpdateAuthTokenInfo(eoi *AuthTokenInfo, fields ...string) error {
+	sealed, sealErr := sealAuthTokenInfo(eoi)
+	if sealErr != nil {
+		return sealErr
+	}
+	if hasField(fields, "AccessToken", "access_token") {
+		fields = append(fields, "AccessTokenHash")
+	}
 	o := orm.NewOrm()
-	_, err := o.Update(eoi, fields...)
+	_, err := o.Update(&sealed, fields...)
+	eoi.AccessTokenHash = sealed.AccessTokenHash
 	return err
 }
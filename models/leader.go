@@ -0,0 +1,47 @@
+package models
+
+import (
+	"playground_backend/common"
+
+	"github.com/astaxie/beego/logs"
+	"github.com/astaxie/beego/orm"
+)
+
+// AcquireLeaderLock takes the lock row when it is free or expired, or renews it
+// when holder already owns it. It returns true while holder owns the lease.
+// Leases are measured with the clock of the database, so replicas whose clocks
+// drift apart still agree on when a lease runs out.
+func AcquireLeaderLock(lockName, holder string, leaseSeconds int64) (bool, error) {
+	o := orm.NewOrm()
+	res, err := o.Raw("update pg_leader_lock set holder = ?, expire_time = UNIX_TIMESTAMP() + ?, update_time = ? "+
+		"where lock_name = ? and (holder = ? or expire_time < UNIX_TIMESTAMP())",
+		holder, leaseSeconds, common.GetCurTime(), lockName, holder).Exec()
+	if err != nil {
+		return false, err
+	}
+	num, _ := res.RowsAffected()
+	if num > 0 {
+		return true, nil
+	}
+	ll := LeaderLock{LockName: lockName}
+	readErr := o.Read(&ll, "LockName")
+	if readErr != orm.ErrNoRows {
+		return false, nil
+	}
+	_, inErr := o.Raw("insert into pg_leader_lock (lock_name, holder, expire_time, create_time) "+
+		"values (?, ?, UNIX_TIMESTAMP() + ?, ?)", lockName, holder, leaseSeconds, common.GetCurTime()).Exec()
+	if inErr != nil {
+		// Another replica created the row first
+		logs.Info("AcquireLeaderLock, inErr: ", inErr)
+		return false, nil
+	}
+	return true, nil
+}
+
+// ReleaseLeaderLock expires the lease so that another replica can take over at once
+func ReleaseLeaderLock(lockName, holder string) error {
+	o := orm.NewOrm()
+	_, err := o.Raw("update pg_leader_lock set expire_time = ?, update_time = ? where lock_name = ? and holder = ?",
+		0, common.GetCurTime(), lockName, holder).Exec()
+	return err
+}
@@ -0,0 +1,286 @@
+package models
+
+import (
+	"playground_backend/common"
+	"strings"
+	"sync/atomic"
+
+	"github.com/astaxie/beego/logs"
+	"github.com/astaxie/beego/orm"
+)
+
+// Rows migrated per batch by MigrateAuthPII
+const piiBatchSize = 500
+
+// piiHashed is set once every row has its lookup hashes. Until then a lookup
+// that misses by hash is tried again on the plaintext columns, which only
+// rows MigrateAuthPII has not reached yet still hold.
+var piiHashed int32
+
+func lookupsHashed() bool {
+	if atomic.LoadInt32(&piiHashed) == 1 {
+		return true
+	}
+	o := orm.NewOrm()
+	var userNum, tokenNum int
+	userErr := o.Raw("select count(*) total from pg_auth_user_info where " +
+		"(email != '' and (email_hash is null or email_hash = '')) or " +
+		"(phone_number != '' and (phone_hash is null or phone_hash = '')) or " +
+		"(access_token != '' and (access_token_hash is null or access_token_hash = ''))").QueryRow(&userNum)
+	tokenErr := o.Raw("select count(*) total from pg_auth_token_info where " +
+		"access_token != '' and (access_token_hash is null or access_token_hash = '')").QueryRow(&tokenNum)
+	if userErr != nil || tokenErr != nil {
+		logs.Error("lookupsHashed, userErr: ", userErr, ", tokenErr: ", tokenErr)
+		return false
+	}
+	if userNum > 0 || tokenNum > 0 {
+		return false
+	}
+	atomic.StoreInt32(&piiHashed, 1)
+	return true
+}
+
+// normalizeEmail makes the keyed hash of an email independent of case and spacing
+func normalizeEmail(email string) string {
+	return strings.ToLower(strings.TrimSpace(email))
+}
+
+func hasField(fields []string, names ...string) bool {
+	for _, f := range fields {
+		for _, name := range names {
+			if strings.EqualFold(f, name) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// sealFields seals every value in place, stopping at the first error. A value
+// still sealed under a key that is no longer configured cannot be opened, it
+// is kept as stored, so writing the row never replaces the data.
+func sealFields(values ...*string) error {
+	for _, value := range values {
+		sealed, err := common.SealField(*value)
+		if err != nil && common.IsSealed(*value) {
+			logs.Error("sealFields, the value stays sealed under its old key, err: ", err)
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		*value = sealed
+	}
+	return nil
+}
+
+// openFields opens every value in place, values that fail to open stay sealed
+// and the first error is returned
+func openFields(values ...*string) error {
+	var firstErr error
+	for _, value := range values {
+		opened, err := common.OpenField(*value)
+		if err != nil && firstErr == nil {
+			firstErr = err
+		}
+		*value = opened
+	}
+	return firstErr
+}
+
+// hashOf returns the keyed hash of the plaintext of a possibly sealed value.
+// The stored hash is kept for a value that cannot be opened.
+func hashOf(value, stored string, normalize func(string) string) string {
+	opened, err := common.OpenField(value)
+	if err != nil {
+		return stored
+	}
+	if normalize != nil {
+		opened = normalize(opened)
+	}
+	return common.HashField(opened)
+}
+
+// sealAuthUserInfo returns the row as stored, with the personal fields and the
+// access token sealed and the lookup hashes taken from their plaintext
+func sealAuthUserInfo(eoi *AuthUserInfo) (AuthUserInfo, error) {
+	sealed := *eoi
+	sealed.EmailHash = hashOf(eoi.Email, eoi.EmailHash, normalizeEmail)
+	sealed.PhoneHash = hashOf(eoi.PhoneNumber, eoi.PhoneHash, strings.TrimSpace)
+	sealed.AccessTokenHash = hashOf(eoi.AccessToken, eoi.AccessTokenHash, nil)
+	err := sealFields(&sealed.Name, &sealed.PhoneNumber, &sealed.Email, &sealed.AccessToken)
+	return sealed, err
+}
+
+func openAuthUserInfo(eoi *AuthUserInfo) error {
+	return openFields(&eoi.Name, &eoi.PhoneNumber, &eoi.Email, &eoi.AccessToken)
+}
+
+func sealAuthUserDetail(eoi *AuthUserDetail) (AuthUserDetail, error) {
+	sealed := *eoi
+	err := sealFields(&sealed.GivenName, &sealed.FamilyName, &sealed.MiddleName, &sealed.Birthdate,
+		&sealed.Formatted, &sealed.StreetAddress, &sealed.PostalCode, &sealed.Email)
+	return sealed, err
+}
+
+func openAuthUserDetail(eoi *AuthUserDetail) error {
+	return openFields(&eoi.GivenName, &eoi.FamilyName, &eoi.MiddleName, &eoi.Birthdate,
+		&eoi.Formatted, &eoi.StreetAddress, &eoi.PostalCode, &eoi.Email)
+}
+
+func sealAuthTokenInfo(eoi *AuthTokenInfo) (AuthTokenInfo, error) {
+	sealed := *eoi
+	sealed.AccessTokenHash = hashOf(eoi.AccessToken, eoi.AccessTokenHash, nil)
+	err := sealFields(&sealed.AccessToken, &sealed.RefreshToken, &sealed.IdToken)
+	return sealed, err
+}
+
+func openAuthTokenInfo(eoi *AuthTokenInfo) error {
+	return openFields(&eoi.AccessToken, &eoi.RefreshToken, &eoi.IdToken)
+}
+
+// widenPhoneNumber grows pg_auth_user_info.phone_number so it fits an envelope,
+// syncdb only creates missing columns and leaves the old width in place. The
+// width comes from information_schema, the backend only registers mysql.
+func widenPhoneNumber(o orm.Ormer) error {
+	var width int
+	err := o.Raw("select character_maximum_length from information_schema.columns " +
+		"where table_schema = database() and table_name = 'pg_auth_user_info' " +
+		"and column_name = 'phone_number'").QueryRow(&width)
+	if err != nil || width >= 512 {
+		return err
+	}
+	_, err = o.Raw("alter table pg_auth_user_info modify phone_number varchar(512) not null default ''").Exec()
+	return err
+}
+
+// MigrateAuthPII seals the personal fields of rows written in plaintext or under
+// an older key, and fills in the lookup hashes. Rows that are already current
+// are left alone, so it is safe to run on every start. Only one replica runs
+// it at a time, see handler.MigrateAuthPII.
+func MigrateAuthPII() error {
+	o := orm.NewOrm()
+	if err := widenPhoneNumber(o); err != nil {
+		logs.Error("MigrateAuthPII, widenPhoneNumber, err: ", err)
+		return err
+	}
+	userNum, userErr := migrateAuthUserInfo(o)
+	if userErr != nil {
+		return userErr
+	}
+	detailNum, detailErr := migrateAuthUserDetail(o)
+	if detailErr != nil {
+		return detailErr
+	}
+	tokenNum, tokenErr := migrateAuthTokenInfo(o)
+	if tokenErr != nil {
+		return tokenErr
+	}
+	logs.Info("MigrateAuthPII, user info: ", userNum, ", user detail: ", detailNum, ", token info: ", tokenNum)
+	lookupsHashed()
+	return nil
+}
+
+func migrateAuthUserInfo(o orm.Ormer) (int, error) {
+	count := 0
+	lastId := int64(0)
+	for {
+		var rows []AuthUserInfo
+		_, err := o.Raw("select * from pg_auth_user_info where id > ? order by id limit ?",
+			lastId, piiBatchSize).QueryRows(&rows)
+		if err != nil {
+			logs.Error("migrateAuthUserInfo, err: ", err)
+			return count, err
+		}
+		for _, row := range rows {
+			lastId = row.UserId
+			sealed, sealErr := sealAuthUserInfo(&row)
+			if sealErr != nil {
+				logs.Error("migrateAuthUserInfo, sealErr: ", sealErr, ",id: ", row.UserId)
+				continue
+			}
+			if sealed == row {
+				continue
+			}
+			_, upErr := o.Update(&sealed, "Name", "PhoneNumber", "Email", "AccessToken",
+				"EmailHash", "PhoneHash", "AccessTokenHash")
+			if upErr != nil {
+				logs.Error("migrateAuthUserInfo, upErr: ", upErr, ",id: ", row.UserId)
+				return count, upErr
+			}
+			count++
+		}
+		if len(rows) < piiBatchSize {
+			return count, nil
+		}
+	}
+}
+
+func migrateAuthUserDetail(o orm.Ormer) (int, error) {
+	count := 0
+	lastId := int64(0)
+	for {
+		var rows []AuthUserDetail
+		_, err := o.Raw("select * from pg_auth_user_detail where id > ? order by id limit ?",
+			lastId, piiBatchSize).QueryRows(&rows)
+		if err != nil {
+			logs.Error("migrateAuthUserDetail, err: ", err)
+			return count, err
+		}
+		for _, row := range rows {
+			lastId = row.UserDetailId
+			sealed, sealErr := sealAuthUserDetail(&row)
+			if sealErr != nil {
+				logs.Error("migrateAuthUserDetail, sealErr: ", sealErr, ",id: ", row.UserDetailId)
+				continue
+			}
+			if sealed == row {
+				continue
+			}
+			_, upErr := o.Update(&sealed, "GivenName", "FamilyName", "MiddleName", "Birthdate",
+				"Formatted", "StreetAddress", "PostalCode", "Email")
+			if upErr != nil {
+				logs.Error("migrateAuthUserDetail, upErr: ", upErr, ",id: ", row.UserDetailId)
+				return count, upErr
+			}
+			count++
+		}
+		if len(rows) < piiBatchSize {
+			return count, nil
+		}
+	}
+}
+
+func migrateAuthTokenInfo(o orm.Ormer) (int, error) {
+	count := 0
+	lastId := int64(0)
+	for {
+		var rows []AuthTokenInfo
+		_, err := o.Raw("select * from pg_auth_token_info where id > ? order by id limit ?",
+			lastId, piiBatchSize).QueryRows(&rows)
+		if err != nil {
+			logs.Error("migrateAuthTokenInfo, err: ", err)
+			return count, err
+		}
+		for _, row := range rows {
+			lastId = row.Id
+			sealed, sealErr := sealAuthTokenInfo(&row)
+			if sealErr != nil {
+				logs.Error("migrateAuthTokenInfo, sealErr: ", sealErr, ",id: ", row.Id)
+				continue
+			}
+			if sealed == row {
+				continue
+			}
+			_, upErr := o.Update(&sealed, "AccessToken", "RefreshToken", "IdToken", "AccessTokenHash")
+			if upErr != nil {
+				logs.Error("migrateAuthTokenInfo, upErr: ", upErr, ",id: ", row.Id)
+				return count, upErr
+			}
+			count++
+		}
+		if len(rows) < piiBatchSize {
+			return count, nil
+		}
+	}
+}
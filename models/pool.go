@@ -0,0 +1,113 @@
+package models
+
+import (
+	"playground_backend/common"
+
+	"github.com/astaxie/beego/logs"
+	"github.com/astaxie/beego/orm"
+)
+
+const (
+	PoolInstanceFree    = 1
+	PoolInstanceClaimed = 2
+)
+
+type PoolInstanceStat struct {
+	PoolKey string
+	Status  int8
+	Total   int64
+}
+
+// InsertPoolInstanceIfAbsent adds an idle member, a member that is already
+// known keeps its status so that a claimed member is never handed out twice
+func InsertPoolInstanceIfAbsent(pi *PoolInstance) (bool, error) {
+	o := orm.NewOrm()
+	created, _, err := o.ReadOrCreate(pi, "ResName")
+	return created, err
+}
+
+func QueryPoolInstance(pi *PoolInstance, field ...string) error {
+	o := orm.NewOrm()
+	err := o.Read(pi, field...)
+	return err
+}
+
+func CountFreePoolInstance(poolKey string) int {
+	o := orm.NewOrm()
+	var total int
+	err := o.Raw("select count(*) total from pg_pool_instance where pool_key = ? and status = ?",
+		poolKey, PoolInstanceFree).QueryRow(&total)
+	if err != nil {
+		logs.Error("CountFreePoolInstance, err: ", err)
+		return 0
+	}
+	return total
+}
+
+// ClaimPoolInstance claims the oldest idle member of a pool. Candidates are
+// switched with an optimistic update, a candidate taken by another replica in
+// the meantime is skipped. orm.ErrNoRows means the pool has no idle member.
+func ClaimPoolInstance(poolKey, claimBy string) (PoolInstance, error) {
+	o := orm.NewOrm()
+	for attempt := 0; attempt < 3; attempt++ {
+		var piList []PoolInstance
+		num, err := o.Raw("select * from pg_pool_instance where pool_key = ? and status = ? order by id limit 10",
+			poolKey, PoolInstanceFree).QueryRows(&piList)
+		if err != nil && err != orm.ErrNoRows {
+			return PoolInstance{}, err
+		}
+		if num == 0 {
+			return PoolInstance{}, orm.ErrNoRows
+		}
+		for _, pi := range piList {
+			curTime := common.GetCurTime()
+			res, upErr := o.Raw("update pg_pool_instance set status = ?, claim_by = ?, claim_time = ?, "+
+				"version = version + 1, update_time = ? where id = ? and status = ? and version = ?",
+				PoolInstanceClaimed, claimBy, curTime, curTime, pi.Id, PoolInstanceFree, pi.Version).Exec()
+			if upErr != nil {
+				return PoolInstance{}, upErr
+			}
+			if affected, _ := res.RowsAffected(); affected == 1 {
+				pi.Status = PoolInstanceClaimed
+				pi.ClaimBy = claimBy
+				pi.ClaimTime = curTime
+				pi.Version++
+				return pi, nil
+			}
+		}
+	}
+	return PoolInstance{}, orm.ErrNoRows
+}
+
+func DeletePoolInstance(resName string) error {
+	o := orm.NewOrm()
+	_, err := o.Raw("delete from pg_pool_instance where res_name = ?", resName).Exec()
+	return err
+}
+
+// DeleteClaimedPoolInstance removes the claims made before claimTime, the
+// members they point to are bound or have been recycled by now
+func DeleteClaimedPoolInstance(claimTime string) (int64, error) {
+	o := orm.NewOrm()
+	res, err := o.Raw("delete from pg_pool_instance where status = ? and claim_time < ?",
+		PoolInstanceClaimed, claimTime).Exec()
+	if err != nil {
+		return 0, err
+	}
+	return res.RowsAffected()
+}
+
+func QueryPoolInstanceStat() (psList []PoolInstanceStat, num int64, err error) {
+	o := orm.NewOrm()
+	num, err = o.Raw("select pool_key, status, count(*) total from pg_pool_instance " +
+		"group by pool_key, status").QueryRows(&psList)
+	return
+}
+
+// ClearPrevPoolKey forgets a drained previous pool on every course that pointed at it
+func ClearPrevPoolKey(prevPoolKey string) error {
+	o := orm.NewOrm()
+	_, err := o.Raw("update pg_resource_tempath_rel set prev_pool_key = '' where prev_pool_key = ?",
+		prevPoolKey).Exec()
+	return err
+}
@@ -0,0 +1,46 @@
+package models
+
+import (
+	"playground_backend/common"
+
+	"github.com/astaxie/beego/logs"
+	"github.com/astaxie/beego/orm"
+)
+
+// AddUserChapterStudyTime adds seconds to the study time of a user chapter
+// and moves its last heartbeat from activeTime to curTime. It returns false
+// when another heartbeat moved it first, so no interval is counted twice.
+func AddUserChapterStudyTime(id, activeTime, curTime, seconds int64) (bool, error) {
+	num, err := execAffected("update pg_user_course_chapter set study_time = study_time + ?,active_time = ?,update_time = ? "+
+		"where id = ? and active_time = ?", seconds, curTime, common.GetCurTime(), id, activeTime)
+	if err != nil {
+		logs.Error("AddUserChapterStudyTime, err: ", err)
+		return false, err
+	}
+	return num > 0, nil
+}
+
+// AddUserCourseStudyTime adds seconds to the study time of a user course and
+// moves its last heartbeat from activeTime to curTime, like AddUserChapterStudyTime.
+// The heartbeats of every chapter of the course count against the same interval.
+func AddUserCourseStudyTime(id, activeTime, curTime, seconds int64) (bool, error) {
+	num, err := execAffected("update pg_user_course set study_time = study_time + ?,active_time = ?,update_time = ? "+
+		"where id = ? and active_time = ?", seconds, curTime, common.GetCurTime(), id, activeTime)
+	if err != nil {
+		logs.Error("AddUserCourseStudyTime, err: ", err)
+		return false, err
+	}
+	return num > 0, nil
+}
+
+// QueryUserResourceEnvList returns the course environments of a user, one per
+// cluster the user was scheduled onto
+func QueryUserResourceEnvList(userId int64, courseId string) (ure []UserResourceEnv, err error) {
+	o := orm.NewOrm()
+	_, err = o.Raw("select * from pg_user_resource_env where user_id = ? and course_id = ?",
+		userId, courseId).QueryRows(&ure)
+	if err != nil {
+		logs.Error("QueryUserResourceEnvList, err: ", err)
+	}
+	return
+}
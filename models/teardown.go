@@ -0,0 +1,59 @@
+package models
+
+import (
+	"github.com/astaxie/beego/logs"
+	"github.com/astaxie/beego/orm"
+)
+
+func QueryOfflineTeardown(eoi *OfflineTeardown, field ...string) error {
+	o := orm.NewOrm()
+	err := o.Read(eoi, field...)
+	return err
+}
+
+// InsertOfflineTeardown schedules an instance once, a scheduled instance keeps its deadline
+func InsertOfflineTeardown(eoi *OfflineTeardown) (bool, error) {
+	o := orm.NewOrm()
+	created, _, err := o.ReadOrCreate(eoi, "ResName")
+	return created, err
+}
+
+func DeleteOfflineTeardown(eoi *OfflineTeardown) error {
+	o := orm.NewOrm()
+	_, err := o.Delete(eoi)
+	return err
+}
+
+// QueryDueOfflineTeardown returns the instances whose grace period ended by now
+func QueryDueOfflineTeardown(now int64) (ots []OfflineTeardown, num int64, err error) {
+	o := orm.NewOrm()
+	num, err = o.Raw("select * from pg_offline_teardown where delete_at <= ? order by delete_at", now).QueryRows(&ots)
+	if err != nil {
+		logs.Error("QueryDueOfflineTeardown, err: ", err)
+	}
+	return
+}
+
+// InsertPendingTeardown records a cluster to schedule once, it is a no-op when
+// the cluster is already pending
+func InsertPendingTeardown(eoi *PendingTeardown) error {
+	o := orm.NewOrm()
+	_, _, err := o.ReadOrCreate(eoi, "CourseId", "ResourceId", "EnvResource")
+	return err
+}
+
+func DeletePendingTeardown(eoi *PendingTeardown) error {
+	o := orm.NewOrm()
+	_, err := o.Raw("delete from pg_pending_teardown where course_id = ? and resource_id = ? and env_resource = ?",
+		eoi.CourseId, eoi.ResourceId, eoi.EnvResource).Exec()
+	return err
+}
+
+func QueryPendingTeardown() (pts []PendingTeardown, num int64, err error) {
+	o := orm.NewOrm()
+	num, err = o.Raw("select * from pg_pending_teardown order by id").QueryRows(&pts)
+	if err != nil {
+		logs.Error("QueryPendingTeardown, err: ", err)
+	}
+	return
+}
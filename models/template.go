@@ -0,0 +1,112 @@
+package models
+
+import (
+	"github.com/astaxie/beego/logs"
+	"github.com/astaxie/beego/orm"
+)
+
+const (
+	TemplatePinned   = 1
+	TemplateFollowed = 2
+)
+
+func QueryTemplateRegistry(eoi *TemplateRegistry, field ...string) error {
+	o := orm.NewOrm()
+	err := o.Read(eoi, field...)
+	return err
+}
+
+// AddTemplateVersion stores eoi as the next version of its template unless the
+// latest version has the same content and branch, eoi is set to that one then.
+// A concurrent registration of the same version fails on the unique
+// (name, version) and is read again.
+func AddTemplateVersion(eoi *TemplateRegistry) (bool, error) {
+	o := orm.NewOrm()
+	var err error
+	for i := 0; i < 3; i++ {
+		if err = o.Begin(); err != nil {
+			return false, err
+		}
+		latest := TemplateRegistry{}
+		err = o.Raw("select * from pg_template_registry where name = ? order by version desc limit 1 for update",
+			eoi.Name).QueryRow(&latest)
+		if err != nil && err != orm.ErrNoRows {
+			o.Rollback()
+			return false, err
+		}
+		if latest.Id > 0 && latest.ContentHash == eoi.ContentHash && latest.EulerBranch == eoi.EulerBranch {
+			o.Rollback()
+			*eoi = latest
+			return false, nil
+		}
+		eoi.Id = 0
+		eoi.Version = latest.Version + 1
+		if _, err = o.Insert(eoi); err != nil {
+			o.Rollback()
+			logs.Info("AddTemplateVersion, the version was taken, name: ", eoi.Name, ", err: ", err)
+			continue
+		}
+		if err = o.Commit(); err != nil {
+			return false, err
+		}
+		return true, nil
+	}
+	return false, err
+}
+
+// QueryTemplateVersions lists the versions of a template, newest first, or of
+// every template when name is empty. Content is left out.
+func QueryTemplateVersions(name string) (trs []TemplateRegistry, num int64, err error) {
+	o := orm.NewOrm()
+	if len(name) > 0 {
+		num, err = o.Raw("select id,name,version,content_hash,backend,euler_branch,create_time"+
+			" from pg_template_registry where name = ? order by version desc", name).QueryRows(&trs)
+	} else {
+		num, err = o.Raw("select id,name,version,content_hash,backend,euler_branch,create_time" +
+			" from pg_template_registry order by name,version desc").QueryRows(&trs)
+	}
+	if err != nil {
+		logs.Error("QueryTemplateVersions, err: ", err)
+	}
+	return
+}
+
+func QueryCourseTemplateMap(eoi *CourseTemplateMap, field ...string) error {
+	o := orm.NewOrm()
+	err := o.Read(eoi, field...)
+	return err
+}
+
+// InsertCourseTemplateMap stores a mapping unless the course, chapter and
+// branch are mapped already, eoi is set to the stored mapping then
+func InsertCourseTemplateMap(eoi *CourseTemplateMap) (bool, error) {
+	o := orm.NewOrm()
+	_, err := o.Insert(eoi)
+	if err == nil {
+		return true, nil
+	}
+	existing := CourseTemplateMap{CourseId: eoi.CourseId, ChapterId: eoi.ChapterId, EulerBranch: eoi.EulerBranch}
+	if readErr := o.Read(&existing, "CourseId", "ChapterId", "EulerBranch"); readErr != nil {
+		return false, err
+	}
+	*eoi = existing
+	return false, nil
+}
+
+func UpdateCourseTemplateMap(eoi *CourseTemplateMap, fields ...string) error {
+	o := orm.NewOrm()
+	_, err := o.Update(eoi, fields...)
+	return err
+}
+
+func QueryCourseTemplateMapList(courseId string) (ctm []CourseTemplateMap, num int64, err error) {
+	o := orm.NewOrm()
+	num, err = o.Raw("select * from pg_course_template_map where course_id = ?", courseId).QueryRows(&ctm)
+	return
+}
+
+func QueryCourseTemplateRelList(courseId string) (rtr []ResourceTempathRel, num int64, err error) {
+	o := orm.NewOrm()
+	num, err = o.Raw("select * from pg_resource_tempath_rel where course_id = ?", courseId).QueryRows(&rtr)
+	return
+}
@@ -19,8 +19,39 @@ func init() {
 	beego.Router("/playground/crd/resource", &controllers.CrdResourceControllers{})
 	// Bind the course/chapter selected by the user
 	beego.Router("/playground/users/course/chapter", &controllers.CourseChapterControllers{})
+	// Heartbeat of the learning page while a chapter is open, counts the study time
+	beego.Router("/playground/users/course/chapter/heartbeat", &controllers.StudyHeartbeatControllers{}, "post:Post")
+	// Run the completion check of a chapter in the user's instance
+	beego.Router("/playground/users/course/chapter/check", &controllers.ChapterCheckControllers{}, "post:Post")
+	// Certificate of a completed course, signed json or svg
+	beego.Router("/playground/users/course/certificate", &controllers.CertificateControllers{}, "get:Get")
+	// Public verification of a certificate by its id
+	beego.Router("/playground/certificates/:certId", &controllers.CertificateControllers{}, "get:Verify")
 	//
 	beego.Router("/playground/users/checkSubdomain", &controllers.CrdResourceControllers{}, "post:CheckSubdomain")
+	// Catalog of the courses with their chapters and environments
+	beego.Router("/playground/courses", &controllers.CourseCatalogControllers{}, "get:List")
+	beego.Router("/playground/courses/:courseId", &controllers.CourseCatalogControllers{}, "get:Get")
+	// Sync the courses after a change of the course repository, signed with courses::webhook_secret
+	beego.Router("/playground/course-sync/webhook", &controllers.CourseSyncHookControllers{}, "post:Post")
+	// Admin: health of every configured cluster
+	beego.Router("/playground/admin/clusters/health", &controllers.ClusterHealthControllers{})
+	// Admin: register, update, test and retire clusters
+	beego.Router("/playground/admin/clusters", &controllers.ClusterControllers{}, "get:List;post:Register")
+	beego.Router("/playground/admin/clusters/:resourceId", &controllers.ClusterControllers{}, "put:Update;delete:Retire")
+	beego.Router("/playground/admin/clusters/:resourceId/test", &controllers.ClusterControllers{}, "post:Test")
+	// Admin: render, check and dry run a course template
+	beego.Router("/playground/admin/templates/dryrun", &controllers.TemplateControllers{}, "post:DryRun")
+	// Admin: template versions and the versions courses are mapped to
+	beego.Router("/playground/admin/templates", &controllers.TemplateControllers{}, "get:List;post:Register")
+	beego.Router("/playground/admin/courses/:courseId/templates", &controllers.CourseTemplateControllers{}, "get:List;put:Set")
+	beego.Router("/playground/admin/courses/:courseId/templates/rollback", &controllers.CourseTemplateControllers{}, "post:Rollback")
+	beego.Router("/playground/admin/courses/:courseId/templates/refresh", &controllers.CourseTemplateControllers{}, "post:Refresh")
+	// Admin: history of the course catalog sync
+	beego.Router("/playground/admin/course-sync/runs", &controllers.CourseSyncControllers{}, "get:List")
+	beego.Router("/playground/admin/course-sync/runs/:runId", &controllers.CourseSyncControllers{}, "get:Get")
+	// Admin: re-encrypt stored secrets under the active key
+	beego.Router("/playground/admin/secrets/rotate", &controllers.SecretControllers{}, "post:Rotate")
 	// Health check interface
 	beego.Router("/healthz/readiness", &controllers.HealthzReadController{})
 	beego.Router("/healthz/liveness", &controllers.HealthzLiveController{})
@@ -18,23 +18,37 @@ func StopTask() {
 // Clear used resource image instance resources
 func ClearInstanceTask(clInvalidInstance string) {
 	invalidTask := toolbox.NewTask("ClearInvaildResource",
-		clInvalidInstance, handler.ClearInvaildResource)
+		clInvalidInstance, handler.LeaderTask("ClearInvaildResource", handler.ClearInvaildResource))
 	toolbox.AddTask("ClearInvaildResource", invalidTask)
 }
 
 // Synchronized course list and chapter information
 func SyncCourseTask(syncCourse string) {
-	syncCourseTask := toolbox.NewTask("SyncCourse", syncCourse, handler.SyncCourse)
+	syncCourseTask := toolbox.NewTask("SyncCourse", syncCourse,
+		handler.LeaderTask("SyncCourse", handler.SyncCourseTask))
 	toolbox.AddTask("SyncCourse", syncCourseTask)
 }
 
 // Ensure that new courses can generate resource pools
 func ApplyCoursePoolTask(applyCoursePool string) {
 	applyCoursePoolTask := toolbox.NewTask("ApplyCoursePoolTask",
-		applyCoursePool, handler.ApplyCoursePoolTask)
+		applyCoursePool, handler.LeaderTask("ApplyCoursePoolTask", handler.ApplyCoursePoolTask))
 	toolbox.AddTask("ApplyCoursePoolTask", applyCoursePoolTask)
 }
 
+// Delete the bound instances of offline courses after their grace period
+func OfflineTeardownTask(offlineTeardown string) {
+	offlineTeardownTask := toolbox.NewTask("OfflineTeardownTask",
+		offlineTeardown, handler.LeaderTask("OfflineTeardownTask", handler.OfflineTeardownTask))
+	toolbox.AddTask("OfflineTeardownTask", offlineTeardownTask)
+}
+
+// Probe the clusters, every replica keeps its own view of their health
+func ClusterHealthTask(clusterHealth string) {
+	clusterHealthTask := toolbox.NewTask("ClusterHealthTask", clusterHealth, handler.ClusterHealthTask)
+	toolbox.AddTask("ClusterHealthTask", clusterHealthTask)
+}
+
 //InitTask Timing task initialization
 func InitTask() bool {
 	// Clear used resource image instance resources
@@ -55,5 +69,17 @@ func InitTask() bool {
 		applyCoursePool := beego.AppConfig.String("crontab::apply_course_pool")
 		ApplyCoursePoolTask(applyCoursePool)
 	}
+	// Delete the bound instances of offline courses
+	offlineTeardownFlag, err := beego.AppConfig.Int("crontab::offline_teardown_flag")
+	if offlineTeardownFlag == 1 && err == nil {
+		offlineTeardown := beego.AppConfig.String("crontab::offline_teardown")
+		OfflineTeardownTask(offlineTeardown)
+	}
+	// Probe the clusters
+	clusterHealthFlag, err := beego.AppConfig.Int("crontab::cluster_health_flag")
+	if clusterHealthFlag == 1 && err == nil {
+		clusterHealth := beego.AppConfig.String("crontab::cluster_health")
+		ClusterHealthTask(clusterHealth)
+	}
 	return true
 }